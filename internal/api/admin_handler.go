@@ -0,0 +1,321 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/cursor"
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/tokens"
+	"github.com/martialanouman/femProject/internal/utils"
+)
+
+const impersonationTokenTTL = 30 * time.Minute
+
+type setRoleRequest struct {
+	Role store.Role `json:"role"`
+}
+
+// AdminHandler lets admins manage any user account.
+type AdminHandler struct {
+	userStore  store.UserStore
+	tokenStore store.TokenStore
+	auditStore store.AuditStore
+	cursors    *cursor.Codec
+	logger     *log.Logger
+}
+
+func NewAdminHandler(userStore store.UserStore, tokenStore store.TokenStore, auditStore store.AuditStore, cursors *cursor.Codec, logger *log.Logger) *AdminHandler {
+	return &AdminHandler{
+		userStore:  userStore,
+		tokenStore: tokenStore,
+		auditStore: auditStore,
+		cursors:    cursors,
+		logger:     logger,
+	}
+}
+
+// HandleListUsers lists users by id, searched with q (part of the username or
+// email) and filtered by role and suspended.
+func (h *AdminHandler) HandleListUsers(w http.ResponseWriter, r *http.Request) {
+	take, skip, err := utils.ReadPaginationParams(r)
+	if err != nil || skip != 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid pagination parameters"})
+		return
+	}
+
+	qs := r.URL.Query()
+	filter := store.UserFilter{
+		Query: qs.Get("q"),
+		Role:  store.Role(qs.Get("role")),
+		Take:  take,
+	}
+
+	if filter.Role != "" && !filter.Role.Valid() {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid role parameter"})
+		return
+	}
+
+	if param := qs.Get("suspended"); param != "" {
+		suspended, err := strconv.ParseBool(param)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid suspended parameter"})
+			return
+		}
+		filter.Suspended = &suspended
+	}
+
+	filter.After, err = utils.ReadCursorParam(r, h.cursors)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid cursor"})
+		return
+	}
+
+	page, err := h.userStore.ListUsers(filter)
+	if errors.Is(err, cursor.ErrInvalidCursor) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid cursor"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: ListUsers %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	nextCursor, err := utils.EncodeCursor(h.cursors, page.Next)
+	if err != nil {
+		h.logger.Printf("ERROR: EncodeCursor %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"users": page.Users, "take": take, "next_cursor": nextCursor})
+}
+
+func (h *AdminHandler) HandleGetUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// HandleSuspendUser keeps a user from logging in and ends all their sessions.
+func (h *AdminHandler) HandleSuspendUser(w http.ResponseWriter, r *http.Request) {
+	h.setSuspended(w, r, true)
+}
+
+func (h *AdminHandler) HandleUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	h.setSuspended(w, r, false)
+}
+
+func (h *AdminHandler) setSuspended(w http.ResponseWriter, r *http.Request, suspended bool) {
+	user, ok := h.readOtherUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.userStore.SetSuspended(user.Id, suspended)
+	if err != nil {
+		h.logger.Printf("ERROR: SetSuspended %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if suspended {
+		err = h.tokenStore.RevokeAllTokens(user.Id)
+		if err != nil {
+			h.logger.Printf("ERROR: RevokeAllTokens %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	action := store.AuditUserUnsuspended
+	if suspended {
+		action = store.AuditUserSuspended
+	}
+	h.recordUserEvent(r, user, action, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleRevokeUserTokens logs a user out everywhere, API keys included.
+func (h *AdminHandler) HandleRevokeUserTokens(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.readUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.tokenStore.RevokeAllTokens(user.Id)
+	if err != nil {
+		h.logger.Printf("ERROR: RevokeAllTokens %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.recordUserEvent(r, user, store.AuditSessionsRevoked, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleSetUserRole changes the role of a user and ends all their sessions.
+func (h *AdminHandler) HandleSetUserRole(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.readOtherUser(w, r)
+	if !ok {
+		return
+	}
+
+	var req setRoleRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding payload %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if !req.Role.Valid() {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "role must be one of user, coach, admin"})
+		return
+	}
+
+	err = h.userStore.SetRole(user.Id, req.Role)
+	if err != nil {
+		h.logger.Printf("ERROR: SetRole %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	// tokens issued under the former role must not keep its permissions
+	err = h.tokenStore.RevokeAllTokens(user.Id)
+	if err != nil {
+		h.logger.Printf("ERROR: RevokeAllTokens %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.recordUserEvent(r, user, store.AuditRoleChanged, map[string]any{"from": user.Role, "to": req.Role})
+	user.Role = req.Role
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+// HandleDeleteUser deletes an account along with its workouts and tokens.
+func (h *AdminHandler) HandleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.readOtherUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := h.userStore.DeleteUser(user.Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: DeleteUser %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.recordUserEvent(r, user, store.AuditUserDeleted, nil)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleImpersonateUser issues a short-lived token to act as a user, for
+// support. Requests made with it are logged and cannot change credentials.
+func (h *AdminHandler) HandleImpersonateUser(w http.ResponseWriter, r *http.Request) {
+	user, ok := h.readOtherUser(w, r)
+	if !ok {
+		return
+	}
+
+	if user.Role == store.RoleAdmin {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "admins cannot be impersonated"})
+		return
+	}
+
+	if user.IsSuspended() {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "suspended users cannot be impersonated"})
+		return
+	}
+
+	admin := middleware.GetUser(r)
+	token, err := tokens.GenerateToken(user.Id, impersonationTokenTTL, tokens.ScopeImpersonation)
+	if err != nil {
+		h.logger.Printf("ERROR: GenerateToken %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	token.ImpersonatorId = admin.Id
+	token.Device = requestDevice(r, "impersonation by "+admin.Username)
+	err = h.tokenStore.Insert(token)
+	if err != nil {
+		h.logger.Printf("ERROR: Insert %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.recordUserEvent(r, user, store.AuditImpersonation, map[string]any{"expiry": token.Expiry})
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"impersonation_token": token, "user": user})
+}
+
+// recordUserEvent records an action of the authenticated admin on user.
+func (h *AdminHandler) recordUserEvent(r *http.Request, user *store.User, action string, metadata map[string]any) {
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:    &middleware.GetUser(r).Id,
+		UserId:     &user.Id,
+		Action:     action,
+		TargetType: store.AuditTargetUser,
+		TargetId:   &user.Id,
+		Metadata:   metadata,
+	})
+}
+
+// readUser loads the user given in the path, writing the error response
+// itself when it cannot.
+func (h *AdminHandler) readUser(w http.ResponseWriter, r *http.Request) (*store.User, bool) {
+	userId, err := utils.ReadIdParam(r)
+	if err != nil {
+		h.logger.Printf("ERROR: ReadIdParam %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid user id"})
+		return nil, false
+	}
+
+	user, err := h.userStore.GetUserById(userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "user not found"})
+		return nil, false
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: GetUserById %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil, false
+	}
+
+	return user, true
+}
+
+// readOtherUser is readUser for actions admins may not take on their own
+// account, which could leave no admin able to undo them.
+func (h *AdminHandler) readOtherUser(w http.ResponseWriter, r *http.Request) (*store.User, bool) {
+	user, ok := h.readUser(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	if user.Id == middleware.GetUser(r).Id {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "admins cannot do this to their own account"})
+		return nil, false
+	}
+
+	return user, true
+}
@@ -0,0 +1,205 @@
+package api
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/tokens"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *fakeUserStore) SetRole(userId int64, role store.Role) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.Role = role
+	return nil
+}
+
+func (s *fakeUserStore) SetSuspended(userId int64, suspended bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userId]
+	if !ok {
+		return sql.ErrNoRows
+	}
+
+	user.SuspendedAt = nil
+	if suspended {
+		now := time.Now()
+		user.SuspendedAt = &now
+	}
+
+	return nil
+}
+
+func (s *fakeTokenStore) RevokeAllTokens(userId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for plaintext, token := range s.tokens {
+		if token.UserId == userId {
+			delete(s.tokens, plaintext)
+		}
+	}
+
+	return nil
+}
+
+// count returns the number of tokens of userId in scope.
+func (s *fakeTokenStore) count(userId int64, scope string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for _, token := range s.tokens {
+		if token.UserId == userId && token.Scope == scope {
+			count++
+		}
+	}
+
+	return count
+}
+
+func withURLParam(r *http.Request, key, value string) *http.Request {
+	routeContext := chi.NewRouteContext()
+	routeContext.URLParams.Add(key, value)
+	return r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, routeContext))
+}
+
+// newAdminTest returns a handler along with an admin and a user who holds a
+// session and an API key.
+func newAdminTest(t *testing.T) (*AdminHandler, *fakeUserStore, *fakeTokenStore, *fakeAuditStore, *store.User, *store.User) {
+	userStore := newFakeUserStore()
+	admin := &store.User{Username: "admin", Email: "admin@example.com", Role: store.RoleAdmin}
+	user := &store.User{Username: "janedoe", Email: "jane@example.com", Role: store.RoleUser}
+	require.NoError(t, userStore.CreateUser(admin))
+	require.NoError(t, userStore.CreateUser(user))
+
+	tokenStore := newFakeTokenStore()
+	for _, scope := range []string{tokens.ScopeAuth, tokens.ScopeRefresh, tokens.ScopeAPIKey} {
+		_, err := tokenStore.CreateToken(user.Id, time.Hour, scope)
+		require.NoError(t, err)
+	}
+
+	auditStore := &fakeAuditStore{}
+	handler := NewAdminHandler(userStore, tokenStore, auditStore, nil, log.New(io.Discard, "", 0))
+
+	return handler, userStore, tokenStore, auditStore, admin, user
+}
+
+// adminRequest makes a request of admin on the user with the given id.
+func adminRequest(admin *store.User, method string, userId int64, body string) *http.Request {
+	req := httptest.NewRequest(method, "/admin/users/"+strconv.FormatInt(userId, 10), strings.NewReader(body))
+	return withURLParam(middleware.SetUser(req, admin), "id", strconv.FormatInt(userId, 10))
+}
+
+func TestSetUserRole(t *testing.T) {
+	handler, userStore, tokenStore, auditStore, admin, user := newAdminTest(t)
+
+	rec := httptest.NewRecorder()
+	handler.HandleSetUserRole(rec, adminRequest(admin, http.MethodPut, user.Id, `{"role": "coach"}`))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"role": "coach"`)
+
+	updated, err := userStore.GetUserById(user.Id)
+	require.NoError(t, err)
+	assert.Equal(t, store.RoleCoach, updated.Role)
+
+	for _, scope := range []string{tokens.ScopeAuth, tokens.ScopeRefresh, tokens.ScopeAPIKey} {
+		assert.Zero(t, tokenStore.count(user.Id, scope), "%s tokens keep the permissions of the former role", scope)
+	}
+	assert.Equal(t, []string{store.AuditRoleChanged}, auditStore.actions())
+
+	rec = httptest.NewRecorder()
+	handler.HandleSetUserRole(rec, adminRequest(admin, http.MethodPut, user.Id, `{"role": "owner"}`))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.HandleSetUserRole(rec, adminRequest(admin, http.MethodPut, 42, `{"role": "coach"}`))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestSuspendUser(t *testing.T) {
+	handler, userStore, tokenStore, auditStore, admin, user := newAdminTest(t)
+
+	rec := httptest.NewRecorder()
+	handler.HandleSuspendUser(rec, adminRequest(admin, http.MethodPut, user.Id, ""))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	suspended, err := userStore.GetUserById(user.Id)
+	require.NoError(t, err)
+	assert.True(t, suspended.IsSuspended())
+	for _, scope := range []string{tokens.ScopeAuth, tokens.ScopeRefresh, tokens.ScopeAPIKey} {
+		assert.Zero(t, tokenStore.count(user.Id, scope), "%s tokens outlive the suspension", scope)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.HandleImpersonateUser(rec, adminRequest(admin, http.MethodPost, user.Id, ""))
+	assert.Equal(t, http.StatusConflict, rec.Code, "suspended users cannot be impersonated")
+
+	rec = httptest.NewRecorder()
+	handler.HandleUnsuspendUser(rec, adminRequest(admin, http.MethodDelete, user.Id, ""))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	unsuspended, err := userStore.GetUserById(user.Id)
+	require.NoError(t, err)
+	assert.False(t, unsuspended.IsSuspended())
+
+	assert.Equal(t, []string{store.AuditUserSuspended, store.AuditUserUnsuspended}, auditStore.actions())
+}
+
+func TestAdminForbiddenActions(t *testing.T) {
+	handler, userStore, tokenStore, auditStore, admin, _ := newAdminTest(t)
+
+	other := &store.User{Username: "root", Email: "root@example.com", Role: store.RoleAdmin}
+	require.NoError(t, userStore.CreateUser(other))
+
+	tests := []struct {
+		name   string
+		handle http.HandlerFunc
+		method string
+		userId int64
+		body   string
+		want   int
+	}{
+		{name: "demote self", handle: handler.HandleSetUserRole, method: http.MethodPut, userId: admin.Id, body: `{"role": "user"}`, want: http.StatusConflict},
+		{name: "suspend self", handle: handler.HandleSuspendUser, method: http.MethodPut, userId: admin.Id, want: http.StatusConflict},
+		{name: "delete self", handle: handler.HandleDeleteUser, method: http.MethodDelete, userId: admin.Id, want: http.StatusConflict},
+		{name: "impersonate self", handle: handler.HandleImpersonateUser, method: http.MethodPost, userId: admin.Id, want: http.StatusConflict},
+		{name: "impersonate another admin", handle: handler.HandleImpersonateUser, method: http.MethodPost, userId: other.Id, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.handle(rec, adminRequest(admin, tt.method, tt.userId, tt.body))
+			assert.Equal(t, tt.want, rec.Code)
+		})
+	}
+
+	current, err := userStore.GetUserById(admin.Id)
+	require.NoError(t, err)
+	assert.Equal(t, store.RoleAdmin, current.Role)
+	assert.False(t, current.IsSuspended())
+	assert.Zero(t, tokenStore.count(other.Id, tokens.ScopeImpersonation))
+	assert.Empty(t, auditStore.actions())
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/tokens"
+	"github.com/martialanouman/femProject/internal/utils"
+)
+
+type createAPIKeyRequest struct {
+	Name          string             `json:"name"`
+	Permissions   tokens.Permissions `json:"permissions"`
+	ExpiresInDays *int               `json:"expires_in_days"`
+}
+
+const (
+	defaultAPIKeyTTLDays = 365
+	maxAPIKeyTTLDays     = 5 * 365
+)
+
+type APIKeyHandler struct {
+	store      store.TokenStore
+	auditStore store.AuditStore
+	logger     *log.Logger
+}
+
+func NewAPIKeyHandler(store store.TokenStore, auditStore store.AuditStore, logger *log.Logger) *APIKeyHandler {
+	return &APIKeyHandler{
+		store:      store,
+		auditStore: auditStore,
+		logger:     logger,
+	}
+}
+
+func (h *APIKeyHandler) validateCreateAPIKeyRequest(req *createAPIKeyRequest) error {
+	if req.Name == "" {
+		return errors.New("name is required")
+	}
+
+	if len(req.Permissions) == 0 {
+		return errors.New("at least one permission is required")
+	}
+
+	err := req.Permissions.Validate()
+	if err != nil {
+		return err
+	}
+
+	if req.ExpiresInDays != nil && (*req.ExpiresInDays < 1 || *req.ExpiresInDays > maxAPIKeyTTLDays) {
+		return errors.New("expires_in_days must be between 1 and 1825")
+	}
+
+	return nil
+}
+
+func (h *APIKeyHandler) HandleCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding request %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	err = h.validateCreateAPIKeyRequest(&req)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	ttlDays := defaultAPIKeyTTLDays
+	if req.ExpiresInDays != nil {
+		ttlDays = *req.ExpiresInDays
+	}
+
+	currentUser := middleware.GetUser(r)
+	token, err := tokens.GenerateToken(currentUser.Id, time.Duration(ttlDays)*24*time.Hour, tokens.ScopeAPIKey)
+	if err != nil {
+		h.logger.Printf("ERROR: generating api key %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+	token.Name = req.Name
+	token.Permissions = req.Permissions
+	token.Device = requestDevice(r, "")
+
+	err = h.store.Insert(token)
+	if err != nil {
+		h.logger.Printf("ERROR: inserting api key %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	apiKey := store.APIKey{
+		Id:          token.Id,
+		Name:        token.Name,
+		Permissions: token.Permissions,
+		Token:       token.Plaintext,
+		CreatedAt:   time.Now(),
+		Expiry:      token.Expiry,
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:    &currentUser.Id,
+		UserId:     &currentUser.Id,
+		Action:     store.AuditAPIKeyCreated,
+		TargetType: store.AuditTargetAPIKey,
+		TargetId:   &token.Id,
+		Metadata:   map[string]any{"name": token.Name, "permissions": token.Permissions},
+	})
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"api_key": apiKey})
+}
+
+func (h *APIKeyHandler) HandleListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	keys, err := h.store.ListAPIKeys(currentUser.Id)
+	if err != nil {
+		h.logger.Printf("ERROR: ListAPIKeys %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"api_keys": keys})
+}
+
+func (h *APIKeyHandler) HandleRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	keyId, err := utils.ReadIdParam(r)
+	if err != nil {
+		h.logger.Printf("ERROR: ReadIdParam %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid api key id"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	err = h.store.RevokeAPIKey(currentUser.Id, keyId)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "api key not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: RevokeAPIKey %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:    &currentUser.Id,
+		UserId:     &currentUser.Id,
+		Action:     store.AuditAPIKeyRevoked,
+		TargetType: store.AuditTargetAPIKey,
+		TargetId:   &keyId,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,77 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/tokens"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *fakeTokenStore) RevokeAPIKey(userId int64, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for plaintext, token := range s.tokens {
+		if token.Id == id && token.UserId == userId && token.Scope == tokens.ScopeAPIKey {
+			delete(s.tokens, plaintext)
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+func TestAPIKeys(t *testing.T) {
+	tokenStore := newFakeTokenStore()
+	auditStore := &fakeAuditStore{}
+	handler := NewAPIKeyHandler(tokenStore, auditStore, log.New(io.Discard, "", 0))
+
+	user := &store.User{Id: 1, Username: "janedoe"}
+	create := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/users/me/api-keys", strings.NewReader(body))
+		handler.HandleCreateAPIKey(rec, middleware.SetUser(req, user))
+		return rec
+	}
+
+	revoke := func(userId int64, id string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "/users/me/api-keys/"+id, nil)
+		handler.HandleRevokeAPIKey(rec, withURLParam(middleware.SetUser(req, &store.User{Id: userId}), "id", id))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusBadRequest, create(`{"name": "ci", "permissions": []}`).Code)
+	assert.Equal(t, http.StatusBadRequest, create(`{"name": "ci", "permissions": ["workouts:delete"]}`).Code, "unknown permissions are refused")
+	assert.Equal(t, http.StatusBadRequest, create(`{"name": "ci", "permissions": ["workouts:read"], "expires_in_days": 0}`).Code)
+
+	rec := create(`{"name": "ci", "permissions": ["workouts:read"]}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var body struct {
+		APIKey store.APIKey `json:"api_key"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	require.Contains(t, tokenStore.tokens, body.APIKey.Token)
+	key := tokenStore.tokens[body.APIKey.Token]
+	assert.Equal(t, tokens.ScopeAPIKey, key.Scope)
+	assert.Equal(t, tokens.Permissions{tokens.PermissionWorkoutsRead}, key.Permissions, "keys only get the permissions asked for")
+
+	id := strconv.FormatInt(body.APIKey.Id, 10)
+	assert.Equal(t, http.StatusNotFound, revoke(2, id).Code, "keys of other users cannot be revoked")
+	assert.Equal(t, http.StatusNoContent, revoke(user.Id, id).Code)
+	assert.NotContains(t, tokenStore.tokens, body.APIKey.Token)
+
+	assert.Equal(t, []string{store.AuditAPIKeyCreated, store.AuditAPIKeyRevoked}, auditStore.actions())
+}
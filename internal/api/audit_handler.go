@@ -0,0 +1,143 @@
+package api
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/martialanouman/femProject/internal/cursor"
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/utils"
+)
+
+// AuditHandler serves the audit log, to users for their own account and to
+// admins for every account.
+type AuditHandler struct {
+	store   store.AuditStore
+	cursors *cursor.Codec
+	logger  *log.Logger
+}
+
+func NewAuditHandler(store store.AuditStore, cursors *cursor.Codec, logger *log.Logger) *AuditHandler {
+	return &AuditHandler{
+		store:   store,
+		cursors: cursors,
+		logger:  logger,
+	}
+}
+
+// HandleListCurrentUserEvents lists the events concerning the authenticated
+// user, filtered by action, from and to.
+func (h *AuditHandler) HandleListCurrentUserEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := h.readAuditFilter(r)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	filter.UserId = &middleware.GetUser(r).Id
+	h.writeEventPage(w, filter)
+}
+
+// HandleListEvents lists the events of every account, filtered by actor_id
+// and user_id on top of the filters of HandleListCurrentUserEvents.
+func (h *AuditHandler) HandleListEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := h.readAuditFilter(r)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	idParams := []struct {
+		name  string
+		value **int64
+	}{
+		{"actor_id", &filter.ActorId},
+		{"user_id", &filter.UserId},
+	}
+
+	qs := r.URL.Query()
+	for _, param := range idParams {
+		if qs.Get(param.name) == "" {
+			continue
+		}
+
+		id, err := strconv.ParseInt(qs.Get(param.name), 10, 64)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid " + param.name + " parameter"})
+			return
+		}
+		*param.value = &id
+	}
+
+	h.writeEventPage(w, filter)
+}
+
+func (h *AuditHandler) readAuditFilter(r *http.Request) (store.AuditFilter, error) {
+	filter := store.AuditFilter{
+		Action: r.URL.Query().Get("action"),
+	}
+
+	take, skip, err := utils.ReadPaginationParams(r)
+	if err != nil || skip != 0 {
+		return filter, errors.New("invalid pagination parameters")
+	}
+	filter.Take = take
+
+	filter.From, _, err = utils.ReadOptionalTimeParam(r, "from")
+	if err != nil {
+		return filter, err
+	}
+
+	filter.To, err = utils.ReadOptionalEndTimeParam(r, "to")
+	if err != nil {
+		return filter, err
+	}
+
+	filter.After, err = utils.ReadCursorParam(r, h.cursors)
+	if err != nil {
+		return filter, errors.New("invalid cursor")
+	}
+
+	return filter, nil
+}
+
+func (h *AuditHandler) writeEventPage(w http.ResponseWriter, filter store.AuditFilter) {
+	page, err := h.store.ListEvents(filter)
+	if errors.Is(err, cursor.ErrInvalidCursor) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid cursor"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: ListEvents %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	nextCursor, err := utils.EncodeCursor(h.cursors, page.Next)
+	if err != nil {
+		h.logger.Printf("ERROR: EncodeCursor %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"events": page.Events, "take": filter.Take, "next_cursor": nextCursor})
+}
+
+// recordEvent saves an audit event along with the IP of the client and the
+// admin impersonating the user, if any. A failure is only logged: the action
+// audited already happened.
+func recordEvent(auditStore store.AuditStore, logger *log.Logger, r *http.Request, event store.AuditEvent) {
+	event.IP = utils.ClientIP(r)
+	if middleware.IsImpersonating(r) {
+		event.ImpersonatorId = &middleware.GetRealUser(r).Id
+	}
+
+	err := auditStore.RecordEvent(&event)
+	if err != nil {
+		logger.Printf("ERROR: recording %s audit event %v", event.Action, err)
+	}
+}
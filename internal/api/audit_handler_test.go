@@ -0,0 +1,179 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/cursor"
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// ListEvents pages through the recorded events like the Postgres store:
+// newest first, by id.
+func (s *fakeAuditStore) ListEvents(filter store.AuditFilter) (*store.AuditPage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if filter.After != nil && (filter.After.Sort != "-id" || filter.After.Before) {
+		return nil, cursor.ErrInvalidCursor
+	}
+
+	page := &store.AuditPage{Events: []store.AuditEvent{}}
+	for i := len(s.events) - 1; i >= 0; i-- {
+		event := s.events[i]
+		switch {
+		case filter.ActorId != nil && (event.ActorId == nil || *event.ActorId != *filter.ActorId),
+			filter.UserId != nil && (event.UserId == nil || *event.UserId != *filter.UserId),
+			filter.Action != "" && event.Action != filter.Action,
+			filter.From != nil && event.CreatedAt.Before(*filter.From),
+			filter.To != nil && !event.CreatedAt.Before(*filter.To),
+			filter.After != nil && event.Id >= filter.After.Id:
+			continue
+		}
+
+		if len(page.Events) == filter.Take {
+			page.Next = &cursor.Cursor{Sort: "-id", Id: page.Events[filter.Take-1].Id}
+			break
+		}
+		page.Events = append(page.Events, event)
+	}
+
+	return page, nil
+}
+
+func TestListAuditEvents(t *testing.T) {
+	owner := &store.User{Id: 1, Username: "janedoe", Role: store.RoleUser}
+	other := &store.User{Id: 2, Username: "johndoe", Role: store.RoleUser}
+	admin := &store.User{Id: 3, Username: "admin", Role: store.RoleAdmin}
+
+	event := func(id int64, actor *store.User, user *store.User, action string, createdAt string) store.AuditEvent {
+		at, err := time.Parse(time.RFC3339, createdAt)
+		require.NoError(t, err)
+		return store.AuditEvent{Id: id, ActorId: &actor.Id, UserId: &user.Id, Action: action, CreatedAt: at}
+	}
+
+	auditStore := &fakeAuditStore{events: []store.AuditEvent{
+		event(1, owner, owner, store.AuditLogin, "2026-10-01T10:00:00Z"),
+		event(2, other, other, store.AuditLogin, "2026-10-02T10:00:00Z"),
+		event(3, admin, owner, store.AuditRoleChanged, "2026-10-03T10:00:00Z"),
+		event(4, owner, owner, store.AuditPasswordChanged, "2026-10-03T23:00:00Z"),
+		event(5, owner, owner, store.AuditLogin, "2026-10-05T10:00:00Z"),
+	}}
+	handler := NewAuditHandler(auditStore, cursor.NewCodec([]byte("secret")), log.New(io.Discard, "", 0))
+
+	type page struct {
+		Events     []store.AuditEvent `json:"events"`
+		NextCursor *string            `json:"next_cursor"`
+	}
+
+	list := func(handle http.HandlerFunc, user *store.User, query url.Values) (*httptest.ResponseRecorder, page) {
+		rec := httptest.NewRecorder()
+		handle(rec, middleware.SetUser(httptest.NewRequest(http.MethodGet, "/audit?"+query.Encode(), nil), user))
+
+		var body page
+		if rec.Code == http.StatusOK {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		}
+		return rec, body
+	}
+
+	ids := func(body page) []int64 {
+		ids := []int64{}
+		for _, event := range body.Events {
+			ids = append(ids, event.Id)
+		}
+		return ids
+	}
+
+	t.Run("current user", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			query url.Values
+			want  []int64
+		}{
+			{name: "own events", query: url.Values{}, want: []int64{5, 4, 3, 1}},
+			{name: "user_id ignored", query: url.Values{"user_id": {"2"}}, want: []int64{5, 4, 3, 1}},
+			{name: "action", query: url.Values{"action": {store.AuditLogin}}, want: []int64{5, 1}},
+			{name: "date range including the whole last day", query: url.Values{"from": {"2026-10-03"}, "to": {"2026-10-03"}}, want: []int64{4, 3}},
+			{name: "instants", query: url.Values{"from": {"2026-10-01T12:00:00Z"}, "to": {"2026-10-03T23:00:00Z"}}, want: []int64{3}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rec, body := list(handler.HandleListCurrentUserEvents, owner, tt.query)
+				require.Equal(t, http.StatusOK, rec.Code)
+				assert.Equal(t, tt.want, ids(body))
+			})
+		}
+	})
+
+	t.Run("admin", func(t *testing.T) {
+		tests := []struct {
+			name  string
+			query url.Values
+			want  []int64
+		}{
+			{name: "every account", query: url.Values{}, want: []int64{5, 4, 3, 2, 1}},
+			{name: "actor", query: url.Values{"actor_id": {"3"}}, want: []int64{3}},
+			{name: "user", query: url.Values{"user_id": {"2"}}, want: []int64{2}},
+			{name: "actor and action", query: url.Values{"actor_id": {"1"}, "action": {store.AuditLogin}}, want: []int64{5, 1}},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				rec, body := list(handler.HandleListEvents, admin, tt.query)
+				require.Equal(t, http.StatusOK, rec.Code)
+				assert.Equal(t, tt.want, ids(body))
+			})
+		}
+	})
+
+	t.Run("paging", func(t *testing.T) {
+		rec, first := list(handler.HandleListEvents, admin, url.Values{"take": {"2"}})
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, []int64{5, 4}, ids(first))
+		require.NotNil(t, first.NextCursor)
+
+		rec, second := list(handler.HandleListEvents, admin, url.Values{"take": {"2"}, "cursor": {*first.NextCursor}})
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, []int64{3, 2}, ids(second))
+		require.NotNil(t, second.NextCursor)
+
+		rec, last := list(handler.HandleListEvents, admin, url.Values{"take": {"2"}, "cursor": {*second.NextCursor}})
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, []int64{1}, ids(last))
+		assert.Nil(t, last.NextCursor)
+
+		rec, own := list(handler.HandleListCurrentUserEvents, owner, url.Values{"take": {"2"}, "cursor": {*first.NextCursor}})
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, []int64{3, 1}, ids(own), "cursors stay within the events of the user")
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		foreign, err := cursor.NewCodec([]byte("secret")).Encode(cursor.Cursor{Sort: "name", Id: 3})
+		require.NoError(t, err)
+
+		for _, query := range []url.Values{
+			{"actor_id": {"abc"}},
+			{"user_id": {"1.5"}},
+			{"from": {"yesterday"}},
+			{"to": {"2026-13-01"}},
+			{"skip": {"2"}},
+			{"take": {"0"}},
+			{"cursor": {"forged"}},
+			{"cursor": {foreign}},
+		} {
+			rec, _ := list(handler.HandleListEvents, admin, query)
+			assert.Equal(t, http.StatusBadRequest, rec.Code, "%v", query)
+		}
+	})
+}
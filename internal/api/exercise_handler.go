@@ -0,0 +1,139 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/martialanouman/femProject/internal/cursor"
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/utils"
+)
+
+// ExerciseHandler serves the exercise catalog along with the custom exercises
+// of the authenticated user.
+type ExerciseHandler struct {
+	store   store.ExerciseStore
+	cursors *cursor.Codec
+	logger  *log.Logger
+}
+
+func NewExerciseHandler(store store.ExerciseStore, cursors *cursor.Codec, logger *log.Logger) *ExerciseHandler {
+	return &ExerciseHandler{
+		store:   store,
+		cursors: cursors,
+		logger:  logger,
+	}
+}
+
+// HandleListExercises searches the exercises by name or alias with q, and
+// filters them by muscle group and equipment.
+func (h *ExerciseHandler) HandleListExercises(w http.ResponseWriter, r *http.Request) {
+	take, skip, err := utils.ReadPaginationParams(r)
+	if err != nil || skip != 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid pagination parameters"})
+		return
+	}
+
+	after, err := utils.ReadCursorParam(r, h.cursors)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid cursor"})
+		return
+	}
+
+	qs := r.URL.Query()
+	filter := store.ExerciseFilter{
+		UserId:    middleware.GetUser(r).Id,
+		Query:     qs.Get("q"),
+		Muscle:    qs.Get("muscle"),
+		Equipment: qs.Get("equipment"),
+		Take:      take,
+		After:     after,
+	}
+
+	page, err := h.store.ListExercises(filter)
+	if errors.Is(err, cursor.ErrInvalidCursor) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid cursor"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: ListExercises %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	nextCursor, err := utils.EncodeCursor(h.cursors, page.Next)
+	if err != nil {
+		h.logger.Printf("ERROR: EncodeCursor %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"exercises": page.Exercises, "take": take, "next_cursor": nextCursor})
+}
+
+func (h *ExerciseHandler) HandleGetExercise(w http.ResponseWriter, r *http.Request) {
+	exerciseId, err := utils.ReadIdParam(r)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid exercise id"})
+		return
+	}
+
+	exercise, err := h.store.GetExerciseForUser(exerciseId, middleware.GetUser(r).Id)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "exercise not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: GetExerciseForUser %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"exercise": exercise})
+}
+
+// HandleCreateExercise adds a custom exercise only the authenticated user
+// sees, for exercises missing from the catalog.
+func (h *ExerciseHandler) HandleCreateExercise(w http.ResponseWriter, r *http.Request) {
+	var exercise store.Exercise
+	err := json.NewDecoder(r.Body).Decode(&exercise)
+	if err != nil {
+		h.logger.Printf("ERROR: json.Decode %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request data"})
+		return
+	}
+
+	switch {
+	case strings.TrimSpace(exercise.Name) == "":
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "name is required"})
+		return
+	case exercise.UnitType != "" && !exercise.UnitType.Valid():
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "unit_type must be one of reps, time, distance"})
+		return
+	case !exercise.Mechanics.Valid():
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "mechanics must be one of compound, isolation"})
+		return
+	}
+
+	exercise.UserId = &middleware.GetUser(r).Id
+	err = h.store.CreateExercise(&exercise)
+	if errors.Is(err, store.ErrDuplicateExercise) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "you already have an exercise with this name"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: CreateExercise %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"exercise": exercise})
+}
@@ -0,0 +1,337 @@
+package api
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/oidc"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/utils"
+)
+
+const (
+	oidcLoginStateTTL = 10 * time.Minute
+	maxUsernameLength = 50
+
+	// oidcStateCookieName binds a login state to the browser which started
+	// the login, so that a callback cannot be completed by another browser
+	// lured into following it.
+	oidcStateCookieName = "oidc_state"
+)
+
+type OIDCHandler struct {
+	providers  oidc.Providers
+	store      store.IdentityStore
+	auditStore store.AuditStore
+	sessions   *TokenHandler
+	logger     *log.Logger
+}
+
+func NewOIDCHandler(providers oidc.Providers, store store.IdentityStore, auditStore store.AuditStore, sessions *TokenHandler, logger *log.Logger) *OIDCHandler {
+	return &OIDCHandler{
+		providers:  providers,
+		store:      store,
+		auditStore: auditStore,
+		sessions:   sessions,
+		logger:     logger,
+	}
+}
+
+// HandleLogin sends the browser to the login page of the provider.
+func (h *OIDCHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, ok := h.startLogin(w, r, nil)
+	if !ok {
+		return
+	}
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// HandleLinkIdentity returns the URL of the provider's login page, going
+// through which links the provider account to the authenticated user.
+func (h *OIDCHandler) HandleLinkIdentity(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	authURL, ok := h.startLogin(w, r, &currentUser.Id)
+	if !ok {
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"authorization_url": authURL})
+}
+
+func (h *OIDCHandler) startLogin(w http.ResponseWriter, r *http.Request, userId *int64) (string, bool) {
+	provider, err := h.providers.Get(chi.URLParam(r, "provider"))
+	if err != nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "unknown provider"})
+		return "", false
+	}
+
+	state := &store.LoginState{
+		Provider:      provider.Name,
+		DeviceName:    r.URL.Query().Get("device_name"),
+		CookieSession: wantsCookieSession(r),
+		UserId:        userId,
+		Expiry:        time.Now().Add(oidcLoginStateTTL),
+	}
+
+	state.State, err = oidc.NewState()
+	if err == nil {
+		state.Nonce, err = oidc.NewState()
+	}
+	if err == nil {
+		state.CodeVerifier, err = oidc.NewVerifier()
+	}
+	if err != nil {
+		h.logger.Printf("ERROR: generating login state %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return "", false
+	}
+
+	authURL, err := provider.AuthCodeURL(r.Context(), state.State, state.Nonce, state.CodeVerifier)
+	if err != nil {
+		h.logger.Printf("ERROR: AuthCodeURL %v", err)
+		utils.WriteJSON(w, http.StatusBadGateway, utils.Envelope{"error": "provider unavailable"})
+		return "", false
+	}
+
+	err = h.store.CreateLoginState(state)
+	if err != nil {
+		h.logger.Printf("ERROR: CreateLoginState %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return "", false
+	}
+
+	// Lax, as the provider sends the browser back with a cross-site redirect
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Value:    state.State,
+		Path:     "/",
+		MaxAge:   int(oidcLoginStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return authURL, true
+}
+
+// HandleCallback completes a login or a link once the provider sends the
+// user back with an authorization code.
+func (h *OIDCHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	provider, err := h.providers.Get(chi.URLParam(r, "provider"))
+	if err != nil {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "unknown provider"})
+		return
+	}
+
+	query := r.URL.Query()
+	if providerErr := query.Get("error"); providerErr != "" {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": fmt.Sprintf("login refused by provider: %s", providerErr)})
+		return
+	}
+
+	if query.Get("state") == "" || query.Get("code") == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "state and code are required"})
+		return
+	}
+
+	// a state started by another browser, such as an attacker's linking
+	// their provider account, is refused before being consumed
+	cookie, err := r.Cookie(oidcStateCookieName)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(query.Get("state"))) != 1 {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired login state"})
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookieName,
+		Path:     "/",
+		Expires:  time.Unix(0, 0),
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+	})
+
+	state, err := h.store.ConsumeLoginState(query.Get("state"))
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && state.Provider != provider.Name) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired login state"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: ConsumeLoginState %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	claims, err := provider.Exchange(r.Context(), query.Get("code"), state.CodeVerifier, state.Nonce)
+	if errors.Is(err, oidc.ErrInvalidIDToken) {
+		h.logger.Printf("WARNING: %s id token rejected %v", provider.Name, err)
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "login could not be verified"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: Exchange %v", err)
+		utils.WriteJSON(w, http.StatusBadGateway, utils.Envelope{"error": "provider unavailable"})
+		return
+	}
+
+	identity := &store.Identity{
+		Provider: provider.Name,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}
+
+	if state.UserId != nil {
+		h.linkIdentity(w, r, *state.UserId, identity)
+		return
+	}
+
+	user, err := h.store.GetUserByIdentity(provider.Name, claims.Subject)
+	if errors.Is(err, sql.ErrNoRows) {
+		user, err = h.createUser(w, r, claims, identity)
+		if user == nil {
+			return
+		}
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: GetUserByIdentity %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.sessions.completeLogin(w, r, user, state.DeviceName, state.CookieSession)
+}
+
+func (h *OIDCHandler) linkIdentity(w http.ResponseWriter, r *http.Request, userId int64, identity *store.Identity) {
+	err := h.store.LinkIdentity(userId, identity)
+	if errors.Is(err, store.ErrIdentityTaken) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "this provider account is already linked to a user"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: LinkIdentity %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:    &userId,
+		UserId:     &userId,
+		Action:     store.AuditIdentityLinked,
+		TargetType: store.AuditTargetIdentity,
+		TargetId:   &identity.Id,
+		Metadata:   map[string]any{"provider": identity.Provider},
+	})
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"identity": identity})
+}
+
+// createUser registers the user logging in through a provider for the first
+// time. Accounts are not linked by email automatically, as that would hand an
+// existing account to whoever controls the address at the provider: the
+// owner has to log in and link the provider themselves. It writes the error
+// response itself and returns a nil user when registration fails.
+func (h *OIDCHandler) createUser(w http.ResponseWriter, r *http.Request, claims *oidc.Claims, identity *store.Identity) (*store.User, error) {
+	if !emailRegex.MatchString(claims.Email) {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "the provider did not share a valid email address"})
+		return nil, nil
+	}
+
+	user := &store.User{
+		Email:     claims.Email,
+		Activated: claims.EmailVerified,
+	}
+
+	// the account is only reachable through the provider until the user
+	// resets their password
+	randomPassword, err := oidc.NewState()
+	if err == nil {
+		err = user.PasswordHash.Set(randomPassword)
+	}
+	if err != nil {
+		h.logger.Printf("ERROR: hashing password %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil, nil
+	}
+
+	base := usernameFromClaims(claims)
+	user.Username = base
+
+	for attempt := 0; ; attempt++ {
+		err = h.store.CreateUserWithIdentity(user, identity)
+		if !errors.Is(err, store.ErrDuplicateUsername) || attempt == 5 {
+			break
+		}
+
+		user.Username = fmt.Sprintf("%s%d", base, rand.IntN(10000))
+	}
+
+	switch {
+	case errors.Is(err, store.ErrDuplicateEmail):
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "an account already uses this email, log in and link the provider from it"})
+		return nil, nil
+	case errors.Is(err, store.ErrIdentityTaken):
+		// another request registered this identity meanwhile
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "login already in progress, try again"})
+		return nil, nil
+	case err != nil:
+		h.logger.Printf("ERROR: CreateUserWithIdentity %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return nil, nil
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:  &user.Id,
+		UserId:   &user.Id,
+		Action:   store.AuditUserRegistered,
+		Metadata: map[string]any{"provider": identity.Provider},
+	})
+
+	return user, nil
+}
+
+func (h *OIDCHandler) HandleListIdentities(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	identities, err := h.store.ListIdentities(currentUser.Id)
+	if err != nil {
+		h.logger.Printf("ERROR: ListIdentities %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"identities": identities})
+}
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-z0-9_.-]+`)
+
+// usernameFromClaims proposes a username from what the provider tells about
+// the user, leaving room for a numeric suffix should it be taken.
+func usernameFromClaims(claims *oidc.Claims) string {
+	candidate := claims.PreferredUsername
+	if candidate == "" {
+		candidate, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	candidate = usernameInvalidChars.ReplaceAllString(strings.ToLower(candidate), "")
+	if candidate == "" {
+		candidate = "user"
+	}
+
+	return candidate[:min(len(candidate), maxUsernameLength-5)]
+}
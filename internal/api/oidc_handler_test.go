@@ -0,0 +1,114 @@
+package api
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/oidc"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIdentityStore keeps login states in memory.
+type fakeIdentityStore struct {
+	store.IdentityStore
+	mu     sync.Mutex
+	states map[string]*store.LoginState
+}
+
+func (s *fakeIdentityStore) CreateLoginState(state *store.LoginState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.states[state.State] = state
+	return nil
+}
+
+func (s *fakeIdentityStore) ConsumeLoginState(state string) (*store.LoginState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	loginState, ok := s.states[state]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	delete(s.states, state)
+	return loginState, nil
+}
+
+// newDiscoveryServer serves the discovery document of a provider, enough to
+// start logins.
+func newDiscoveryServer(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 server.URL,
+			"authorization_endpoint": server.URL + "/authorize",
+			"token_endpoint":         server.URL + "/token",
+			"jwks_uri":               server.URL + "/jwks",
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func withProvider(r *http.Request, name string) *http.Request {
+	return withURLParam(r, "provider", name)
+}
+
+func TestLinkIdentityStateBoundToBrowser(t *testing.T) {
+	server := newDiscoveryServer(t)
+	provider := oidc.NewProvider(oidc.Config{Name: "stub", Issuer: server.URL, ClientID: "client"}, server.Client())
+	identityStore := &fakeIdentityStore{states: map[string]*store.LoginState{}}
+	handler := NewOIDCHandler(oidc.Providers{"stub": provider}, identityStore, &fakeAuditStore{}, nil, log.New(io.Discard, "", 0))
+
+	attacker := &store.User{Id: 1, Username: "attacker"}
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/users/me/identities/stub", nil)
+	handler.HandleLinkIdentity(rec, withProvider(middleware.SetUser(req, attacker), "stub"))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var body struct {
+		AuthorizationURL string `json:"authorization_url"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+	authURL, err := url.Parse(body.AuthorizationURL)
+	require.NoError(t, err)
+	state := authURL.Query().Get("state")
+	require.NotEmpty(t, state)
+
+	cookies := rec.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, oidcStateCookieName, cookies[0].Name)
+	assert.Equal(t, state, cookies[0].Value)
+	assert.True(t, cookies[0].HttpOnly)
+
+	callback := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/auth/oidc/stub/callback?code=code&state="+url.QueryEscape(state), nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		handler.HandleCallback(rec, withProvider(req, "stub"))
+		return rec
+	}
+
+	// the victim's browser, lured into the callback, holds no such state
+	assert.Equal(t, http.StatusUnauthorized, callback(nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, callback(&http.Cookie{Name: oidcStateCookieName, Value: "another-state"}).Code)
+
+	identityStore.mu.Lock()
+	assert.Contains(t, identityStore.states, state, "refused callbacks leave the state to its browser")
+	identityStore.mu.Unlock()
+}
@@ -1,12 +1,21 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/martialanouman/femProject/internal/lockout"
+	"github.com/martialanouman/femProject/internal/mailer"
 	"github.com/martialanouman/femProject/internal/middleware"
 	"github.com/martialanouman/femProject/internal/store"
 	"github.com/martialanouman/femProject/internal/tokens"
@@ -14,21 +23,71 @@ import (
 )
 
 type createTokenRequest struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
+	Username   string `json:"username"`
+	Password   string `json:"password"`
+	DeviceName string `json:"device_name"`
 }
 
+type verifyTwoFactorRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Code           string `json:"code"`
+	RecoveryCode   string `json:"recovery_code"`
+}
+
+type magicLinkRequest struct {
+	Email      string `json:"email"`
+	DeviceName string `json:"device_name"`
+}
+
+type redeemMagicLinkRequest struct {
+	Token string `json:"token"`
+}
+
+type refreshTokenRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+const (
+	authTokenTTL          = 24 * time.Hour
+	jwtAuthTokenTTL       = 15 * time.Minute
+	refreshTokenTTL       = 30 * 24 * time.Hour
+	twoFactorChallengeTTL = 5 * time.Minute
+	magicLinkTTL          = 15 * time.Minute
+)
+
 type TokenHandler struct {
-	store     store.TokenStore
-	userStore store.UserStore
-	logger    *log.Logger
+	store          store.TokenStore
+	userStore      store.UserStore
+	twoFactorStore store.TwoFactorStore
+	auditStore     store.AuditStore
+	jwt            *tokens.JWTCodec
+	mailer         mailer.Mailer
+	magicLinkURL   string
+	userAttempts   *lockout.Limiter
+	ipAttempts     *lockout.Limiter
+	magicLinks     *lockout.Limiter
+	logger         *log.Logger
 }
 
-func NewTokenHandler(store store.TokenStore, userStore store.UserStore, logger *log.Logger) *TokenHandler {
+// NewTokenHandler returns a handler issuing opaque auth tokens, or JWTs when
+// given a codec to sign them with. Magic links point to magicLinkURL with the
+// token as query parameter, or only carry the token when it is empty.
+func NewTokenHandler(store store.TokenStore, userStore store.UserStore, twoFactorStore store.TwoFactorStore, auditStore store.AuditStore, jwt *tokens.JWTCodec, mailer mailer.Mailer, magicLinkURL string, logger *log.Logger) *TokenHandler {
 	return &TokenHandler{
-		store:     store,
-		userStore: userStore,
-		logger:    logger,
+		store:          store,
+		userStore:      userStore,
+		twoFactorStore: twoFactorStore,
+		auditStore:     auditStore,
+		jwt:            jwt,
+		mailer:         mailer,
+		magicLinkURL:   magicLinkURL,
+		// an IP may legitimately serve several users (NAT, gym wifi), hence
+		// the higher threshold
+		userAttempts: lockout.NewLimiter(5, 30*time.Second, time.Hour, 24*time.Hour),
+		ipAttempts:   lockout.NewLimiter(20, 30*time.Second, time.Hour, 24*time.Hour),
+		// every request counts, so a mailbox cannot be flooded with links
+		magicLinks: lockout.NewLimiter(3, time.Minute, time.Hour, time.Hour),
+		logger:     logger,
 	}
 }
 
@@ -60,45 +119,585 @@ func (h *TokenHandler) HandleCreateToken(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	usernameKey, ip := strings.ToLower(req.Username), utils.ClientIP(r)
+
+	lockedFor := max(h.userAttempts.LockedFor(usernameKey), h.ipAttempts.LockedFor(ip))
+	if lockedFor > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockedFor.Seconds()))))
+		utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "too many failed login attempts, try again later"})
+		return
+	}
+
 	user, err := h.userStore.GetUserByUsername(req.Username)
-	if err != nil || user == nil {
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		h.logger.Printf("ERROR: fetching user %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	ok, err := user.PasswordHash.Matches(req.Password)
+	ok := false
+	if user == nil {
+		store.SimulatePasswordCheck(req.Password)
+	} else {
+		ok, err = user.PasswordHash.Matches(req.Password)
+		if err != nil {
+			h.logger.Printf("ERROR: password matches %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	if !ok {
+		var userId *int64
+		if user != nil {
+			userId = &user.Id
+		}
+
+		recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+			UserId:   userId,
+			Action:   store.AuditLoginFailed,
+			Metadata: map[string]any{"username": req.Username},
+		})
+
+		if delay := h.userAttempts.Fail(usernameKey); delay > 0 {
+			recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+				UserId:   userId,
+				Action:   store.AuditLoginLocked,
+				Metadata: map[string]any{"username": req.Username, "delay": delay.String()},
+			})
+		}
+
+		if delay := h.ipAttempts.Fail(ip); delay > 0 {
+			recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+				Action:   store.AuditLoginLocked,
+				Metadata: map[string]any{"delay": delay.String()},
+			})
+		}
+
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid username or password"})
+		return
+	}
+
+	h.userAttempts.Reset(usernameKey)
+
+	h.completeLogin(w, r, user, req.DeviceName, wantsCookieSession(r))
+}
+
+// wantsCookieSession reports whether a browser client asked for its session
+// in cookies rather than in the response body.
+func wantsCookieSession(r *http.Request) bool {
+	return r.URL.Query().Get("session") == "cookie"
+}
+
+// completeLogin answers a request whose user proved who they are: with a
+// session, or with a challenge to finish the login with a second factor.
+func (h *TokenHandler) completeLogin(w http.ResponseWriter, r *http.Request, user *store.User, deviceName string, cookie bool) {
+	if user.IsSuspended() {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "your account is suspended"})
+		return
+	}
+
+	if user.TOTPEnabled {
+		challenge, err := tokens.GenerateToken(user.Id, twoFactorChallengeTTL, tokens.Scope2FAChallenge)
+		if err != nil {
+			h.logger.Printf("ERROR: generating 2fa challenge %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+		challenge.Device = requestDevice(r, deviceName)
+
+		err = h.store.Insert(challenge)
+		if err != nil {
+			h.logger.Printf("ERROR: inserting 2fa challenge %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+
+		utils.WriteJSON(w, http.StatusAccepted, utils.Envelope{"two_factor_required": true, "challenge_token": challenge})
+		return
+	}
+
+	h.startSession(w, r, user.Id, deviceName, cookie)
+}
+
+// startSession issues the tokens of a new session and writes them out.
+func (h *TokenHandler) startSession(w http.ResponseWriter, r *http.Request, userId int64, deviceName string, cookie bool) {
+	family, err := tokens.NewFamily()
+	if err != nil {
+		h.logger.Printf("ERROR: creating token family %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	authToken, refreshToken, err := h.issueTokenPair(userId, family, requestDevice(r, deviceName))
+	if err != nil {
+		h.logger.Printf("ERROR: creating token %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:  &userId,
+		UserId:   &userId,
+		Action:   store.AuditLogin,
+		Metadata: map[string]any{"device": deviceName},
+	})
+
+	writeSession(w, authToken, refreshToken, cookie)
+}
+
+// writeSession answers with the tokens of a session, in cookies for browser
+// clients which then only get the CSRF token to echo.
+func writeSession(w http.ResponseWriter, authToken, refreshToken *tokens.Token, cookie bool) {
+	if cookie {
+		csrf := middleware.SetSessionCookies(w, authToken, refreshToken)
+		utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"csrf_token": csrf, "expiry": authToken.Expiry})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"auth_token": authToken, "refresh_token": refreshToken})
+}
+
+// HandleVerifyTwoFactor exchanges the challenge of a login and a code of the
+// user's authenticator, or one of their recovery codes, for a session.
+func (h *TokenHandler) HandleVerifyTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req verifyTwoFactorRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding request %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.ChallengeToken == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "challenge_token is required"})
+		return
+	}
+
+	if (req.Code == "") == (req.RecoveryCode == "") {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "either code or recovery_code is required"})
+		return
+	}
+
+	user, challenge, err := h.userStore.GetUserAndToken(req.ChallengeToken, tokens.Scope2FAChallenge)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired challenge token"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: GetUserAndToken %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	// codes are short, guesses are limited like passwords are
+	attemptsKey := fmt.Sprintf("2fa:%d", user.Id)
+	lockedFor := h.userAttempts.LockedFor(attemptsKey)
+	if lockedFor > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(lockedFor.Seconds()))))
+		utils.WriteJSON(w, http.StatusTooManyRequests, utils.Envelope{"error": "too many failed attempts, try again later"})
+		return
+	}
+
+	var ok bool
+	if req.Code != "" {
+		ok, err = verifyTOTPCode(h.twoFactorStore, user, req.Code)
+	} else {
+		ok, err = h.twoFactorStore.UseRecoveryCode(user.Id, req.RecoveryCode)
+	}
+
 	if err != nil {
-		h.logger.Printf("ERROR: password matches %v", err)
+		h.logger.Printf("ERROR: verifying second factor %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
 	if !ok {
-		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "unauthorized"})
+		recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+			UserId: &user.Id,
+			Action: store.AuditTwoFactorFailed,
+		})
+
+		if delay := h.userAttempts.Fail(attemptsKey); delay > 0 {
+			recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+				UserId:   &user.Id,
+				Action:   store.AuditLoginLocked,
+				Metadata: map[string]any{"two_factor": true, "delay": delay.String()},
+			})
+		}
+
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid code"})
+		return
+	}
+
+	h.userAttempts.Reset(attemptsKey)
+
+	// the challenge is single use, losing a race for it means another
+	// request already completed the login
+	_, err = h.store.ConsumeToken(tokens.Scope2FAChallenge, req.ChallengeToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired challenge token"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: ConsumeToken %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if user.IsSuspended() {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "your account is suspended"})
+		return
+	}
+
+	h.startSession(w, r, user.Id, challenge.Device.Name, wantsCookieSession(r))
+}
+
+// HandleRequestMagicLink emails a single-use link logging the user in
+// without their password.
+func (h *TokenHandler) HandleRequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req magicLinkRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding request %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Email == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "email is required"})
+		return
+	}
+
+	// the body is the same for unknown emails, but a registered one inserts a
+	// token first: timing, or a 500 from the store, can still tell them apart
+	accepted := utils.Envelope{"message": "if an account exists for this email, a login link has been sent"}
+
+	emailKey := strings.ToLower(req.Email)
+	if h.magicLinks.LockedFor(emailKey) > 0 {
+		utils.WriteJSON(w, http.StatusAccepted, accepted)
+		return
+	}
+	h.magicLinks.Fail(emailKey)
+
+	user, err := h.userStore.GetUserByEmail(req.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusAccepted, accepted)
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: GetUserByEmail %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	token, err := tokens.GenerateToken(user.Id, magicLinkTTL, tokens.ScopeMagicLink)
+	if err != nil {
+		h.logger.Printf("ERROR: generating magic link %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+	token.Device = requestDevice(r, req.DeviceName)
+
+	err = h.store.Insert(token)
+	if err != nil {
+		h.logger.Printf("ERROR: inserting magic link %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	link := token.Plaintext
+	if h.magicLinkURL != "" {
+		link = h.magicLinkURL + "?token=" + url.QueryEscape(token.Plaintext)
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Your login link",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse the following link to log in, or send its token to POST /tokens/magic-link/redeem:\n\n%s\n\nIt can be used once and expires at %s. If you did not ask to log in, you can ignore this email.\n",
+			user.Username, link, token.Expiry.Format(time.RFC1123),
+		),
+	}
+
+	sendEmail(h.mailer, h.logger, msg)
+
+	utils.WriteJSON(w, http.StatusAccepted, accepted)
+}
+
+// HandleRedeemMagicLink exchanges the token of a magic link for a session,
+// or for a challenge when the user has two-factor authentication enabled.
+func (h *TokenHandler) HandleRedeemMagicLink(w http.ResponseWriter, r *http.Request) {
+	var req redeemMagicLinkRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding request %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"})
+		return
+	}
+
+	user, link, err := h.userStore.GetUserAndToken(req.Token, tokens.ScopeMagicLink)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired login link"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: GetUserAndToken %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	_, err = h.store.ConsumeToken(tokens.ScopeMagicLink, req.Token)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired login link"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: ConsumeToken %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	// following the link proves the user owns the email address
+	if !user.Activated {
+		user.Activated = true
+
+		err = h.userStore.UpdateUser(user)
+		if err != nil {
+			h.logger.Printf("ERROR: UpdateUser %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	h.magicLinks.Reset(strings.ToLower(user.Email))
+
+	h.completeLogin(w, r, user, link.Device.Name, wantsCookieSession(r))
+}
+
+// HandleRefreshToken renews a session given its refresh token, taken from the
+// body or, for browser clients, from its cookie.
+func (h *TokenHandler) HandleRefreshToken(w http.ResponseWriter, r *http.Request) {
+	var req refreshTokenRequest
+
+	// browser clients send their refresh token in a cookie and no body
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil && !errors.Is(err, io.EOF) {
+		h.logger.Printf("ERROR: decoding request %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	fromCookie := false
+	if cookie, err := r.Cookie(middleware.RefreshCookieName); req.RefreshToken == "" && err == nil {
+		csrf, err := r.Cookie(middleware.CSRFCookieName)
+		if err != nil || !middleware.ValidCSRF(r, csrf.Value) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "missing or invalid CSRF token"})
+			return
+		}
+
+		req.RefreshToken, fromCookie = cookie.Value, true
+	}
+
+	if req.RefreshToken == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "refresh_token is required"})
+		return
+	}
+
+	consumed, err := h.store.ConsumeRefreshToken(req.RefreshToken)
+	if errors.Is(err, store.ErrRefreshTokenReused) {
+		h.logger.Printf("WARNING: refresh token reuse detected, token family revoked")
+		recordEvent(h.auditStore, h.logger, r, store.AuditEvent{Action: store.AuditRefreshTokenReused})
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired refresh token"})
+		return
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired refresh token"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: ConsumeRefreshToken %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	const expiry24Hour = 24 * time.Hour
-	token, err := h.store.CreateToken(user.Id, expiry24Hour, tokens.ScopeAuth)
+	// the previous access token of the session is superseded by the new one
+	err = h.store.RevokeTokenFamily(consumed.Family, tokens.ScopeAuth)
+	if err != nil {
+		h.logger.Printf("ERROR: RevokeTokenFamily %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	authToken, refreshToken, err := h.issueTokenPair(consumed.UserId, consumed.Family, requestDevice(r, consumed.Device.Name))
 	if err != nil {
 		h.logger.Printf("ERROR: creating token %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"auth_token": token})
+	writeSession(w, authToken, refreshToken, fromCookie)
+}
+
+// HandleLogout ends the current session, revoking its tokens and clearing its
+// cookies.
+func (h *TokenHandler) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	err := h.store.RevokeSessionByHash(middleware.GetToken(r).Hash)
+	if err != nil {
+		h.logger.Printf("ERROR: RevokeSessionByHash %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId: &currentUser.Id,
+		UserId:  &currentUser.Id,
+		Action:  store.AuditLogout,
+	})
+
+	middleware.ClearSessionCookies(w)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// issueTokenPair creates an access token and the refresh token able to renew
+// it, both belonging to the given family.
+func (h *TokenHandler) issueTokenPair(userId int64, family string, device tokens.Device) (*tokens.Token, *tokens.Token, error) {
+	ttl := authTokenTTL
+	if h.jwt != nil {
+		// JWTs are only checked against revocations every few seconds and
+		// carry a snapshot of the user, they are kept short lived
+		ttl = jwtAuthTokenTTL
+	}
+
+	authToken, err := tokens.GenerateToken(userId, ttl, tokens.ScopeAuth)
+	if err != nil {
+		return nil, nil, err
+	}
+	authToken.Family = family
+	authToken.Device = device
+
+	refreshToken, err := tokens.GenerateToken(userId, refreshTokenTTL, tokens.ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+	refreshToken.Family = family
+	refreshToken.Device = device
+
+	err = h.store.Insert(authToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = h.store.Insert(refreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the session is still recorded by the opaque token, the JWT stands for
+	// it
+	if h.jwt != nil {
+		user, err := h.userStore.GetUserById(userId)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = h.jwt.Sign(authToken, user.Username, string(user.Role), user.Activated)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return authToken, refreshToken, nil
 }
 
 func (h *TokenHandler) HandleRevokeAllTokensForUser(w http.ResponseWriter, r *http.Request) {
 	currentUser := middleware.GetUser(r)
 
-	err := h.store.RevokeAllTokenForUser(currentUser.Id, tokens.ScopeAuth)
+	for _, scope := range []string{tokens.ScopeAuth, tokens.ScopeRefresh} {
+		err := h.store.RevokeAllTokenForUser(currentUser.Id, scope)
+		if err != nil {
+			h.logger.Printf("ERROR: RevokeAllTokenForUser %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId: &currentUser.Id,
+		UserId:  &currentUser.Id,
+		Action:  store.AuditSessionsRevoked,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *TokenHandler) HandleListSessions(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	sessions, err := h.store.ListSessions(currentUser.Id, middleware.GetToken(r).Hash)
+	if err != nil {
+		h.logger.Printf("ERROR: ListSessions %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"sessions": sessions})
+}
+
+func (h *TokenHandler) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	sessionId, err := utils.ReadIdParam(r)
+	if err != nil {
+		h.logger.Printf("ERROR: ReadIdParam %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid session id"})
+		return
+	}
+
+	currentUser := middleware.GetUser(r)
+
+	err = h.store.RevokeSession(currentUser.Id, sessionId)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "session not found"})
+		return
+	}
+
 	if err != nil {
-		h.logger.Printf("ERROR: RevokeAllTokenForUser %v", err)
+		h.logger.Printf("ERROR: RevokeSession %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:    &currentUser.Id,
+		UserId:     &currentUser.Id,
+		Action:     store.AuditSessionRevoked,
+		TargetType: store.AuditTargetSession,
+		TargetId:   &sessionId,
+	})
+
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// requestDevice describes the client behind r, under the name it gave itself.
+func requestDevice(r *http.Request, name string) tokens.Device {
+	return tokens.Device{
+		Name:      name,
+		UserAgent: r.UserAgent(),
+		IP:        utils.ClientIP(r),
+	}
+}
@@ -0,0 +1,626 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/mailer"
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/tokens"
+	"github.com/martialanouman/femProject/internal/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func (s *fakeUserStore) GetUserByEmail(email string) (*store.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Email == email {
+			copied := *user
+			return &copied, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *fakeUserStore) GetUserByUsername(username string) (*store.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, user := range s.users {
+		if user.Username == username {
+			copied := *user
+			return &copied, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func (s *fakeTokenStore) Insert(token *tokens.Token) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastId++
+	token.Id = s.lastId
+	s.tokens[token.Plaintext] = token
+	return nil
+}
+
+func (s *fakeTokenStore) ConsumeRefreshToken(plaintext string) (*tokens.Token, error) {
+	s.mu.Lock()
+	token, ok := s.tokens[plaintext]
+	if !ok || token.Scope != tokens.ScopeRefresh || token.Expiry.Before(time.Now()) {
+		s.mu.Unlock()
+		return nil, sql.ErrNoRows
+	}
+
+	if s.used[plaintext] {
+		s.mu.Unlock()
+		return nil, errors.Join(s.RevokeTokenFamily(token.Family), store.ErrRefreshTokenReused)
+	}
+
+	s.used[plaintext] = true
+	s.mu.Unlock()
+
+	copied := *token
+	return &copied, nil
+}
+
+func (s *fakeTokenStore) RevokeTokenFamily(family string, scopes ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for plaintext, token := range s.tokens {
+		if token.Family == family && (len(scopes) == 0 || slices.Contains(scopes, token.Scope)) {
+			delete(s.tokens, plaintext)
+		}
+	}
+
+	return nil
+}
+
+// fakeLoginUserStore resolves tokens of a fakeTokenStore to their users.
+type fakeLoginUserStore struct {
+	*fakeUserStore
+	tokens *fakeTokenStore
+}
+
+func (s *fakeLoginUserStore) GetUserAndToken(plaintext string, scopes ...string) (*store.User, *tokens.Token, error) {
+	s.tokens.mu.Lock()
+	token, ok := s.tokens.tokens[plaintext]
+	s.tokens.mu.Unlock()
+
+	if !ok || token.Expiry.Before(time.Now()) || !(len(scopes) == 1 && scopes[0] == token.Scope) {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	user, err := s.GetUserById(token.UserId)
+	return user, token, err
+}
+
+func TestLoginFailures(t *testing.T) {
+	userStore := newFakeUserStore()
+	user := &store.User{Username: "janedoe", Email: "jane@example.com"}
+	require.NoError(t, user.PasswordHash.Set("password"))
+	require.NoError(t, userStore.CreateUser(user))
+
+	tokenStore := newFakeTokenStore()
+	auditStore := &fakeAuditStore{}
+	handler := NewTokenHandler(tokenStore, userStore, nil, auditStore, nil, &mailer.FakeMailer{}, "", log.New(io.Discard, "", 0))
+
+	login := func(ip, username, password string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(`{"username": "`+username+`", "password": "`+password+`"}`))
+		req.RemoteAddr = ip + ":4242"
+		handler.HandleCreateToken(rec, req)
+		return rec
+	}
+
+	// lockedEvents returns the metadata of the login_locked events.
+	lockedEvents := func() []map[string]any {
+		auditStore.mu.Lock()
+		defer auditStore.mu.Unlock()
+
+		var locked []map[string]any
+		for _, event := range auditStore.events {
+			if event.Action == store.AuditLoginLocked {
+				locked = append(locked, event.Metadata)
+			}
+		}
+		return locked
+	}
+
+	unknown := login("192.0.2.1", "nobody", "password")
+	wrong := login("192.0.2.1", "janedoe", "wrong-password")
+	assert.Equal(t, http.StatusUnauthorized, unknown.Code)
+	assert.Equal(t, http.StatusUnauthorized, wrong.Code)
+	assert.Equal(t, unknown.Body.String(), wrong.Body.String(), "unknown usernames are answered like wrong passwords")
+
+	require.Equal(t, http.StatusCreated, login("192.0.2.1", "janedoe", "password").Code, "a login resets the failures of the username")
+
+	t.Run("username", func(t *testing.T) {
+		for i := range 5 {
+			require.Equal(t, http.StatusUnauthorized, login("192.0.2.2", "JaneDoe", "wrong-password").Code, "failure %d", i+1)
+		}
+
+		rec := login("192.0.2.3", "janedoe", "password")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code, "usernames are locked out whatever the IP and case")
+		assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+
+		locked := lockedEvents()
+		require.Len(t, locked, 1)
+		assert.Equal(t, "JaneDoe", locked[0]["username"])
+	})
+
+	t.Run("IP", func(t *testing.T) {
+		// 5 failures from the username test, 15 more on other accounts
+		for i := range 15 {
+			require.Equal(t, http.StatusUnauthorized, login("192.0.2.2", "user"+strconv.Itoa(i), "password").Code)
+		}
+
+		rec := login("192.0.2.2", "someone", "password")
+		assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+		assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+		assert.Equal(t, http.StatusUnauthorized, login("192.0.2.4", "someone", "password").Code, "other IPs are not locked out")
+
+		locked := lockedEvents()
+		require.Len(t, locked, 2)
+		assert.NotContains(t, locked[1], "username", "the IP lockout concerns no account")
+		assert.Equal(t, "30s", locked[1]["delay"])
+	})
+}
+
+func (s *fakeTokenStore) RevokeSessionByHash(hash []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.tokens {
+		if bytes.Equal(token.Hash, hash) {
+			for plaintext, other := range s.tokens {
+				if other == token || (token.Family != "" && other.Family == token.Family) {
+					delete(s.tokens, plaintext)
+				}
+			}
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func TestCookieSession(t *testing.T) {
+	userStore := newFakeUserStore()
+	user := &store.User{Username: "janedoe", Email: "jane@example.com"}
+	require.NoError(t, user.PasswordHash.Set("password"))
+	require.NoError(t, userStore.CreateUser(user))
+
+	tokenStore := newFakeTokenStore()
+	auditStore := &fakeAuditStore{}
+	handler := NewTokenHandler(tokenStore, userStore, nil, auditStore, nil, &mailer.FakeMailer{}, "", log.New(io.Discard, "", 0))
+
+	cookies := func(rec *httptest.ResponseRecorder) map[string]*http.Cookie {
+		cookies := map[string]*http.Cookie{}
+		for _, cookie := range rec.Result().Cookies() {
+			cookies[cookie.Name] = cookie
+		}
+		return cookies
+	}
+
+	// assertSessionCookies checks the cookies of a session against the body
+	// answered along, returning them.
+	assertSessionCookies := func(rec *httptest.ResponseRecorder) map[string]*http.Cookie {
+		require.Equal(t, http.StatusCreated, rec.Code)
+		assert.NotContains(t, rec.Body.String(), "auth_token", "the tokens stay out of reach of scripts")
+		assert.NotContains(t, rec.Body.String(), "refresh_token")
+
+		var body struct {
+			CSRFToken string `json:"csrf_token"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+
+		set := cookies(rec)
+		require.Len(t, set, 3)
+
+		session := set[middleware.SessionCookieName]
+		assert.True(t, session.HttpOnly)
+		assert.True(t, session.Secure)
+		assert.Equal(t, http.SameSiteLaxMode, session.SameSite)
+		assert.Equal(t, "/", session.Path)
+		require.Contains(t, tokenStore.tokens, session.Value)
+		assert.Equal(t, tokens.ScopeAuth, tokenStore.tokens[session.Value].Scope)
+
+		refresh := set[middleware.RefreshCookieName]
+		assert.True(t, refresh.HttpOnly)
+		assert.True(t, refresh.Secure)
+		assert.Equal(t, http.SameSiteStrictMode, refresh.SameSite)
+		assert.Equal(t, "/tokens/refresh", refresh.Path, "the refresh token is only sent to renew the session")
+
+		csrf := set[middleware.CSRFCookieName]
+		assert.False(t, csrf.HttpOnly, "scripts read the CSRF token to echo it")
+		assert.True(t, csrf.Secure)
+		assert.Equal(t, body.CSRFToken, csrf.Value)
+		assert.Equal(t, middleware.CSRFToken(session.Value), csrf.Value)
+
+		return set
+	}
+
+	rec := httptest.NewRecorder()
+	body := `{"username": "janedoe", "password": "password"}`
+	handler.HandleCreateToken(rec, httptest.NewRequest(http.MethodPost, "/tokens?session=cookie", strings.NewReader(body)))
+	session := assertSessionCookies(rec)
+
+	refresh := func(csrfHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/tokens/refresh", nil)
+		req.AddCookie(session[middleware.RefreshCookieName])
+		req.AddCookie(session[middleware.CSRFCookieName])
+		if csrfHeader != "" {
+			req.Header.Set(middleware.CSRFHeaderName, csrfHeader)
+		}
+
+		rec := httptest.NewRecorder()
+		handler.HandleRefreshToken(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusForbidden, refresh("").Code, "the CSRF header is required")
+	assert.Equal(t, http.StatusForbidden, refresh("forged").Code)
+	assert.Contains(t, tokenStore.tokens, session[middleware.RefreshCookieName].Value, "refused refreshes leave the session alone")
+
+	previous := session
+	session = assertSessionCookies(refresh(session[middleware.CSRFCookieName].Value))
+	assert.NotEqual(t, previous[middleware.SessionCookieName].Value, session[middleware.SessionCookieName].Value)
+	assert.NotContains(t, tokenStore.tokens, previous[middleware.SessionCookieName].Value, "the previous access token is superseded")
+
+	current := tokenStore.tokens[session[middleware.SessionCookieName].Value]
+	req := httptest.NewRequest(http.MethodPost, "/tokens/logout", nil)
+	rec = httptest.NewRecorder()
+	handler.HandleLogout(rec, middleware.SetToken(middleware.SetUser(req, user), current))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	assert.NotContains(t, tokenStore.tokens, session[middleware.SessionCookieName].Value)
+	assert.NotContains(t, tokenStore.tokens, session[middleware.RefreshCookieName].Value, "logging out ends the whole session")
+
+	cleared := cookies(rec)
+	require.Len(t, cleared, 3)
+	for name, cookie := range cleared {
+		assert.Empty(t, cookie.Value, name)
+		assert.Negative(t, cookie.MaxAge, name)
+	}
+	assert.Equal(t, "/tokens/refresh", cleared[middleware.RefreshCookieName].Path, "cookies are cleared on their own path")
+
+	assert.Equal(t, []string{store.AuditLogin, store.AuditLogout}, auditStore.actions())
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	require.NoError(t, err)
+
+	tokenStore := newFakeTokenStore()
+	userStore := &fakeLoginUserStore{fakeUserStore: newFakeUserStore(), tokens: tokenStore}
+	user := &store.User{Username: "janedoe", Email: "jane@example.com", TOTPEnabled: true, TOTPSecret: secret}
+	require.NoError(t, user.PasswordHash.Set("password"))
+	require.NoError(t, userStore.CreateUser(user))
+
+	twoFactorStore := newFakeTwoFactorStore(nil)
+	twoFactorStore.recoveryCodes["recovery-code"] = true
+
+	auditStore := &fakeAuditStore{}
+	handler := NewTokenHandler(tokenStore, userStore, twoFactorStore, auditStore, nil, &mailer.FakeMailer{}, "", log.New(io.Discard, "", 0))
+
+	login := func() string {
+		rec := httptest.NewRecorder()
+		body := `{"username": "janedoe", "password": "password", "device_name": "phone"}`
+		handler.HandleCreateToken(rec, httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(body)))
+		require.Equal(t, http.StatusAccepted, rec.Code)
+
+		var challenge struct {
+			TwoFactorRequired bool `json:"two_factor_required"`
+			ChallengeToken    struct {
+				Token string `json:"token"`
+			} `json:"challenge_token"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &challenge))
+		require.True(t, challenge.TwoFactorRequired)
+		assert.NotContains(t, rec.Body.String(), "auth_token", "the password alone opens no session")
+		return challenge.ChallengeToken.Token
+	}
+
+	verify := func(challenge, field, code string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"challenge_token": "` + challenge + `", "` + field + `": "` + code + `"}`
+		handler.HandleVerifyTwoFactor(rec, httptest.NewRequest(http.MethodPost, "/tokens/2fa", strings.NewReader(body)))
+		return rec
+	}
+
+	codeAt := func(step int64) string {
+		code, err := totp.CodeAt(secret, step)
+		require.NoError(t, err)
+		return code
+	}
+
+	assertSession := func(rec *httptest.ResponseRecorder) {
+		require.Equal(t, http.StatusCreated, rec.Code)
+
+		var session struct {
+			AuthToken struct {
+				Token string `json:"token"`
+			} `json:"auth_token"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &session))
+		require.Contains(t, tokenStore.tokens, session.AuthToken.Token)
+		assert.Equal(t, "phone", tokenStore.tokens[session.AuthToken.Token].Device.Name, "the session is named at login")
+	}
+
+	step := totp.Step(time.Now())
+	challenge := login()
+
+	assert.Equal(t, http.StatusBadRequest, verify(challenge, "device_name", "phone").Code)
+	assert.Equal(t, http.StatusUnauthorized, verify("not-a-challenge", "code", codeAt(step)).Code)
+	assert.Equal(t, http.StatusUnauthorized, verify(challenge, "code", "00000x").Code)
+
+	assertSession(verify(challenge, "code", codeAt(step)))
+	assert.Equal(t, http.StatusUnauthorized, verify(challenge, "code", codeAt(step+1)).Code, "challenges are single use")
+
+	challenge = login()
+	assert.Equal(t, http.StatusUnauthorized, verify(challenge, "code", codeAt(step)).Code, "a code cannot be replayed")
+	assertSession(verify(challenge, "recovery_code", "recovery-code"))
+
+	challenge = login()
+	assert.Equal(t, http.StatusUnauthorized, verify(challenge, "recovery_code", "recovery-code").Code, "recovery codes are single use")
+
+	// the successful logins reset the count, the fifth failure in a row
+	// locks the second factor out
+	for range 4 {
+		verify(challenge, "code", "00000x")
+	}
+	rec := verify(challenge, "code", codeAt(step+1))
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+
+	assert.Equal(t, []string{
+		store.AuditTwoFactorFailed,
+		store.AuditLogin,
+		store.AuditTwoFactorFailed,
+		store.AuditLogin,
+		store.AuditTwoFactorFailed,
+		store.AuditTwoFactorFailed,
+		store.AuditTwoFactorFailed,
+		store.AuditTwoFactorFailed,
+		store.AuditTwoFactorFailed,
+		store.AuditLoginLocked,
+	}, auditStore.actions())
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+	tokenStore := newFakeTokenStore()
+	userStore := &fakeLoginUserStore{fakeUserStore: newFakeUserStore(), tokens: tokenStore}
+	userStore.CreateUser(&store.User{Username: "janedoe", Email: "jane@example.com"})
+
+	fakeMailer := &mailer.FakeMailer{}
+	auditStore := &fakeAuditStore{}
+	handler := NewTokenHandler(tokenStore, userStore, nil, auditStore, nil, fakeMailer, "https://app.example.com/login", log.New(io.Discard, "", 0))
+
+	request := func(email string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"email": "` + email + `", "device_name": "phone"}`
+		handler.HandleRequestMagicLink(rec, httptest.NewRequest(http.MethodPost, "/tokens/magic-link", strings.NewReader(body)))
+		return rec
+	}
+
+	redeem := func(token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"token": "` + token + `"}`
+		handler.HandleRedeemMagicLink(rec, httptest.NewRequest(http.MethodPost, "/tokens/magic-link/redeem", strings.NewReader(body)))
+		return rec
+	}
+
+	unknown := request("nobody@example.com")
+	rec := request("jane@example.com")
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, unknown.Body.String(), rec.Body.String(), "unknown emails are answered alike")
+
+	require.Eventually(t, func() bool { return len(fakeMailer.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+	msg := fakeMailer.Messages()[0]
+	assert.Equal(t, "jane@example.com", msg.To)
+
+	var token string
+	for line := range strings.Lines(msg.Body) {
+		link, err := url.Parse(strings.TrimSpace(line))
+		if err == nil && link.Host == "app.example.com" {
+			token = link.Query().Get("token")
+		}
+	}
+	require.NotEmpty(t, token, "login link not found in %q", msg.Body)
+
+	rec = redeem(token)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var session struct {
+		AuthToken struct {
+			Token string `json:"token"`
+		} `json:"auth_token"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &session))
+	assert.Equal(t, tokens.ScopeAuth, tokenStore.tokens[session.AuthToken.Token].Scope)
+	assert.Equal(t, "phone", tokenStore.tokens[session.AuthToken.Token].Device.Name)
+
+	user, err := userStore.GetUserById(1)
+	require.NoError(t, err)
+	assert.True(t, user.Activated, "following the link proves the email")
+	assert.Equal(t, []string{store.AuditLogin}, auditStore.actions())
+
+	rec = redeem(token)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "links are single use")
+
+	// redeeming resets the limit of 3 links
+	for range 4 {
+		request("jane@example.com")
+	}
+	// links are stored before their email is sent, so the links tell how
+	// many emails are on their way
+	assert.Equal(t, 3, tokenStore.count(1, tokens.ScopeMagicLink), "requests beyond the limit do not issue links")
+	require.Eventually(t, func() bool { return len(fakeMailer.Messages()) == 4 }, time.Second, 10*time.Millisecond)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	tokenStore := newFakeTokenStore()
+	auditStore := &fakeAuditStore{}
+	handler := NewTokenHandler(tokenStore, newFakeUserStore(), nil, auditStore, nil, &mailer.FakeMailer{}, "", log.New(io.Discard, "", 0))
+
+	refresh := func(token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"refresh_token": "` + token + `"}`
+		handler.HandleRefreshToken(rec, httptest.NewRequest(http.MethodPost, "/tokens/refresh", strings.NewReader(body)))
+		return rec
+	}
+
+	type session struct {
+		AuthToken struct {
+			Token string `json:"token"`
+		} `json:"auth_token"`
+		RefreshToken struct {
+			Token string `json:"token"`
+		} `json:"refresh_token"`
+	}
+
+	firstAuth, firstRefresh := newSession(t, tokenStore, 1)
+	otherAuth, _ := newSession(t, tokenStore, 1)
+
+	rec := refresh(firstRefresh.Plaintext)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var rotated session
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &rotated))
+	assert.NotEqual(t, firstRefresh.Plaintext, rotated.RefreshToken.Token, "refresh tokens are rotated")
+	assert.NotContains(t, tokenStore.tokens, firstAuth.Plaintext, "the previous access token is superseded")
+	require.Contains(t, tokenStore.tokens, rotated.AuthToken.Token)
+	assert.Equal(t, firstRefresh.Family, tokenStore.tokens[rotated.AuthToken.Token].Family, "the session keeps its family")
+
+	// a leaked refresh token presented again ends the whole session
+	rec = refresh(firstRefresh.Plaintext)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.NotContains(t, tokenStore.tokens, rotated.AuthToken.Token)
+	assert.NotContains(t, tokenStore.tokens, rotated.RefreshToken.Token)
+	assert.Contains(t, tokenStore.tokens, otherAuth.Plaintext, "other sessions are left alone")
+	assert.Equal(t, []string{store.AuditRefreshTokenReused}, auditStore.actions())
+
+	rec = refresh(rotated.RefreshToken.Token)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "the tokens of a revoked session are refused")
+
+	rec = refresh("not-a-token")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	expired, err := tokens.GenerateToken(1, -time.Minute, tokens.ScopeRefresh)
+	require.NoError(t, err)
+	require.NoError(t, tokenStore.Insert(expired))
+	rec = refresh(expired.Plaintext)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "expired refresh tokens are refused")
+
+	rec = refresh(otherAuth.Plaintext)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "access tokens cannot refresh")
+}
+
+func (s *fakeTokenStore) ListSessions(userId int64, currentHash []byte) ([]store.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sessions := []store.Session{}
+	for _, token := range s.tokens {
+		if token.UserId == userId && token.Scope == tokens.ScopeAuth {
+			sessions = append(sessions, store.Session{
+				Id:         token.Id,
+				DeviceName: token.Device.Name,
+				Expiry:     token.Expiry,
+				Current:    bytes.Equal(token.Hash, currentHash),
+			})
+		}
+	}
+
+	return sessions, nil
+}
+
+func (s *fakeTokenStore) RevokeSession(userId int64, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range s.tokens {
+		if token.Id == id && token.UserId == userId && token.Scope == tokens.ScopeAuth {
+			for plaintext, other := range s.tokens {
+				if other == token || (token.Family != "" && other.Family == token.Family) {
+					delete(s.tokens, plaintext)
+				}
+			}
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+func TestSessions(t *testing.T) {
+	tokenStore := newFakeTokenStore()
+	auditStore := &fakeAuditStore{}
+	handler := NewTokenHandler(tokenStore, newFakeUserStore(), nil, auditStore, nil, &mailer.FakeMailer{}, "", log.New(io.Discard, "", 0))
+
+	user := &store.User{Id: 1, Username: "janedoe"}
+	current, _ := newSession(t, tokenStore, user.Id)
+	other, otherRefresh := newSession(t, tokenStore, user.Id)
+	stranger, _ := newSession(t, tokenStore, 2)
+
+	list := func() []store.Session {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/tokens/sessions", nil)
+		handler.HandleListSessions(rec, middleware.SetToken(middleware.SetUser(req, user), current))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var body struct {
+			Sessions []store.Session `json:"sessions"`
+		}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+		return body.Sessions
+	}
+
+	revoke := func(id string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "/tokens/sessions/"+id, nil)
+		handler.HandleRevokeSession(rec, withURLParam(middleware.SetToken(middleware.SetUser(req, user), current), "id", id))
+		return rec
+	}
+
+	sessions := list()
+	require.Len(t, sessions, 2, "sessions of other users are not listed")
+	for _, session := range sessions {
+		assert.Equal(t, session.Id == current.Id, session.Current)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, revoke("abc").Code)
+	assert.Equal(t, http.StatusNotFound, revoke(strconv.FormatInt(stranger.Id, 10)).Code, "sessions of other users cannot be revoked")
+	assert.Equal(t, http.StatusNotFound, revoke(strconv.FormatInt(otherRefresh.Id, 10)).Code, "sessions are named by their access token")
+	assert.Contains(t, tokenStore.tokens, stranger.Plaintext)
+
+	require.Equal(t, http.StatusNoContent, revoke(strconv.FormatInt(other.Id, 10)).Code)
+	assert.NotContains(t, tokenStore.tokens, other.Plaintext)
+	assert.NotContains(t, tokenStore.tokens, otherRefresh.Plaintext, "revoked sessions cannot be refreshed")
+
+	sessions = list()
+	require.Len(t, sessions, 1)
+	assert.Equal(t, current.Id, sessions[0].Id)
+	assert.Equal(t, []string{store.AuditSessionRevoked}, auditStore.actions())
+}
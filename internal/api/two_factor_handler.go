@@ -0,0 +1,202 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/totp"
+	"github.com/martialanouman/femProject/internal/utils"
+)
+
+type confirmTwoFactorRequest struct {
+	Code string `json:"code"`
+}
+
+type disableTwoFactorRequest struct {
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+const (
+	totpIssuer         = "Workout API"
+	recoveryCodesCount = 10
+)
+
+type TwoFactorHandler struct {
+	store      store.TwoFactorStore
+	auditStore store.AuditStore
+	logger     *log.Logger
+}
+
+func NewTwoFactorHandler(store store.TwoFactorStore, auditStore store.AuditStore, logger *log.Logger) *TwoFactorHandler {
+	return &TwoFactorHandler{
+		store:      store,
+		auditStore: auditStore,
+		logger:     logger,
+	}
+}
+
+// HandleEnrollTwoFactor starts an enrollment: it generates a secret to add to
+// an authenticator app, which is only used once confirmed with a code.
+func (h *TwoFactorHandler) HandleEnrollTwoFactor(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if user.TOTPEnabled {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		h.logger.Printf("ERROR: generating totp secret %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.store.SetTOTPSecret(user.Id, secret)
+	if err != nil {
+		h.logger.Printf("ERROR: SetTOTPSecret %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId: &user.Id,
+		UserId:  &user.Id,
+		Action:  store.AuditTwoFactorEnrollment,
+	})
+
+	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI(secret, totpIssuer, user.Username),
+	})
+}
+
+func (h *TwoFactorHandler) HandleConfirmTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req confirmTwoFactorRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding request %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	user := middleware.GetUser(r)
+
+	if user.TOTPEnabled {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	if user.TOTPSecret == "" {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor enrollment has not been started"})
+		return
+	}
+
+	ok, err := verifyTOTPCode(h.store, user, req.Code)
+	if err != nil {
+		h.logger.Printf("ERROR: UseTOTPStep %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !ok {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "invalid code"})
+		return
+	}
+
+	recoveryCodes, err := totp.GenerateRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		h.logger.Printf("ERROR: generating recovery codes %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.store.EnableTOTP(user.Id, recoveryCodes)
+	if err != nil {
+		h.logger.Printf("ERROR: EnableTOTP %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId: &user.Id,
+		UserId:  &user.Id,
+		Action:  store.AuditTwoFactorEnabled,
+	})
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"recovery_codes": recoveryCodes})
+}
+
+func (h *TwoFactorHandler) HandleDisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var req disableTwoFactorRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding request %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	user := middleware.GetUser(r)
+
+	if !user.TOTPEnabled {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": "two-factor authentication is not enabled"})
+		return
+	}
+
+	ok, err := user.PasswordHash.Matches(req.Password)
+	if err != nil {
+		h.logger.Printf("ERROR: password matches %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !ok {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "password is incorrect"})
+		return
+	}
+
+	ok, err = verifyTOTPCode(h.store, user, req.Code)
+	if err != nil {
+		h.logger.Printf("ERROR: UseTOTPStep %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !ok {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "invalid code"})
+		return
+	}
+
+	err = h.store.DisableTOTP(user.Id)
+	if err != nil {
+		h.logger.Printf("ERROR: DisableTOTP %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId: &user.Id,
+		UserId:  &user.Id,
+		Action:  store.AuditTwoFactorDisabled,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// verifyTOTPCode checks a code of the user's authenticator, refusing codes
+// which were already used.
+func verifyTOTPCode(twoFactorStore store.TwoFactorStore, user *store.User, code string) (bool, error) {
+	step, ok := totp.Validate(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return false, nil
+	}
+
+	return twoFactorStore.UseTOTPStep(user.Id, step)
+}
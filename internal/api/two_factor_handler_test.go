@@ -0,0 +1,138 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/totp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTwoFactorStore keeps the two-factor settings of a single user.
+type fakeTwoFactorStore struct {
+	store.TwoFactorStore
+	mu    sync.Mutex
+	user  *store.User
+	steps map[int64]bool
+	// recoveryCodes holds the recovery codes not used yet.
+	recoveryCodes map[string]bool
+}
+
+func newFakeTwoFactorStore(user *store.User) *fakeTwoFactorStore {
+	return &fakeTwoFactorStore{user: user, steps: map[int64]bool{}, recoveryCodes: map[string]bool{}}
+}
+
+func (s *fakeTwoFactorStore) SetTOTPSecret(userId int64, secret string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.user.TOTPSecret = secret
+	return nil
+}
+
+func (s *fakeTwoFactorStore) EnableTOTP(userId int64, recoveryCodes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.user.TOTPEnabled = true
+	for _, code := range recoveryCodes {
+		s.recoveryCodes[code] = true
+	}
+	return nil
+}
+
+func (s *fakeTwoFactorStore) DisableTOTP(userId int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.user.TOTPEnabled, s.user.TOTPSecret = false, ""
+	return nil
+}
+
+func (s *fakeTwoFactorStore) UseTOTPStep(userId int64, step int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.steps[step] {
+		return false, nil
+	}
+
+	s.steps[step] = true
+	return true, nil
+}
+
+func (s *fakeTwoFactorStore) UseRecoveryCode(userId int64, code string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.recoveryCodes[code] {
+		return false, nil
+	}
+
+	delete(s.recoveryCodes, code)
+	return true, nil
+}
+
+func TestTwoFactorLifecycle(t *testing.T) {
+	user := &store.User{Id: 1, Username: "janedoe"}
+	require.NoError(t, user.PasswordHash.Set("password"))
+
+	twoFactorStore := newFakeTwoFactorStore(user)
+	auditStore := &fakeAuditStore{}
+	handler := NewTwoFactorHandler(twoFactorStore, auditStore, log.New(io.Discard, "", 0))
+
+	call := func(handle http.HandlerFunc, method, body string) *httptest.ResponseRecorder {
+		twoFactorStore.mu.Lock()
+		current := *user
+		twoFactorStore.mu.Unlock()
+
+		rec := httptest.NewRecorder()
+		handle(rec, middleware.SetUser(httptest.NewRequest(method, "/users/me/2fa", strings.NewReader(body)), &current))
+		return rec
+	}
+
+	codeAt := func(step int64) string {
+		code, err := totp.CodeAt(user.TOTPSecret, step)
+		require.NoError(t, err)
+		return code
+	}
+
+	rec := call(handler.HandleEnrollTwoFactor, http.MethodPost, "")
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &enrollment))
+	assert.Equal(t, user.TOTPSecret, enrollment.Secret)
+
+	step := totp.Step(time.Now())
+	rec = call(handler.HandleConfirmTwoFactor, http.MethodPost, `{"code": "000000x"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = call(handler.HandleConfirmTwoFactor, http.MethodPost, `{"code": "`+codeAt(step)+`"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, user.TOTPEnabled)
+
+	rec = call(handler.HandleDisableTwoFactor, http.MethodDelete, `{"password": "wrong-password", "code": "`+codeAt(step+1)+`"}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	rec = call(handler.HandleDisableTwoFactor, http.MethodDelete, `{"password": "password", "code": "`+codeAt(step)+`"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "codes are single use")
+	assert.True(t, user.TOTPEnabled)
+
+	rec = call(handler.HandleDisableTwoFactor, http.MethodDelete, `{"password": "password", "code": "`+codeAt(step+1)+`"}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.False(t, user.TOTPEnabled)
+
+	assert.Equal(t, []string{store.AuditTwoFactorEnrollment, store.AuditTwoFactorEnabled, store.AuditTwoFactorDisabled}, auditStore.actions())
+}
@@ -1,13 +1,21 @@
 package api
 
 import (
+	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"regexp"
+	"strings"
+	"time"
 
+	"github.com/martialanouman/femProject/internal/lockout"
+	"github.com/martialanouman/femProject/internal/mailer"
+	"github.com/martialanouman/femProject/internal/middleware"
 	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/tokens"
 	"github.com/martialanouman/femProject/internal/utils"
 )
 
@@ -18,18 +26,76 @@ type registerUserRequest struct {
 	Bio      string `json:"bio"`
 }
 
+type passwordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type activateUserRequest struct {
+	Token string `json:"token"`
+}
+
+type updateProfileRequest struct {
+	Username *string `json:"username"`
+	Email    *string `json:"email"`
+	Bio      *string `json:"bio"`
+}
+
+type deleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword     string `json:"current_password"`
+	NewPassword         string `json:"new_password"`
+	RevokeOtherSessions bool   `json:"revoke_other_sessions"`
+}
+
+const (
+	passwordResetTokenTTL = 30 * time.Minute
+	activationTokenTTL    = 3 * 24 * time.Hour
+)
+
 type UserHandler struct {
-	store  store.UserStore
-	logger *log.Logger
+	store          store.UserStore
+	tokenStore     store.TokenStore
+	auditStore     store.AuditStore
+	mailer         mailer.Mailer
+	passwordResets *lockout.Limiter
+	logger         *log.Logger
 }
 
-func NewUserHandler(store store.UserStore, logger *log.Logger) *UserHandler {
+func NewUserHandler(store store.UserStore, tokenStore store.TokenStore, auditStore store.AuditStore, mailer mailer.Mailer, logger *log.Logger) *UserHandler {
 	return &UserHandler{
-		store,
-		logger,
+		store:      store,
+		tokenStore: tokenStore,
+		auditStore: auditStore,
+		mailer:     mailer,
+		// every request counts, like magic links, so a mailbox cannot be
+		// flooded with reset tokens
+		passwordResets: lockout.NewLimiter(3, time.Minute, time.Hour, time.Hour),
+		logger:         logger,
 	}
 }
 
+var emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+
+func validatePassword(password string) error {
+	if password == "" {
+		return errors.New("password id required")
+	}
+
+	if len(password) < 8 {
+		return errors.New("password must be at least 8 characters")
+	}
+
+	return nil
+}
+
 func (h *UserHandler) validateRegisterRequest(req *registerUserRequest) error {
 	if req.Username == "" {
 		return errors.New("user is required")
@@ -39,20 +105,11 @@ func (h *UserHandler) validateRegisterRequest(req *registerUserRequest) error {
 		return errors.New("email is required")
 	}
 
-	emailRegex := regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
 	if !emailRegex.MatchString(req.Email) {
 		return errors.New("invalid email format")
 	}
 
-	if req.Password == "" {
-		return errors.New("password id required")
-	}
-
-	if len(req.Password) < 8 {
-		return errors.New("password must be at least 8 characters")
-	}
-
-	return nil
+	return validatePassword(req.Password)
 }
 
 func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request) {
@@ -88,11 +145,455 @@ func (h *UserHandler) HandleRegisterUser(w http.ResponseWriter, r *http.Request)
 	}
 
 	err = h.store.CreateUser(&user)
+	if errors.Is(err, store.ErrDuplicateUsername) || errors.Is(err, store.ErrDuplicateEmail) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": duplicateUserMessage(err)})
+		return
+	}
+
 	if err != nil {
 		h.logger.Printf("ERROR: registering user %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
+	err = h.sendActivationEmail(&user)
+	if err != nil {
+		h.logger.Printf("ERROR: creating activation token %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId: &user.Id,
+		UserId:  &user.Id,
+		Action:  store.AuditUserRegistered,
+	})
+
 	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"user": user})
 }
+
+// sendActivationEmail issues an activation token for user and mails it.
+func (h *UserHandler) sendActivationEmail(user *store.User) error {
+	token, err := h.tokenStore.CreateToken(user.Id, activationTokenTTL, tokens.ScopeActivation)
+	if err != nil {
+		return err
+	}
+
+	sendEmail(h.mailer, h.logger, mailer.Message{
+		To:      user.Email,
+		Subject: "Activate your account",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nWelcome! Activate your account by sending the following token to PUT /users/activated:\n\n%s\n\nIt expires at %s.\n",
+			user.Username, token.Plaintext, token.Expiry.Format(time.RFC1123),
+		),
+	})
+
+	return nil
+}
+
+func duplicateUserMessage(err error) string {
+	if errors.Is(err, store.ErrDuplicateUsername) {
+		return "username is already taken"
+	}
+
+	return "email is already in use"
+}
+
+func (h *UserHandler) HandleActivateUser(w http.ResponseWriter, r *http.Request) {
+	var req activateUserRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding payload %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"})
+		return
+	}
+
+	userId, err := h.tokenStore.ConsumeToken(tokens.ScopeActivation, req.Token)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "invalid or expired activation token"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: ConsumeToken %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	user, err := h.store.GetUserById(userId)
+	if err != nil {
+		h.logger.Printf("ERROR: GetUserById %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	user.Activated = true
+	err = h.store.UpdateUser(user)
+	if err != nil {
+		h.logger.Printf("ERROR: UpdateUser %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.tokenStore.RevokeAllTokenForUser(user.Id, tokens.ScopeActivation)
+	if err != nil {
+		h.logger.Printf("ERROR: RevokeAllTokenForUser %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId: &user.Id,
+		UserId:  &user.Id,
+		Action:  store.AuditUserActivated,
+	})
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+func (h *UserHandler) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var req changePasswordRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding payload %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.CurrentPassword == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "current_password is required"})
+		return
+	}
+
+	err = validatePassword(req.NewPassword)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	user := middleware.GetUser(r)
+
+	ok, err := user.PasswordHash.Matches(req.CurrentPassword)
+	if err != nil {
+		h.logger.Printf("ERROR: password matches %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !ok {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "current password is incorrect"})
+		return
+	}
+
+	err = user.PasswordHash.Set(req.NewPassword)
+	if err != nil {
+		h.logger.Printf("ERROR: hashing password %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.store.UpdatePassword(user)
+	if err != nil {
+		h.logger.Printf("ERROR: UpdatePassword %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	// API keys outlive sessions, so whoever knew the old password must not
+	// keep one, as after a reset
+	for _, scope := range []string{tokens.ScopeAPIKey, tokens.ScopePasswordReset} {
+		err = h.tokenStore.RevokeAllTokenForUser(user.Id, scope)
+		if err != nil {
+			h.logger.Printf("ERROR: RevokeAllTokenForUser %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	if req.RevokeOtherSessions {
+		err = h.tokenStore.RevokeOtherSessions(user.Id, middleware.GetToken(r).Hash)
+		if err != nil {
+			h.logger.Printf("ERROR: RevokeOtherSessions %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:  &user.Id,
+		UserId:   &user.Id,
+		Action:   store.AuditPasswordChanged,
+		Metadata: map[string]any{"revoke_other_sessions": req.RevokeOtherSessions},
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *UserHandler) HandleGetCurrentUser(w http.ResponseWriter, r *http.Request) {
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": middleware.GetUser(r)})
+}
+
+func (h *UserHandler) HandleUpdateCurrentUser(w http.ResponseWriter, r *http.Request) {
+	var req updateProfileRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding payload %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	user := middleware.GetUser(r)
+	emailChanged := false
+
+	if req.Username != nil {
+		if *req.Username == "" {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "username cannot be empty"})
+			return
+		}
+		user.Username = *req.Username
+	}
+
+	if req.Email != nil && *req.Email != user.Email {
+		if !emailRegex.MatchString(*req.Email) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid email format"})
+			return
+		}
+		user.Email = *req.Email
+		// the new address has to be verified again
+		user.Activated = false
+		emailChanged = true
+	}
+
+	if req.Bio != nil {
+		user.Bio = *req.Bio
+	}
+
+	err = h.store.UpdateUser(user)
+	if errors.Is(err, store.ErrDuplicateUsername) || errors.Is(err, store.ErrDuplicateEmail) {
+		utils.WriteJSON(w, http.StatusConflict, utils.Envelope{"error": duplicateUserMessage(err)})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: UpdateUser %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if emailChanged {
+		err = h.sendActivationEmail(user)
+		if err != nil {
+			h.logger.Printf("ERROR: creating activation token %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:  &user.Id,
+		UserId:   &user.Id,
+		Action:   store.AuditProfileUpdated,
+		Metadata: map[string]any{"email_changed": emailChanged},
+	})
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"user": user})
+}
+
+func (h *UserHandler) HandleDeleteCurrentUser(w http.ResponseWriter, r *http.Request) {
+	var req deleteAccountRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding payload %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Password == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "password is required"})
+		return
+	}
+
+	user := middleware.GetUser(r)
+
+	ok, err := user.PasswordHash.Matches(req.Password)
+	if err != nil {
+		h.logger.Printf("ERROR: password matches %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	if !ok {
+		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "password is incorrect"})
+		return
+	}
+
+	err = h.store.DeleteUser(user.Id)
+	if err != nil {
+		h.logger.Printf("ERROR: DeleteUser %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId: &user.Id,
+		UserId:  &user.Id,
+		Action:  store.AuditUserDeleted,
+	})
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// sendEmail sends msg, only logging a failure so that the response does not
+// depend on it. The application mailer is a mailer.Background, so a slow
+// provider does not hold the request either.
+func sendEmail(m mailer.Mailer, logger *log.Logger, msg mailer.Message) {
+	err := m.Send(msg)
+	if err != nil {
+		logger.Printf("ERROR: sending email %q %v", msg.Subject, err)
+	}
+}
+
+func (h *UserHandler) HandleRequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding payload %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Email == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "email is required"})
+		return
+	}
+
+	// unknown emails get the same answer as registered ones, so the body
+	// alone does not list accounts. Registered emails still create a token,
+	// which takes longer and may fail with a 500.
+	accepted := utils.Envelope{"message": "if an account exists for this email, a password reset token has been sent"}
+
+	emailKey := strings.ToLower(req.Email)
+	if h.passwordResets.LockedFor(emailKey) > 0 {
+		utils.WriteJSON(w, http.StatusAccepted, accepted)
+		return
+	}
+	h.passwordResets.Fail(emailKey)
+
+	user, err := h.store.GetUserByEmail(req.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusAccepted, accepted)
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: GetUserByEmail %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	token, err := h.tokenStore.CreateToken(user.Id, passwordResetTokenTTL, tokens.ScopePasswordReset)
+	if err != nil {
+		h.logger.Printf("ERROR: creating password reset token %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	msg := mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse the following token to choose a new password with PUT /users/password:\n\n%s\n\nIt expires at %s. If you did not ask for a reset, you can ignore this email.\n",
+			user.Username, token.Plaintext, token.Expiry.Format(time.RFC1123),
+		),
+	}
+
+	sendEmail(h.mailer, h.logger, msg)
+
+	utils.WriteJSON(w, http.StatusAccepted, accepted)
+}
+
+func (h *UserHandler) HandleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var req resetPasswordRequest
+
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		h.logger.Printf("ERROR: decoding payload %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid request payload"})
+		return
+	}
+
+	if req.Token == "" {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "token is required"})
+		return
+	}
+
+	err = validatePassword(req.Password)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	userId, err := h.tokenStore.ConsumeToken(tokens.ScopePasswordReset, req.Token)
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusUnprocessableEntity, utils.Envelope{"error": "invalid or expired password reset token"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: ConsumeToken %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	user, err := h.store.GetUserById(userId)
+	if err != nil {
+		h.logger.Printf("ERROR: GetUserById %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = user.PasswordHash.Set(req.Password)
+	if err != nil {
+		h.logger.Printf("ERROR: hashing password %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	err = h.store.UpdatePassword(user)
+	if err != nil {
+		h.logger.Printf("ERROR: UpdatePassword %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	h.passwordResets.Reset(strings.ToLower(user.Email))
+
+	// whoever knew the old password must not keep a session or an API key,
+	// and the other reset tokens that may have been requested are now useless
+	for _, scope := range []string{tokens.ScopeAuth, tokens.ScopeRefresh, tokens.ScopeAPIKey, tokens.ScopePasswordReset} {
+		err = h.tokenStore.RevokeAllTokenForUser(user.Id, scope)
+		if err != nil {
+			h.logger.Printf("ERROR: RevokeAllTokenForUser %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return
+		}
+	}
+
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId: &user.Id,
+		UserId:  &user.Id,
+		Action:  store.AuditPasswordReset,
+	})
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"message": "your password has been reset"})
+}
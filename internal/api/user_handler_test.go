@@ -0,0 +1,443 @@
+package api
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/mailer"
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/tokens"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUserStore keeps users in memory. Methods a test does not need are left to
+// the embedded nil interface and panic if called.
+type fakeUserStore struct {
+	store.UserStore
+	mu    sync.Mutex
+	users map[int64]*store.User
+}
+
+func newFakeUserStore() *fakeUserStore {
+	return &fakeUserStore{users: map[int64]*store.User{}}
+}
+
+func (s *fakeUserStore) CreateUser(user *store.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user.Id = int64(len(s.users) + 1)
+	copied := *user
+	s.users[user.Id] = &copied
+
+	return nil
+}
+
+func (s *fakeUserStore) GetUserById(id int64) (*store.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	copied := *user
+	return &copied, nil
+}
+
+func (s *fakeUserStore) UpdateUser(user *store.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *user
+	s.users[user.Id] = &copied
+
+	return nil
+}
+
+// fakeTokenStore keeps tokens in memory, indexed by plaintext.
+type fakeTokenStore struct {
+	store.TokenStore
+	mu     sync.Mutex
+	tokens map[string]*tokens.Token
+	// used holds the plaintext of the refresh tokens already exchanged.
+	used   map[string]bool
+	lastId int64
+}
+
+func newFakeTokenStore() *fakeTokenStore {
+	return &fakeTokenStore{tokens: map[string]*tokens.Token{}, used: map[string]bool{}}
+}
+
+func (s *fakeTokenStore) CreateToken(userId int64, ttl time.Duration, scope string) (*tokens.Token, error) {
+	token, err := tokens.GenerateToken(userId, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.Plaintext] = token
+
+	return token, nil
+}
+
+func (s *fakeTokenStore) ConsumeToken(scope, plaintext string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	token, ok := s.tokens[plaintext]
+	if !ok || token.Scope != scope || token.Expiry.Before(time.Now()) {
+		return 0, sql.ErrNoRows
+	}
+
+	delete(s.tokens, plaintext)
+	return token.UserId, nil
+}
+
+func (s *fakeTokenStore) RevokeAllTokenForUser(userId int64, scope string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for plaintext, token := range s.tokens {
+		if token.UserId == userId && token.Scope == scope {
+			delete(s.tokens, plaintext)
+		}
+	}
+
+	return nil
+}
+
+// fakeAuditStore keeps the recorded events in memory.
+type fakeAuditStore struct {
+	store.AuditStore
+	mu     sync.Mutex
+	events []store.AuditEvent
+}
+
+func (s *fakeAuditStore) RecordEvent(event *store.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, *event)
+	return nil
+}
+
+// actions returns the actions of the recorded events, in order.
+func (s *fakeAuditStore) actions() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var actions []string
+	for _, event := range s.events {
+		actions = append(actions, event.Action)
+	}
+
+	return actions
+}
+
+func TestRegisterAndActivateUser(t *testing.T) {
+	userStore := newFakeUserStore()
+	fakeMailer := &mailer.FakeMailer{}
+	auditStore := &fakeAuditStore{}
+	handler := NewUserHandler(userStore, newFakeTokenStore(), auditStore, fakeMailer, log.New(io.Discard, "", 0))
+
+	body := `{"username": "johndoe", "email": "john@example.com", "password": "securepassword"}`
+	rec := httptest.NewRecorder()
+	handler.HandleRegisterUser(rec, httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body)))
+
+	require.Equal(t, http.StatusCreated, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"activated": false`)
+
+	require.Eventually(t, func() bool { return len(fakeMailer.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+	msg := fakeMailer.Messages()[0]
+	assert.Equal(t, "john@example.com", msg.To)
+
+	var token string
+	for line := range strings.Lines(msg.Body) {
+		if len(strings.TrimSpace(line)) == 52 {
+			token = strings.TrimSpace(line)
+		}
+	}
+	require.NotEmpty(t, token, "activation token not found in %q", msg.Body)
+
+	activate := func(token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"token": "` + token + `"}`
+		handler.HandleActivateUser(rec, httptest.NewRequest(http.MethodPut, "/users/activated", strings.NewReader(body)))
+		return rec
+	}
+
+	rec = activate("not-a-token")
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = activate(token)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	user, err := userStore.GetUserById(1)
+	require.NoError(t, err)
+	assert.True(t, user.Activated)
+
+	rec = activate(token)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code, "activation tokens are single use")
+
+	assert.Equal(t, []string{store.AuditUserRegistered, store.AuditUserActivated}, auditStore.actions())
+}
+
+func (s *fakeUserStore) UpdatePassword(user *store.User) error {
+	return s.UpdateUser(user)
+}
+
+func (s *fakeTokenStore) RevokeOtherSessions(userId int64, currentHash []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var family string
+	for _, token := range s.tokens {
+		if bytes.Equal(token.Hash, currentHash) {
+			family = token.Family
+		}
+	}
+
+	for plaintext, token := range s.tokens {
+		session := token.Scope == tokens.ScopeAuth || token.Scope == tokens.ScopeRefresh
+		if token.UserId == userId && session && !bytes.Equal(token.Hash, currentHash) && (token.Family == "" || token.Family != family) {
+			delete(s.tokens, plaintext)
+		}
+	}
+
+	return nil
+}
+
+// newSession stores the auth and refresh tokens of a login of userId,
+// returning them.
+func newSession(t *testing.T, tokenStore *fakeTokenStore, userId int64) (*tokens.Token, *tokens.Token) {
+	family, err := tokens.NewFamily()
+	require.NoError(t, err)
+
+	var session []*tokens.Token
+	for _, scope := range []string{tokens.ScopeAuth, tokens.ScopeRefresh} {
+		token, err := tokens.GenerateToken(userId, time.Hour, scope)
+		require.NoError(t, err)
+		token.Family = family
+		require.NoError(t, tokenStore.Insert(token))
+		session = append(session, token)
+	}
+
+	return session[0], session[1]
+}
+
+func TestChangePassword(t *testing.T) {
+	userStore := newFakeUserStore()
+	user := &store.User{Username: "janedoe", Email: "jane@example.com"}
+	require.NoError(t, user.PasswordHash.Set("old-password"))
+	require.NoError(t, userStore.CreateUser(user))
+
+	tokenStore := newFakeTokenStore()
+	current, _ := newSession(t, tokenStore, user.Id)
+	newSession(t, tokenStore, user.Id)
+	for _, scope := range []string{tokens.ScopeAPIKey, tokens.ScopePasswordReset} {
+		_, err := tokenStore.CreateToken(user.Id, time.Hour, scope)
+		require.NoError(t, err)
+	}
+
+	auditStore := &fakeAuditStore{}
+	handler := NewUserHandler(userStore, tokenStore, auditStore, &mailer.FakeMailer{}, log.New(io.Discard, "", 0))
+
+	change := func(body string) *httptest.ResponseRecorder {
+		user, err := userStore.GetUserById(user.Id)
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "/users/me/password", strings.NewReader(body))
+		handler.HandleChangePassword(rec, middleware.SetToken(middleware.SetUser(req, user), current))
+		return rec
+	}
+
+	rec := change(`{"current_password": "wrong-password", "new_password": "new-password"}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	assert.Equal(t, 1, tokenStore.count(user.Id, tokens.ScopeAPIKey), "refused changes revoke nothing")
+
+	rec = change(`{"current_password": "old-password", "new_password": "short"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = change(`{"current_password": "old-password", "new_password": "new-password"}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	changed, err := userStore.GetUserById(user.Id)
+	require.NoError(t, err)
+	ok, err := changed.PasswordHash.Matches("new-password")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.Zero(t, tokenStore.count(user.Id, tokens.ScopeAPIKey), "API keys are revoked")
+	assert.Zero(t, tokenStore.count(user.Id, tokens.ScopePasswordReset), "reset tokens are revoked")
+	assert.Equal(t, 2, tokenStore.count(user.Id, tokens.ScopeAuth), "other sessions are kept unless asked")
+
+	rec = change(`{"current_password": "new-password", "new_password": "newer-password", "revoke_other_sessions": true}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Equal(t, 1, tokenStore.count(user.Id, tokens.ScopeAuth))
+	assert.Equal(t, 1, tokenStore.count(user.Id, tokens.ScopeRefresh), "the current session keeps its refresh token")
+
+	assert.Equal(t, []string{store.AuditPasswordChanged, store.AuditPasswordChanged}, auditStore.actions())
+}
+
+func TestPasswordReset(t *testing.T) {
+	userStore := newFakeUserStore()
+	user := &store.User{Username: "janedoe", Email: "jane@example.com"}
+	require.NoError(t, user.PasswordHash.Set("old-password"))
+	require.NoError(t, userStore.CreateUser(user))
+
+	tokenStore := newFakeTokenStore()
+	newSession(t, tokenStore, user.Id)
+	_, err := tokenStore.CreateToken(user.Id, time.Hour, tokens.ScopeAPIKey)
+	require.NoError(t, err)
+
+	fakeMailer := &mailer.FakeMailer{}
+	auditStore := &fakeAuditStore{}
+	handler := NewUserHandler(userStore, tokenStore, auditStore, fakeMailer, log.New(io.Discard, "", 0))
+
+	request := func(email string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"email": "` + email + `"}`
+		handler.HandleRequestPasswordReset(rec, httptest.NewRequest(http.MethodPost, "/users/password-reset", strings.NewReader(body)))
+		return rec
+	}
+
+	reset := func(token, password string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		body := `{"token": "` + token + `", "password": "` + password + `"}`
+		handler.HandleResetPassword(rec, httptest.NewRequest(http.MethodPut, "/users/password", strings.NewReader(body)))
+		return rec
+	}
+
+	unknown := request("nobody@example.com")
+	rec := request("jane@example.com")
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, unknown.Body.String(), rec.Body.String(), "unknown emails are answered alike")
+
+	require.Eventually(t, func() bool { return len(fakeMailer.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+	msg := fakeMailer.Messages()[0]
+	assert.Equal(t, "jane@example.com", msg.To)
+
+	var token string
+	for line := range strings.Lines(msg.Body) {
+		if len(strings.TrimSpace(line)) == 52 {
+			token = strings.TrimSpace(line)
+		}
+	}
+	require.NotEmpty(t, token, "reset token not found in %q", msg.Body)
+
+	expired, err := tokens.GenerateToken(user.Id, -time.Minute, tokens.ScopePasswordReset)
+	require.NoError(t, err)
+	require.NoError(t, tokenStore.Insert(expired))
+
+	assert.Equal(t, http.StatusUnprocessableEntity, reset(expired.Plaintext, "new-password").Code, "expired tokens are refused")
+	assert.Equal(t, http.StatusUnprocessableEntity, reset("not-a-token", "new-password").Code)
+	assert.Equal(t, http.StatusBadRequest, reset(token, "short").Code)
+
+	rec = reset(token, "new-password")
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	updated, err := userStore.GetUserById(user.Id)
+	require.NoError(t, err)
+	ok, err := updated.PasswordHash.Matches("new-password")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	for _, scope := range []string{tokens.ScopeAuth, tokens.ScopeRefresh, tokens.ScopeAPIKey, tokens.ScopePasswordReset} {
+		assert.Zero(t, tokenStore.count(user.Id, scope), "%s tokens outlive the reset", scope)
+	}
+
+	assert.Equal(t, http.StatusUnprocessableEntity, reset(token, "newer-password").Code, "reset tokens are single use")
+	assert.Equal(t, []string{store.AuditPasswordReset}, auditStore.actions())
+
+	// resetting the password resets the limit of 3 requests
+	for range 4 {
+		assert.Equal(t, http.StatusAccepted, request("jane@example.com").Code)
+	}
+	assert.Len(t, fakeMailer.Messages(), 4, "requests beyond the limit do not send tokens")
+	assert.Equal(t, 3, tokenStore.count(user.Id, tokens.ScopePasswordReset))
+}
+
+func (s *fakeUserStore) DeleteUser(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	delete(s.users, id)
+	return nil
+}
+
+func TestCurrentUserProfile(t *testing.T) {
+	userStore := newFakeUserStore()
+	user := &store.User{Username: "janedoe", Email: "jane@example.com", Activated: true}
+	require.NoError(t, user.PasswordHash.Set("password"))
+	require.NoError(t, userStore.CreateUser(user))
+
+	fakeMailer := &mailer.FakeMailer{}
+	auditStore := &fakeAuditStore{}
+	handler := NewUserHandler(userStore, newFakeTokenStore(), auditStore, fakeMailer, log.New(io.Discard, "", 0))
+
+	call := func(handle http.HandlerFunc, method, body string) *httptest.ResponseRecorder {
+		user, err := userStore.GetUserById(user.Id)
+		require.NoError(t, err)
+
+		rec := httptest.NewRecorder()
+		handle(rec, middleware.SetUser(httptest.NewRequest(method, "/users/me", strings.NewReader(body)), user))
+		return rec
+	}
+
+	rec := call(handler.HandleGetCurrentUser, http.MethodGet, "")
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"name": "janedoe"`)
+
+	rec = call(handler.HandleUpdateCurrentUser, http.MethodPatch, `{"username": ""}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = call(handler.HandleUpdateCurrentUser, http.MethodPatch, `{"email": "not-an-email"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = call(handler.HandleUpdateCurrentUser, http.MethodPatch, `{"bio": "Runner"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	updated, err := userStore.GetUserById(user.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "Runner", updated.Bio)
+	assert.Equal(t, "janedoe", updated.Username, "fields left out are kept")
+	assert.True(t, updated.Activated)
+
+	rec = call(handler.HandleUpdateCurrentUser, http.MethodPatch, `{"email": "jane@example.org"}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	updated, err = userStore.GetUserById(user.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.org", updated.Email)
+	assert.False(t, updated.Activated, "a new email has to be verified")
+	require.Eventually(t, func() bool { return len(fakeMailer.Messages()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, "jane@example.org", fakeMailer.Messages()[0].To)
+
+	rec = call(handler.HandleDeleteCurrentUser, http.MethodDelete, `{"password": "wrong-password"}`)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+	_, err = userStore.GetUserById(user.Id)
+	require.NoError(t, err, "a wrong password deletes nothing")
+
+	rec = call(handler.HandleDeleteCurrentUser, http.MethodDelete, `{"password": "password"}`)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+	_, err = userStore.GetUserById(user.Id)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	assert.Equal(t, []string{store.AuditProfileUpdated, store.AuditProfileUpdated, store.AuditUserDeleted}, auditStore.actions())
+}
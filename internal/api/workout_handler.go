@@ -4,23 +4,37 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi/v5"
+	"github.com/martialanouman/femProject/internal/cursor"
+	"github.com/martialanouman/femProject/internal/matcher"
 	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/policy"
 	"github.com/martialanouman/femProject/internal/store"
 	"github.com/martialanouman/femProject/internal/utils"
 )
 
 type WorkoutHandler struct {
-	store  store.WorkoutStore
-	logger *log.Logger
+	store         store.WorkoutStore
+	exerciseStore store.ExerciseStore
+	auditStore    store.AuditStore
+	cursors       *cursor.Codec
+	logger        *log.Logger
 }
 
-func NewWorkoutHandler(store store.WorkoutStore, logger *log.Logger) *WorkoutHandler {
+func NewWorkoutHandler(store store.WorkoutStore, exerciseStore store.ExerciseStore, auditStore store.AuditStore, cursors *cursor.Codec, logger *log.Logger) *WorkoutHandler {
 	return &WorkoutHandler{
-		store:  store,
-		logger: logger,
+		store:         store,
+		exerciseStore: exerciseStore,
+		auditStore:    auditStore,
+		cursors:       cursors,
+		logger:        logger,
 	}
 }
 
@@ -45,6 +59,30 @@ func (h *WorkoutHandler) HandleGetWorkoutById(w http.ResponseWriter, r *http.Req
 		return
 	}
 
+	// workouts hidden from the user are not found, so ids cannot be probed
+	if !policy.CanViewWorkout(middleware.GetUser(r), workout) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workout": workout})
+}
+
+// HandleGetSharedWorkout returns an unlisted workout to whoever has its share
+// link, authenticated or not.
+func (h *WorkoutHandler) HandleGetSharedWorkout(w http.ResponseWriter, r *http.Request) {
+	workout, err := h.store.GetWorkoutByShareToken(chi.URLParam(r, "token"))
+	if errors.Is(err, sql.ErrNoRows) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found"})
+		return
+	}
+
+	if err != nil {
+		h.logger.Printf("ERROR: GetWorkoutByShareToken %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
 	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workout": workout})
 }
 
@@ -59,7 +97,29 @@ func (h WorkoutHandler) HandleCreateWorkout(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	if workout.Visibility != "" && !workout.Visibility.Valid() {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "visibility must be one of private, followers, public, unlisted"})
+		return
+	}
+
+	err = validateWorkoutEntries(workout.Entries)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	if workout.Timezone != "" && !store.ValidTimezone(workout.Timezone) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "timezone must be an IANA time zone name"})
+		return
+	}
+
+	suggestions, ok := h.linkExercises(w, currentUser.Id, workout.Entries)
+	if !ok {
+		return
+	}
+
 	workout.UserId = currentUser.Id
+	workout.ShareToken = nil
 	createdWorkout, err := h.store.CreateWorkout(&workout)
 	if err != nil {
 		h.logger.Printf("ERROR: CreateWorkout %v", err)
@@ -67,7 +127,15 @@ func (h WorkoutHandler) HandleCreateWorkout(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusCreated, utils.Envelope{"workout": createdWorkout})
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:    &currentUser.Id,
+		UserId:     &currentUser.Id,
+		Action:     store.AuditWorkoutCreated,
+		TargetType: store.AuditTargetWorkout,
+		TargetId:   &createdWorkout.Id,
+	})
+
+	writeWorkout(w, http.StatusCreated, createdWorkout, suggestions)
 }
 
 func (h *WorkoutHandler) HandleDeleteWorkout(w http.ResponseWriter, r *http.Request) {
@@ -79,25 +147,26 @@ func (h *WorkoutHandler) HandleDeleteWorkout(w http.ResponseWriter, r *http.Requ
 	}
 
 	currentUser := middleware.GetUser(r)
-	ownerId, err := h.store.GetWorkoutOwner(workoutId)
+	workout, err := h.store.GetWorkoutById(workoutId)
 	if errors.Is(err, sql.ErrNoRows) {
-		h.logger.Printf("ERROR: GetWorkoutOwner %v", err)
+		h.logger.Printf("ERROR: GetWorkoutById %v", err)
 		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found"})
 		return
 	}
 
 	if err != nil {
-		h.logger.Printf("ERROR: GetWorkoutOwner %v", err)
+		h.logger.Printf("ERROR: GetWorkoutById %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	if errors.Is(err, sql.ErrNoRows) {
+	if !policy.CanViewWorkout(currentUser, workout) {
 		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found"})
 		return
 	}
 
-	if ownerId != currentUser.Id {
+	ownerId := workout.UserId
+	if !policy.CanDeleteWorkout(currentUser, ownerId) {
 		h.logger.Printf("ERROR: unauthorized delete attempt by user %d on workout %d owned by user %d", currentUser.Id, workoutId, ownerId)
 		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you do not have permission to delete this workout"})
 		return
@@ -116,6 +185,14 @@ func (h *WorkoutHandler) HandleDeleteWorkout(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:    &currentUser.Id,
+		UserId:     &ownerId,
+		Action:     store.AuditWorkoutDeleted,
+		TargetType: store.AuditTargetWorkout,
+		TargetId:   &workoutId,
+	})
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -147,17 +224,25 @@ func (h *WorkoutHandler) HandleUpdateWorkout(w http.ResponseWriter, r *http.Requ
 	}
 
 	currentUser := middleware.GetUser(r)
-	if existingWorkout.UserId != currentUser.Id {
+	if !policy.CanViewWorkout(currentUser, existingWorkout) {
+		utils.WriteJSON(w, http.StatusNotFound, utils.Envelope{"error": "workout not found"})
+		return
+	}
+
+	if !policy.CanUpdateWorkout(currentUser, existingWorkout.UserId) {
 		h.logger.Printf("ERROR: unauthorized update attempt by user %d on workout %d owned by user %d", currentUser.Id, existingWorkout.Id, existingWorkout.UserId)
 		utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you do not have permission to update this workout"})
 		return
 	}
 
 	var updateWorkoutRequest struct {
-		Title           *string `json:"title"`
-		Description     *string `json:"description"`
-		DurationMinutes *int    `json:"duration_minutes"`
-		CaloriesBurned  *int    `json:"calories_burned"`
+		Title           *string           `json:"title"`
+		Description     *string           `json:"description"`
+		DurationMinutes *int              `json:"duration_minutes"`
+		CaloriesBurned  *int              `json:"calories_burned"`
+		Visibility      *store.Visibility `json:"visibility"`
+		PerformedAt     *time.Time        `json:"performed_at"`
+		Timezone        *string           `json:"timezone"`
 		Entries         []store.WorkoutEntry
 	}
 
@@ -184,7 +269,39 @@ func (h *WorkoutHandler) HandleUpdateWorkout(w http.ResponseWriter, r *http.Requ
 		existingWorkout.CaloriesBurned = *updateWorkoutRequest.CaloriesBurned
 	}
 
+	if updateWorkoutRequest.Visibility != nil {
+		if !updateWorkoutRequest.Visibility.Valid() {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "visibility must be one of private, followers, public, unlisted"})
+			return
+		}
+		existingWorkout.Visibility = *updateWorkoutRequest.Visibility
+	}
+
+	if updateWorkoutRequest.PerformedAt != nil {
+		existingWorkout.PerformedAt = *updateWorkoutRequest.PerformedAt
+	}
+
+	if updateWorkoutRequest.Timezone != nil {
+		if !store.ValidTimezone(*updateWorkoutRequest.Timezone) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "timezone must be an IANA time zone name"})
+			return
+		}
+		existingWorkout.Timezone = *updateWorkoutRequest.Timezone
+	}
+
+	var suggestions map[string][]store.Exercise
 	if len(updateWorkoutRequest.Entries) > 0 {
+		err = validateWorkoutEntries(updateWorkoutRequest.Entries)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+			return
+		}
+
+		var ok bool
+		suggestions, ok = h.linkExercises(w, existingWorkout.UserId, updateWorkoutRequest.Entries)
+		if !ok {
+			return
+		}
 		existingWorkout.Entries = updateWorkoutRequest.Entries
 	}
 
@@ -195,10 +312,186 @@ func (h *WorkoutHandler) HandleUpdateWorkout(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workout": existingWorkout})
+	recordEvent(h.auditStore, h.logger, r, store.AuditEvent{
+		ActorId:    &currentUser.Id,
+		UserId:     &existingWorkout.UserId,
+		Action:     store.AuditWorkoutUpdated,
+		TargetType: store.AuditTargetWorkout,
+		TargetId:   &existingWorkout.Id,
+	})
+
+	writeWorkout(w, http.StatusOK, existingWorkout, suggestions)
+}
+
+// exerciseSuggestions is how many exercises are suggested for each name
+// matching none.
+const exerciseSuggestions = 3
+
+// linkExercises names the entries after the exercise they link to, which
+// must be in the catalog or a custom exercise of ownerId, the owner of the
+// workout. Entries given a name only are linked to the exercise it matches,
+// if any, and the closest exercises are suggested for the names left
+// unmatched. It answers the request itself and returns false on failure.
+func (h *WorkoutHandler) linkExercises(w http.ResponseWriter, ownerId int64, entries []store.WorkoutEntry) (map[string][]store.Exercise, bool) {
+	var exerciseMatcher *matcher.Matcher
+	suggestions := map[string][]store.Exercise{}
+
+	for i := range entries {
+		entry := &entries[i]
+		if entry.ExerciseId == nil {
+			if exerciseMatcher == nil {
+				exercises, err := h.exerciseStore.GetExercisesForUser(ownerId)
+				if err != nil {
+					h.logger.Printf("ERROR: GetExercisesForUser %v", err)
+					utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+					return nil, false
+				}
+				exerciseMatcher = matcher.New(exercises)
+			}
+
+			exercise, ok := exerciseMatcher.Match(entry.ExerciseName)
+			if !ok {
+				suggestions[entry.ExerciseName] = exerciseMatcher.Suggest(entry.ExerciseName, exerciseSuggestions)
+				continue
+			}
+
+			entry.ExerciseId, entry.ExerciseName = &exercise.Id, exercise.Name
+			continue
+		}
+
+		exercise, err := h.exerciseStore.GetExerciseForUser(*entry.ExerciseId, ownerId)
+		if errors.Is(err, sql.ErrNoRows) {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": fmt.Sprintf("unknown exercise_id %d", *entry.ExerciseId)})
+			return nil, false
+		}
+
+		if err != nil {
+			h.logger.Printf("ERROR: GetExerciseForUser %v", err)
+			utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+			return nil, false
+		}
+
+		entry.ExerciseName = exercise.Name
+	}
+
+	return suggestions, true
 }
 
+// writeWorkout answers with workout, along with the suggested exercises of
+// its unmatched exercise names when there are some.
+func writeWorkout(w http.ResponseWriter, status int, workout *store.Workout, suggestions map[string][]store.Exercise) {
+	envelope := utils.Envelope{"workout": workout}
+	if len(suggestions) > 0 {
+		envelope["exercise_suggestions"] = suggestions
+	}
+
+	utils.WriteJSON(w, status, envelope)
+}
+
+// validateWorkoutEntries checks the sets logged one by one, the aggregate
+// fields being checked by the database.
+func validateWorkoutEntries(entries []store.WorkoutEntry) error {
+	for _, entry := range entries {
+		if entry.ExerciseId == nil && strings.TrimSpace(entry.ExerciseName) == "" {
+			return errors.New("entries need an exercise_id or an exercise_name")
+		}
+
+		for _, set := range entry.SetDetails {
+			switch {
+			case (set.Reps == nil) == (set.DurationSeconds == nil):
+				return fmt.Errorf("sets of %s need either reps or duration_seconds", entry.ExerciseName)
+			case set.Type != "" && !set.Type.Valid():
+				return errors.New("set_type must be one of warmup, working, drop, failure")
+			case set.RPE != nil && (*set.RPE < 1 || *set.RPE > 10):
+				return errors.New("rpe must be between 1 and 10")
+			case set.RIR != nil && *set.RIR < 0:
+				return errors.New("rir cannot be negative")
+			case set.RestSeconds != nil && *set.RestSeconds < 0:
+				return errors.New("rest_seconds cannot be negative")
+			}
+		}
+	}
+
+	return nil
+}
+
+func (h *WorkoutHandler) readWorkoutFilter(r *http.Request) (store.WorkoutFilter, error) {
+	qs := r.URL.Query()
+	filter := store.WorkoutFilter{
+		Title:        qs.Get("title"),
+		ExerciseName: qs.Get("exercise"),
+		Sort:         qs.Get("sort"),
+	}
+
+	if _, _, err := store.ParseSort(filter.Sort); err != nil {
+		return filter, errors.New("invalid sort parameter")
+	}
+
+	from, _, err := utils.ReadOptionalTimeParam(r, "from")
+	if err != nil {
+		return filter, err
+	}
+	filter.From = from
+
+	filter.To, err = utils.ReadOptionalEndTimeParam(r, "to")
+	if err != nil {
+		return filter, err
+	}
+
+	intParams := []struct {
+		name  string
+		value **int
+	}{
+		{"min_duration", &filter.MinDuration},
+		{"max_duration", &filter.MaxDuration},
+		{"min_calories", &filter.MinCalories},
+		{"max_calories", &filter.MaxCalories},
+	}
+
+	for _, param := range intParams {
+		*param.value, err = utils.ReadOptionalIntParam(r, param.name)
+		if err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
+
+// HandleGetWorkouts lists the workouts of the authenticated user, or those of
+// user_id the authenticated user may see.
 func (h *WorkoutHandler) HandleGetWorkouts(w http.ResponseWriter, r *http.Request) {
+	currentUser := middleware.GetUser(r)
+
+	userId := currentUser.Id
+	if param := r.URL.Query().Get("user_id"); param != "" {
+		var err error
+		userId, err = strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid user_id parameter"})
+			return
+		}
+	}
+
+	h.writeWorkoutPage(w, r, userId, policy.VisibleWorkouts(currentUser, userId))
+}
+
+// HandleGetUserWorkouts lists the workouts of the user given in the path, for
+// admins.
+func (h *WorkoutHandler) HandleGetUserWorkouts(w http.ResponseWriter, r *http.Request) {
+	userId, err := utils.ReadIdParam(r)
+	if err != nil {
+		h.logger.Printf("ERROR: ReadIdParam %v", err)
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid user id"})
+		return
+	}
+
+	h.writeWorkoutPage(w, r, userId, nil)
+}
+
+// writeWorkoutPage answers with the page of the workouts of userId with the
+// given visibilities (all when nil) asked for by the query parameters.
+func (h *WorkoutHandler) writeWorkoutPage(w http.ResponseWriter, r *http.Request, userId int64, visibilities []store.Visibility) {
 	take, skip, err := utils.ReadPaginationParams(r)
 	if err != nil {
 		h.logger.Printf("ERROR: ReadPaginationParams %v", err)
@@ -206,12 +499,59 @@ func (h *WorkoutHandler) HandleGetWorkouts(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	workouts, err := h.store.GetWorkouts(take, skip)
+	filter, err := h.readWorkoutFilter(r)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": err.Error()})
+		return
+	}
+
+	filter.Cursor, err = utils.ReadCursorParam(r, h.cursors)
+	if err != nil {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "invalid cursor"})
+		return
+	}
+
+	if filter.Cursor != nil && skip != 0 {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "cursor and skip cannot be combined"})
+		return
+	}
+
+	filter.UserId = userId
+	filter.Visibilities = visibilities
+	filter.Take = take
+	filter.Skip = skip
+
+	page, err := h.store.GetWorkouts(filter)
+	if errors.Is(err, cursor.ErrInvalidCursor) {
+		utils.WriteJSON(w, http.StatusBadRequest, utils.Envelope{"error": "cursor does not match the requested sort"})
+		return
+	}
+
 	if err != nil {
 		h.logger.Printf("ERROR: GetWorkouts %v", err)
 		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
 		return
 	}
 
-	utils.WriteJSON(w, http.StatusOK, utils.Envelope{"workouts": workouts, "take": take, "skip": skip})
+	nextCursor, err := utils.EncodeCursor(h.cursors, page.Next)
+	if err != nil {
+		h.logger.Printf("ERROR: EncodeCursor %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	prevCursor, err := utils.EncodeCursor(h.cursors, page.Prev)
+	if err != nil {
+		h.logger.Printf("ERROR: EncodeCursor %v", err)
+		utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, utils.Envelope{
+		"workouts":    page.Workouts,
+		"take":        take,
+		"skip":        skip,
+		"next_cursor": nextCursor,
+		"prev_cursor": prevCursor,
+	})
 }
@@ -0,0 +1,274 @@
+package api
+
+import (
+	"cmp"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeWorkoutStore struct {
+	store.WorkoutStore
+	workouts map[int64]*store.Workout
+}
+
+func (s *fakeWorkoutStore) CreateWorkout(workout *store.Workout) (*store.Workout, error) {
+	workout.Id = int64(len(s.workouts) + 1)
+	s.workouts[workout.Id] = workout
+	return workout, nil
+}
+
+func (s *fakeWorkoutStore) GetWorkoutById(id int64) (*store.Workout, error) {
+	workout, ok := s.workouts[id]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	copied := *workout
+	return &copied, nil
+}
+
+func (s *fakeWorkoutStore) UpdateWorkout(workout *store.Workout) error {
+	s.workouts[workout.Id] = workout
+	return nil
+}
+
+func (s *fakeWorkoutStore) DeleteWorkout(id int64) error {
+	if _, ok := s.workouts[id]; !ok {
+		return sql.ErrNoRows
+	}
+
+	delete(s.workouts, id)
+	return nil
+}
+
+func (s *fakeWorkoutStore) GetWorkoutByShareToken(token string) (*store.Workout, error) {
+	for _, workout := range s.workouts {
+		if workout.Visibility == store.VisibilityUnlisted && workout.ShareToken != nil && *workout.ShareToken == token {
+			copied := *workout
+			return &copied, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// GetWorkouts lists the workouts of filter.UserId with the visibilities of
+// the filter, by id.
+func (s *fakeWorkoutStore) GetWorkouts(filter store.WorkoutFilter) (*store.WorkoutPage, error) {
+	page := &store.WorkoutPage{Workouts: []store.Workout{}}
+	for _, workout := range s.workouts {
+		if workout.UserId == filter.UserId && (len(filter.Visibilities) == 0 || slices.Contains(filter.Visibilities, workout.Visibility)) {
+			page.Workouts = append(page.Workouts, *workout)
+		}
+	}
+
+	slices.SortFunc(page.Workouts, func(a, b store.Workout) int { return cmp.Compare(a.Id, b.Id) })
+	return page, nil
+}
+
+// fakeExerciseStore holds the catalog along with custom exercises.
+type fakeExerciseStore struct {
+	store.ExerciseStore
+	exercises []store.Exercise
+}
+
+func (s *fakeExerciseStore) GetExercisesForUser(userId int64) ([]store.Exercise, error) {
+	exercises := []store.Exercise{}
+	for _, exercise := range s.exercises {
+		if exercise.UserId == nil || *exercise.UserId == userId {
+			exercises = append(exercises, exercise)
+		}
+	}
+
+	return exercises, nil
+}
+
+func (s *fakeExerciseStore) GetExerciseForUser(id int64, userId int64) (*store.Exercise, error) {
+	for _, exercise := range s.exercises {
+		if exercise.Id == id && (exercise.UserId == nil || *exercise.UserId == userId) {
+			return &exercise, nil
+		}
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+func TestWorkoutExerciseSuggestions(t *testing.T) {
+	owner := &store.User{Id: 1, Username: "janedoe"}
+	other := int64(2)
+	exerciseStore := &fakeExerciseStore{exercises: []store.Exercise{
+		{Id: 1, Name: "Bench press", Aliases: []string{"flat bench"}},
+		{Id: 2, Name: "Dumbbell bench press", Aliases: []string{"db bench"}},
+		{Id: 3, Name: "Barbell row"},
+		{Id: 4, Name: "Dumbbell row"},
+		{Id: 5, UserId: &owner.Id, Name: "Zercher squat"},
+		{Id: 6, UserId: &other, Name: "Jefferson curl"},
+	}}
+	workoutStore := &fakeWorkoutStore{workouts: map[int64]*store.Workout{}}
+	handler := NewWorkoutHandler(workoutStore, exerciseStore, &fakeAuditStore{}, nil, log.New(io.Discard, "", 0))
+
+	type response struct {
+		Workout             store.Workout               `json:"workout"`
+		ExerciseSuggestions map[string][]store.Exercise `json:"exercise_suggestions"`
+	}
+
+	call := func(handle http.HandlerFunc, method string, workoutId string, body string) (*httptest.ResponseRecorder, response) {
+		req := middleware.SetUser(httptest.NewRequest(method, "/workouts", strings.NewReader(body)), owner)
+		if workoutId != "" {
+			req = withURLParam(req, "id", workoutId)
+		}
+
+		rec := httptest.NewRecorder()
+		handle(rec, req)
+
+		var resp response
+		if rec.Code < http.StatusBadRequest {
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		}
+		return rec, resp
+	}
+
+	rec, resp := call(handler.HandleCreateWorkout, http.MethodPost, "", `{"title": "Push day", "entries": [
+		{"exercise_name": "DB Bench", "sets": 3, "reps": 8, "order_index": 1},
+		{"exercise_name": "zercher squats", "sets": 3, "reps": 5, "order_index": 2},
+		{"exercise_name": "row", "sets": 3, "reps": 10, "order_index": 3},
+		{"exercise_name": "jefferson curl", "sets": 3, "reps": 10, "order_index": 4}
+	]}`)
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	entries := resp.Workout.Entries
+	require.Len(t, entries, 4)
+	require.NotNil(t, entries[0].ExerciseId)
+	assert.Equal(t, int64(2), *entries[0].ExerciseId)
+	assert.Equal(t, "Dumbbell bench press", entries[0].ExerciseName)
+	require.NotNil(t, entries[1].ExerciseId)
+	assert.Equal(t, int64(5), *entries[1].ExerciseId, "custom exercises are matched")
+	assert.Nil(t, entries[2].ExerciseId)
+	assert.Equal(t, "row", entries[2].ExerciseName)
+	assert.Nil(t, entries[3].ExerciseId, "the custom exercises of others are not matched")
+
+	require.Len(t, resp.ExerciseSuggestions, 2)
+	suggested := []string{}
+	for _, exercise := range resp.ExerciseSuggestions["row"] {
+		suggested = append(suggested, exercise.Name)
+	}
+	assert.Equal(t, []string{"Barbell row", "Dumbbell row"}, suggested)
+	assert.Contains(t, resp.ExerciseSuggestions, "jefferson curl")
+
+	rec, resp = call(handler.HandleUpdateWorkout, http.MethodPut, "1", `{"entries": [
+		{"exercise_name": "barbell rows", "sets": 3, "reps": 10, "order_index": 1}
+	]}`)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, resp.Workout.Entries, 1)
+	require.NotNil(t, resp.Workout.Entries[0].ExerciseId)
+	assert.Equal(t, int64(3), *resp.Workout.Entries[0].ExerciseId)
+	assert.Empty(t, resp.ExerciseSuggestions)
+	assert.NotContains(t, rec.Body.String(), "exercise_suggestions")
+
+	rec, _ = call(handler.HandleCreateWorkout, http.MethodPost, "", `{"title": "Pull day", "entries": [
+		{"exercise_id": 6, "sets": 3, "reps": 10, "order_index": 1}
+	]}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "the custom exercises of others cannot be linked")
+}
+
+func TestWorkoutVisibility(t *testing.T) {
+	owner := &store.User{Id: 1, Username: "janedoe", Role: store.RoleUser}
+	other := &store.User{Id: 2, Username: "johndoe", Role: store.RoleUser}
+	admin := &store.User{Id: 3, Username: "admin", Role: store.RoleAdmin}
+
+	shareToken := "share-token"
+	workoutStore := &fakeWorkoutStore{workouts: map[int64]*store.Workout{
+		1: {Id: 1, UserId: owner.Id, Title: "Private", Visibility: store.VisibilityPrivate},
+		2: {Id: 2, UserId: owner.Id, Title: "Public", Visibility: store.VisibilityPublic},
+		3: {Id: 3, UserId: owner.Id, Title: "Unlisted", Visibility: store.VisibilityUnlisted, ShareToken: &shareToken},
+		4: {Id: 4, UserId: owner.Id, Title: "Followers", Visibility: store.VisibilityFollowers},
+	}}
+	handler := NewWorkoutHandler(workoutStore, &fakeExerciseStore{}, &fakeAuditStore{}, nil, log.New(io.Discard, "", 0))
+
+	call := func(user *store.User, handle http.HandlerFunc, method string, workoutId int64, body string) int {
+		id := strconv.FormatInt(workoutId, 10)
+		req := httptest.NewRequest(method, "/workouts/"+id, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		handle(rec, withURLParam(middleware.SetUser(req, user), "id", id))
+		return rec.Code
+	}
+
+	t.Run("other users", func(t *testing.T) {
+		for _, id := range []int64{1, 3, 4} {
+			assert.Equal(t, http.StatusNotFound, call(other, handler.HandleGetWorkoutById, http.MethodGet, id, ""), "get %d", id)
+			assert.Equal(t, http.StatusNotFound, call(other, handler.HandleUpdateWorkout, http.MethodPut, id, `{"title": "Mine"}`), "update %d", id)
+			assert.Equal(t, http.StatusNotFound, call(other, handler.HandleDeleteWorkout, http.MethodDelete, id, ""), "delete %d", id)
+		}
+		assert.Equal(t, http.StatusNotFound, call(other, handler.HandleGetWorkoutById, http.MethodGet, 42, ""), "hidden workouts look missing")
+
+		assert.Equal(t, http.StatusOK, call(other, handler.HandleGetWorkoutById, http.MethodGet, 2, ""))
+		assert.Equal(t, http.StatusForbidden, call(other, handler.HandleUpdateWorkout, http.MethodPut, 2, `{"title": "Mine"}`))
+		assert.Equal(t, http.StatusForbidden, call(other, handler.HandleDeleteWorkout, http.MethodDelete, 2, ""))
+		assert.Len(t, workoutStore.workouts, 4)
+		assert.Equal(t, "Private", workoutStore.workouts[1].Title)
+	})
+
+	t.Run("listing", func(t *testing.T) {
+		list := func(user *store.User, query string) []string {
+			rec := httptest.NewRecorder()
+			handler.HandleGetWorkouts(rec, middleware.SetUser(httptest.NewRequest(http.MethodGet, "/workouts"+query, nil), user))
+			require.Equal(t, http.StatusOK, rec.Code)
+
+			var body struct {
+				Workouts []store.Workout `json:"workouts"`
+			}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &body))
+
+			titles := []string{}
+			for _, workout := range body.Workouts {
+				titles = append(titles, workout.Title)
+			}
+			return titles
+		}
+
+		all := []string{"Private", "Public", "Unlisted", "Followers"}
+		assert.Equal(t, all, list(owner, ""))
+		assert.Equal(t, all, list(owner, "?user_id=1"))
+		assert.Equal(t, []string{"Public"}, list(other, "?user_id=1"))
+		assert.Equal(t, []string{}, list(other, ""), "users list their own workouts by default")
+		assert.Equal(t, all, list(admin, "?user_id=1"))
+	})
+
+	t.Run("share link", func(t *testing.T) {
+		shared := func(token string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/shared/workouts/"+token, nil)
+			rec := httptest.NewRecorder()
+			handler.HandleGetSharedWorkout(rec, withURLParam(middleware.SetUser(req, store.AnonymousUser), "token", token))
+			return rec
+		}
+
+		rec := shared(shareToken)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"title": "Unlisted"`)
+		assert.Equal(t, http.StatusNotFound, shared("not-a-token").Code)
+
+		workoutStore.workouts[3].Visibility = store.VisibilityPrivate
+		assert.Equal(t, http.StatusNotFound, shared(shareToken).Code, "share links stop working once the workout is no longer unlisted")
+	})
+
+	t.Run("owner and admin", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, call(owner, handler.HandleGetWorkoutById, http.MethodGet, 1, ""))
+		assert.Equal(t, http.StatusOK, call(admin, handler.HandleGetWorkoutById, http.MethodGet, 1, ""))
+		assert.Equal(t, http.StatusOK, call(admin, handler.HandleUpdateWorkout, http.MethodPut, 1, `{"title": "Moderated"}`))
+		assert.Equal(t, http.StatusNoContent, call(owner, handler.HandleDeleteWorkout, http.MethodDelete, 1, ""))
+		assert.NotContains(t, workoutStore.workouts, int64(1))
+	})
+}
@@ -1,25 +1,40 @@
 package app
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/martialanouman/femProject/internal/api"
+	"github.com/martialanouman/femProject/internal/cursor"
+	"github.com/martialanouman/femProject/internal/janitor"
+	"github.com/martialanouman/femProject/internal/mailer"
 	"github.com/martialanouman/femProject/internal/middleware"
+	"github.com/martialanouman/femProject/internal/oidc"
 	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/tokens"
 	"github.com/martialanouman/femProject/migrations"
 )
 
 type Application struct {
-	Logger         *log.Logger
-	WorkoutHandler *api.WorkoutHandler
-	UserHandler    *api.UserHandler
-	TokenHandler   *api.TokenHandler
-	AuthMiddleware middleware.UserMiddleware
-	Db             *sql.DB
+	Logger           *log.Logger
+	WorkoutHandler   *api.WorkoutHandler
+	UserHandler      *api.UserHandler
+	TokenHandler     *api.TokenHandler
+	APIKeyHandler    *api.APIKeyHandler
+	TwoFactorHandler *api.TwoFactorHandler
+	OIDCHandler      *api.OIDCHandler
+	AdminHandler     *api.AdminHandler
+	AuditHandler     *api.AuditHandler
+	ExerciseHandler  *api.ExerciseHandler
+	AuthMiddleware   *middleware.UserMiddleware
+	Janitor          *janitor.Janitor
+	Mailer           *mailer.Background
+	Db               *sql.DB
 }
 
 func NewApplication() (*Application, error) {
@@ -35,19 +50,134 @@ func NewApplication() (*Application, error) {
 
 	logger := log.New(os.Stdout, "", log.Ldate|log.Ltime)
 	userStore := store.NewPostgresUserStore(db)
+	tokenStore := store.NewPostgresTokenStore(db)
+	twoFactorStore := store.NewPostgresTwoFactorStore(db)
+	auditStore := store.NewPostgresAuditStore(db)
+	exerciseStore := store.NewPostgresExerciseStore(db)
+
+	delivery, err := newMailer()
+	if err != nil {
+		return nil, err
+	}
+	mail := mailer.NewBackground(delivery, logger)
+
+	cursors, err := newCursorCodec(logger)
+	if err != nil {
+		return nil, err
+	}
+
+	providers, err := oidc.LoadProvidersFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	jwtCodec, err := newJWTCodec()
+	if err != nil {
+		return nil, err
+	}
+
+	authMiddleware := middleware.NewUserMiddleware(userStore, tokenStore, auditStore, jwtCodec, logger)
+	if jwtCodec != nil {
+		err = authMiddleware.SyncRevocations()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tokenJanitor, err := newJanitor(db, tokenStore, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenHandler := api.NewTokenHandler(tokenStore, userStore, twoFactorStore, auditStore, jwtCodec, mail, os.Getenv("MAGIC_LINK_URL"), logger)
 
 	app := &Application{
-		Logger:         logger,
-		WorkoutHandler: api.NewWorkoutHandler(store.NewPostgresWorkoutStore(db), logger),
-		UserHandler:    api.NewUserHandler(userStore, logger),
-		TokenHandler:   api.NewTokenHandler(store.NewPostgresTokenStore(db), userStore, logger),
-		AuthMiddleware: middleware.UserMiddleware{Store: userStore},
-		Db:             db,
+		Logger:           logger,
+		WorkoutHandler:   api.NewWorkoutHandler(store.NewPostgresWorkoutStore(db), exerciseStore, auditStore, cursors, logger),
+		UserHandler:      api.NewUserHandler(userStore, tokenStore, auditStore, mail, logger),
+		TokenHandler:     tokenHandler,
+		APIKeyHandler:    api.NewAPIKeyHandler(tokenStore, auditStore, logger),
+		TwoFactorHandler: api.NewTwoFactorHandler(twoFactorStore, auditStore, logger),
+		OIDCHandler:      api.NewOIDCHandler(providers, store.NewPostgresIdentityStore(db), auditStore, tokenHandler, logger),
+		AdminHandler:     api.NewAdminHandler(userStore, tokenStore, auditStore, cursors, logger),
+		AuditHandler:     api.NewAuditHandler(auditStore, cursors, logger),
+		ExerciseHandler:  api.NewExerciseHandler(exerciseStore, cursors, logger),
+		AuthMiddleware:   authMiddleware,
+		Janitor:          tokenJanitor,
+		Mailer:           mail,
+		Db:               db,
 	}
 
 	return app, nil
 }
 
+// newJanitor returns the janitor deleting expired tokens, meant to be started
+// by the server to run every JANITOR_INTERVAL (a Go duration, 10m by default)
+// unless it is 0.
+func newJanitor(db *sql.DB, tokenStore store.TokenStore, logger *log.Logger) (*janitor.Janitor, error) {
+	interval := janitor.DefaultInterval
+	if value := os.Getenv("JANITOR_INTERVAL"); value != "" {
+		var err error
+		interval, err = time.ParseDuration(value)
+		if err != nil || interval < 0 {
+			return nil, fmt.Errorf("invalid JANITOR_INTERVAL %q", value)
+		}
+	}
+
+	lock := func(ctx context.Context) (func() error, bool, error) {
+		return store.TryAdvisoryLock(ctx, db, janitor.LockKey)
+	}
+
+	return janitor.New(tokenStore, lock, interval, logger), nil
+}
+
+// newCursorCodec signs pagination cursors with CURSOR_SECRET, falling back to a
+// random secret which invalidates cursors on every restart.
+func newCursorCodec(logger *log.Logger) (*cursor.Codec, error) {
+	secret := os.Getenv("CURSOR_SECRET")
+	if secret == "" {
+		logger.Printf("WARNING: CURSOR_SECRET is not set, pagination cursors will not survive a restart")
+		return cursor.NewRandomCodec()
+	}
+
+	return cursor.NewCodec([]byte(secret)), nil
+}
+
+// newJWTCodec returns the codec of JWT access tokens when TOKEN_MODE is jwt,
+// signing with the first of JWT_KEYS. It returns nil in the default opaque
+// mode.
+func newJWTCodec() (*tokens.JWTCodec, error) {
+	switch mode := os.Getenv("TOKEN_MODE"); mode {
+	case "", "opaque":
+		return nil, nil
+	case "jwt":
+		keys, err := tokens.ParseSigningKeys(os.Getenv("JWT_KEYS"))
+		if err != nil {
+			return nil, err
+		}
+
+		return tokens.NewJWTCodec(keys)
+	default:
+		return nil, fmt.Errorf("unknown TOKEN_MODE %q, expected opaque or jwt", mode)
+	}
+}
+
+// newMailer returns the mailer used to deliver emails. Until a real provider is
+// wired in, messages are written to MAILER_OUTPUT, or stdout when unset.
+func newMailer() (mailer.Mailer, error) {
+	path := os.Getenv("MAILER_OUTPUT")
+	if path == "" {
+		return mailer.NewLogMailer(os.Stdout), nil
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("mailer: open %w", err)
+	}
+
+	return mailer.NewLogMailer(file), nil
+}
+
 func (a *Application) HealthCheck(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Status is available.\n")
 }
@@ -0,0 +1,51 @@
+package cursor
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecRoundTrip(t *testing.T) {
+	codec := NewCodec([]byte("secret"))
+	cursor := Cursor{Sort: "-created_at", Key: "2025-09-14 12:30:00+00", Id: 42, Before: true}
+
+	token, err := codec.Encode(cursor)
+	require.NoError(t, err)
+
+	decoded, err := codec.Decode(token)
+	require.NoError(t, err)
+	assert.Equal(t, cursor, *decoded)
+}
+
+func TestCodecRejectsTampering(t *testing.T) {
+	codec := NewCodec([]byte("secret"))
+	token, err := codec.Encode(Cursor{Sort: "title", Key: "Leg day", Id: 1})
+	require.NoError(t, err)
+
+	forged, err := codec.Encode(Cursor{Sort: "title", Key: "Leg day", Id: 1000})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		token string
+		codec *Codec
+	}{
+		{name: "missing signature", token: "eyJzIjoidGl0bGUifQ"},
+		{name: "swapped payload", token: forged[:len(forged)/2] + token[len(token)/2:]},
+		{name: "other secret", token: token, codec: NewCodec([]byte("other"))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := codec
+			if tt.codec != nil {
+				c = tt.codec
+			}
+
+			_, err := c.Decode(tt.token)
+			assert.ErrorIs(t, err, ErrInvalidCursor)
+		})
+	}
+}
@@ -0,0 +1,131 @@
+// Package janitor deletes the tokens left in the database after they expire,
+// along with the revocations of expired tokens.
+package janitor
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/store"
+)
+
+const (
+	// DefaultInterval is the time between two runs.
+	DefaultInterval = 10 * time.Minute
+	// DefaultBatchSize is the number of tokens deleted per statement.
+	DefaultBatchSize = 1000
+	// LockKey is the Postgres advisory lock held while running.
+	LockKey int64 = 0x6a616e69746f72 // "janitor"
+)
+
+// Metrics, published by expvar.
+var (
+	runs               = expvar.NewInt("janitor_runs")
+	skippedRuns        = expvar.NewInt("janitor_skipped_runs")
+	failedRuns         = expvar.NewInt("janitor_failed_runs")
+	tokensDeleted      = expvar.NewInt("janitor_tokens_deleted")
+	revocationsDeleted = expvar.NewInt("janitor_revocations_deleted")
+	lastRun            = expvar.NewString("janitor_last_run")
+)
+
+// LockFunc takes the lock making a single instance run at a time, without
+// waiting for it. ok is false when another instance holds it.
+type LockFunc func(ctx context.Context) (unlock func() error, ok bool, err error)
+
+type Janitor struct {
+	tokens    store.TokenStore
+	lock      LockFunc
+	interval  time.Duration
+	batchSize int
+	logger    *log.Logger
+}
+
+func New(tokens store.TokenStore, lock LockFunc, interval time.Duration, logger *log.Logger) *Janitor {
+	return &Janitor{
+		tokens:    tokens,
+		lock:      lock,
+		interval:  interval,
+		batchSize: DefaultBatchSize,
+		logger:    logger,
+	}
+}
+
+// Start runs the janitor every interval until ctx is done, or never when the
+// interval is 0.
+func (j *Janitor) Start(ctx context.Context) {
+	if j.interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(j.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				_, _, err := j.RunOnce(ctx)
+				if err != nil {
+					j.logger.Printf("ERROR: janitor run %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// RunOnce deletes every expired token and revocation, batch by batch, and
+// returns how many of each were deleted. It does nothing when another instance
+// is already running.
+func (j *Janitor) RunOnce(ctx context.Context) (tokens int64, revocations int64, err error) {
+	unlock, ok, err := j.lock(ctx)
+	if err != nil {
+		failedRuns.Add(1)
+		return 0, 0, err
+	}
+
+	if !ok {
+		skippedRuns.Add(1)
+		return 0, 0, nil
+	}
+	defer func() {
+		if err := unlock(); err != nil {
+			j.logger.Printf("ERROR: janitor unlock %v", err)
+		}
+	}()
+
+	runs.Add(1)
+	lastRun.Set(time.Now().UTC().Format(time.RFC3339))
+
+	tokens, err = j.deleteInBatches(ctx, j.tokens.DeleteExpiredTokens, tokensDeleted)
+	if err != nil {
+		return tokens, 0, err
+	}
+
+	revocations, err = j.deleteInBatches(ctx, j.tokens.DeleteExpiredRevokedTokens, revocationsDeleted)
+	return tokens, revocations, err
+}
+
+// deleteInBatches calls deleteBatch until a batch comes back short, adding the
+// deleted rows to counter, and returns how many were deleted.
+func (j *Janitor) deleteInBatches(ctx context.Context, deleteBatch func(limit int) (int64, error), counter *expvar.Int) (int64, error) {
+	var total int64
+	for ctx.Err() == nil {
+		deleted, err := deleteBatch(j.batchSize)
+		total += deleted
+		counter.Add(deleted)
+		if err != nil {
+			failedRuns.Add(1)
+			return total, err
+		}
+
+		if deleted < int64(j.batchSize) {
+			break
+		}
+	}
+
+	return total, ctx.Err()
+}
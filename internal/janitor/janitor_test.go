@@ -0,0 +1,92 @@
+package janitor
+
+import (
+	"context"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTokenStore holds a number of expired tokens and revocations.
+type fakeTokenStore struct {
+	store.TokenStore
+	expired            int64
+	expiredRevocations int64
+	batches            int
+}
+
+func (s *fakeTokenStore) DeleteExpiredTokens(limit int) (int64, error) {
+	s.batches++
+
+	deleted := min(s.expired, int64(limit))
+	s.expired -= deleted
+	return deleted, nil
+}
+
+func (s *fakeTokenStore) DeleteExpiredRevokedTokens(limit int) (int64, error) {
+	s.batches++
+
+	deleted := min(s.expiredRevocations, int64(limit))
+	s.expiredRevocations -= deleted
+	return deleted, nil
+}
+
+func TestRunOnce(t *testing.T) {
+	tokens := &fakeTokenStore{expired: 2500, expiredRevocations: 1200}
+	unlocked := false
+	lock := func(ctx context.Context) (func() error, bool, error) {
+		return func() error { unlocked = true; return nil }, true, nil
+	}
+
+	janitor := New(tokens, lock, DefaultInterval, log.New(io.Discard, "", 0))
+	before, beforeRevocations := tokensDeleted.Value(), revocationsDeleted.Value()
+
+	deleted, revocations, err := janitor.RunOnce(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2500), deleted)
+	assert.Equal(t, int64(1200), revocations)
+	assert.Equal(t, 5, tokens.batches)
+	assert.True(t, unlocked)
+	assert.Equal(t, before+2500, tokensDeleted.Value())
+	assert.Equal(t, beforeRevocations+1200, revocationsDeleted.Value())
+}
+
+func TestRunOnceLocked(t *testing.T) {
+	tokens := &fakeTokenStore{expired: 10}
+	lock := func(ctx context.Context) (func() error, bool, error) {
+		return nil, false, nil
+	}
+
+	janitor := New(tokens, lock, DefaultInterval, log.New(io.Discard, "", 0))
+
+	deleted, revocations, err := janitor.RunOnce(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+	assert.Zero(t, revocations)
+	assert.Zero(t, tokens.batches, "another instance is running")
+}
+
+func TestStart(t *testing.T) {
+	runs := make(chan struct{}, 100)
+	lock := func(ctx context.Context) (func() error, bool, error) {
+		runs <- struct{}{}
+		return nil, false, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	New(&fakeTokenStore{}, lock, 0, log.New(io.Discard, "", 0)).Start(ctx)
+	New(&fakeTokenStore{}, lock, 10*time.Millisecond, log.New(io.Discard, "", 0)).Start(ctx)
+
+	select {
+	case <-runs:
+	case <-time.After(time.Second):
+		t.Fatal("the janitor did not run")
+	}
+}
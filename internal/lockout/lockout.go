@@ -0,0 +1,104 @@
+package lockout
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter counts failed attempts per key, such as a username or an IP
+// address. Once Threshold failures have been reached, every further failure
+// locks the key out for an exponentially growing delay.
+type Limiter struct {
+	Threshold int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Window is how long a key must stay without failures to be forgotten.
+	Window time.Duration
+
+	mu       sync.Mutex
+	attempts map[string]*attempt
+	now      func() time.Time
+}
+
+type attempt struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// maxTrackedKeys bounds the memory used by a limiter, forgotten keys are
+// swept once it is reached.
+const maxTrackedKeys = 10000
+
+func NewLimiter(threshold int, baseDelay, maxDelay, window time.Duration) *Limiter {
+	return &Limiter{
+		Threshold: threshold,
+		BaseDelay: baseDelay,
+		MaxDelay:  maxDelay,
+		Window:    window,
+		attempts:  map[string]*attempt{},
+		now:       time.Now,
+	}
+}
+
+// LockedFor returns how long key is still locked out, zero if it is not.
+func (l *Limiter) LockedFor(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	a, ok := l.attempts[key]
+	if !ok {
+		return 0
+	}
+
+	return max(a.lockedUntil.Sub(l.now()), 0)
+}
+
+// Fail records a failed attempt for key. It returns the lockout delay the
+// failure triggered, zero if the key is still below the threshold.
+func (l *Limiter) Fail(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	a, ok := l.attempts[key]
+	if !ok || now.Sub(a.lastFailure) > l.Window {
+		if len(l.attempts) >= maxTrackedKeys {
+			l.sweep(now)
+		}
+
+		a = &attempt{}
+		l.attempts[key] = a
+	}
+
+	a.failures++
+	a.lastFailure = now
+
+	if a.failures < l.Threshold {
+		return 0
+	}
+
+	delay := l.MaxDelay
+	if exponent := a.failures - l.Threshold; exponent < 32 {
+		delay = min(l.BaseDelay<<exponent, l.MaxDelay)
+	}
+
+	a.lockedUntil = now.Add(delay)
+	return delay
+}
+
+// Reset forgets the failures of key, typically after a successful attempt.
+func (l *Limiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.attempts, key)
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	for key, a := range l.attempts {
+		if now.Sub(a.lastFailure) > l.Window && now.After(a.lockedUntil) {
+			delete(l.attempts, key)
+		}
+	}
+}
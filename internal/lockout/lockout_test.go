@@ -0,0 +1,45 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2025, 9, 14, 12, 0, 0, 0, time.UTC)
+	limiter := NewLimiter(3, time.Minute, 5*time.Minute, time.Hour)
+	limiter.now = func() time.Time { return now }
+
+	assert.Zero(t, limiter.Fail("johndoe"))
+	assert.Zero(t, limiter.Fail("johndoe"))
+	assert.Zero(t, limiter.LockedFor("johndoe"))
+
+	assert.Equal(t, time.Minute, limiter.Fail("johndoe"))
+	assert.Equal(t, time.Minute, limiter.LockedFor("johndoe"))
+	assert.Zero(t, limiter.LockedFor("janedoe"), "keys are tracked separately")
+
+	now = now.Add(time.Minute)
+	assert.Zero(t, limiter.LockedFor("johndoe"))
+
+	assert.Equal(t, 2*time.Minute, limiter.Fail("johndoe"))
+	assert.Equal(t, 4*time.Minute, limiter.Fail("johndoe"))
+	assert.Equal(t, 5*time.Minute, limiter.Fail("johndoe"), "delay is capped")
+
+	limiter.Reset("johndoe")
+	assert.Zero(t, limiter.LockedFor("johndoe"))
+	assert.Zero(t, limiter.Fail("johndoe"))
+}
+
+func TestLimiterForgetsAfterWindow(t *testing.T) {
+	now := time.Date(2025, 9, 14, 12, 0, 0, 0, time.UTC)
+	limiter := NewLimiter(2, time.Minute, time.Hour, 10*time.Minute)
+	limiter.now = func() time.Time { return now }
+
+	assert.Zero(t, limiter.Fail("10.0.0.1"))
+
+	now = now.Add(11 * time.Minute)
+	assert.Zero(t, limiter.Fail("10.0.0.1"))
+	assert.Equal(t, time.Minute, limiter.Fail("10.0.0.1"))
+}
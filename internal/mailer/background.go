@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"log"
+	"sync"
+)
+
+// Background hands messages over to another Mailer without waiting for it, so
+// that a slow provider does not hold requests. Failures can only be logged.
+// Wait must be called before exiting for the messages in flight to be sent.
+type Background struct {
+	mailer  Mailer
+	logger  *log.Logger
+	pending sync.WaitGroup
+}
+
+func NewBackground(mailer Mailer, logger *log.Logger) *Background {
+	return &Background{mailer: mailer, logger: logger}
+}
+
+// Send delivers msg in the background, it always returns nil.
+func (b *Background) Send(msg Message) error {
+	b.pending.Add(1)
+	go func() {
+		defer b.pending.Done()
+
+		err := b.mailer.Send(msg)
+		if err != nil {
+			b.logger.Printf("ERROR: sending email %q %v", msg.Subject, err)
+		}
+	}()
+
+	return nil
+}
+
+// Wait blocks until every message handed over to Send has been delivered or
+// has failed.
+func (b *Background) Wait() {
+	b.pending.Wait()
+}
@@ -0,0 +1,26 @@
+package mailer
+
+import "sync"
+
+// FakeMailer keeps sent messages in memory so tests can inspect them.
+type FakeMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *FakeMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.messages = append(m.messages, msg)
+
+	return nil
+}
+
+// Messages returns a copy of the messages sent so far.
+func (m *FakeMailer) Messages() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Message(nil), m.messages...)
+}
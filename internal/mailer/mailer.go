@@ -0,0 +1,38 @@
+package mailer
+
+import (
+	"io"
+	"log"
+	"sync"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// LogMailer writes messages to an io.Writer instead of delivering them. It is
+// meant for local development, where reading a token off stdout or a file is
+// good enough.
+type LogMailer struct {
+	mu     sync.Mutex
+	logger *log.Logger
+}
+
+func NewLogMailer(w io.Writer) *LogMailer {
+	return &LogMailer{logger: log.New(w, "MAIL: ", log.Ldate|log.Ltime)}
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.logger.Printf("to=%s subject=%q\n%s\n", msg.To, msg.Subject, msg.Body)
+
+	return nil
+}
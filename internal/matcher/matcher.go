@@ -0,0 +1,242 @@
+// Package matcher maps the free-text exercise names users type to the
+// exercises of the catalog.
+//
+// Names are compared once normalized: case, punctuation, spacing, plurals and
+// common abbreviations such as "db" for dumbbell are ignored, as is the order
+// of the words. Names left apart by a few typos still match, within an edit
+// distance growing with their length.
+package matcher
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/martialanouman/femProject/internal/store"
+)
+
+// abbreviations are expanded word by word before comparing names.
+var abbreviations = map[string]string{
+	"db":  "dumbbell",
+	"bb":  "barbell",
+	"kb":  "kettlebell",
+	"bw":  "bodyweight",
+	"ext": "extension",
+	"inc": "incline",
+	"sm":  "smith",
+}
+
+// Matcher matches names against a fixed set of exercises, typically the
+// catalog along with the custom exercises of a user.
+type Matcher struct {
+	exercises []store.Exercise
+	// keys holds, for each exercise, the keys of its name and aliases.
+	keys [][]key
+}
+
+// key is a normalized name: its words joined, as typed and sorted.
+type key struct {
+	joined string
+	sorted string
+}
+
+func New(exercises []store.Exercise) *Matcher {
+	m := &Matcher{exercises: exercises, keys: make([][]key, len(exercises))}
+	for i, exercise := range exercises {
+		for _, name := range append([]string{exercise.Name}, exercise.Aliases...) {
+			m.keys[i] = append(m.keys[i], newKey(name))
+		}
+	}
+
+	return m
+}
+
+// Normalize lowers the case of name, expands its abbreviations and reduces it
+// to words of letters and digits separated by single spaces, in the singular.
+func Normalize(name string) string {
+	words := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	for i, word := range words {
+		if expanded, ok := abbreviations[word]; ok {
+			word = expanded
+		}
+		if len(word) > 2 && strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") {
+			word = strings.TrimSuffix(word, "s")
+		}
+		words[i] = word
+	}
+
+	return strings.Join(words, " ")
+}
+
+func newKey(name string) key {
+	words := strings.Fields(Normalize(name))
+	joined := strings.Join(words, "")
+	slices.Sort(words)
+
+	return key{joined: joined, sorted: strings.Join(words, "")}
+}
+
+// Match returns the exercise name refers to, when a single one is closest.
+// Among the exercises as close, one of whose keys name spells exactly wins
+// over those only reached through the word order, and a custom exercise over
+// the catalog one it shadows.
+func (m *Matcher) Match(name string) (*store.Exercise, bool) {
+	query := newKey(name)
+	if query.joined == "" {
+		return nil, false
+	}
+
+	best, ambiguous := -1, false
+	var bestRank rank
+	for i := range m.exercises {
+		r := m.rank(i, query)
+		if r.distance > maxDistance(query.joined) {
+			continue
+		}
+
+		switch c := compareRanks(r, bestRank); {
+		case best < 0 || c < 0:
+			best, bestRank, ambiguous = i, r, false
+		case c == 0:
+			ambiguous = true
+		}
+	}
+
+	if best < 0 || ambiguous {
+		return nil, false
+	}
+
+	return &m.exercises[best], true
+}
+
+// rank orders the exercises name may refer to, the lowest first.
+type rank struct {
+	distance int
+	inexact  bool
+	catalog  bool
+}
+
+func (m *Matcher) rank(index int, query key) rank {
+	return rank{
+		distance: m.distance(index, query),
+		inexact:  !slices.ContainsFunc(m.keys[index], func(k key) bool { return k.joined == query.joined }),
+		catalog:  m.exercises[index].UserId == nil,
+	}
+}
+
+func compareRanks(a, b rank) int {
+	return cmp.Or(cmp.Compare(a.distance, b.distance), compareBools(a.inexact, b.inexact), compareBools(a.catalog, b.catalog))
+}
+
+// compareBools orders false before true.
+func compareBools(a, b bool) int {
+	switch {
+	case a == b:
+		return 0
+	case a:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// Suggest returns at most limit exercises resembling name, the closest first.
+func (m *Matcher) Suggest(name string, limit int) []store.Exercise {
+	query := newKey(name)
+	if query.joined == "" {
+		return []store.Exercise{}
+	}
+
+	type candidate struct {
+		index    int
+		distance int
+	}
+
+	candidates := []candidate{}
+	for i := range m.exercises {
+		d := m.distance(i, query)
+		if d <= len([]rune(query.joined))/2 || m.contains(i, query) {
+			candidates = append(candidates, candidate{i, d})
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return cmp.Or(cmp.Compare(a.distance, b.distance), cmp.Compare(m.exercises[a.index].Name, m.exercises[b.index].Name))
+	})
+
+	suggestions := []store.Exercise{}
+	for _, c := range candidates[:min(limit, len(candidates))] {
+		suggestions = append(suggestions, m.exercises[c.index])
+	}
+
+	return suggestions
+}
+
+// distance is the smallest edit distance between query and the keys of the
+// exercise at index.
+func (m *Matcher) distance(index int, query key) int {
+	distance := -1
+	for _, k := range m.keys[index] {
+		for _, d := range []int{levenshtein(query.joined, k.joined), levenshtein(query.sorted, k.sorted)} {
+			if distance < 0 || d < distance {
+				distance = d
+			}
+		}
+	}
+
+	return distance
+}
+
+// contains reports whether query and a key of the exercise at index contain
+// one another, leaving out keys too short not to appear by chance.
+func (m *Matcher) contains(index int, query key) bool {
+	for _, k := range m.keys[index] {
+		if strings.Contains(k.joined, query.joined) || (len([]rune(k.joined)) > 3 && strings.Contains(query.joined, k.joined)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// maxDistance is the number of typos tolerated in a normalized name, none for
+// the shortest ones whose typos easily make another word.
+func maxDistance(joined string) int {
+	switch n := len([]rune(joined)); {
+	case n <= 4:
+		return 0
+	case n <= 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// levenshtein returns the number of rune insertions, deletions and
+// substitutions turning a into b.
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := range ra {
+		current[0] = i + 1
+		for j := range rb {
+			cost := 1
+			if ra[i] == rb[j] {
+				cost = 0
+			}
+			current[j+1] = min(previous[j+1]+1, current[j]+1, previous[j]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(rb)]
+}
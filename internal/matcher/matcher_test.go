@@ -0,0 +1,144 @@
+package matcher
+
+import (
+	"testing"
+
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var catalog = []store.Exercise{
+	{Id: 1, Name: "Bench press", Aliases: []string{"barbell bench press", "bb bench", "flat bench"}},
+	{Id: 2, Name: "Dumbbell bench press", Aliases: []string{"db bench", "dumbbell press"}},
+	{Id: 3, Name: "Overhead press", Aliases: []string{"ohp", "military press"}},
+	{Id: 4, Name: "Push-up", Aliases: []string{"push up", "press up"}},
+	{Id: 5, Name: "Barbell row", Aliases: []string{"bent over row"}},
+	{Id: 6, Name: "Dumbbell row", Aliases: []string{"db row"}},
+	{Id: 7, Name: "Lunge", Aliases: []string{"walking lunge"}},
+	{Id: 8, Name: "Romanian deadlift", Aliases: []string{"rdl"}},
+}
+
+func TestNormalize(t *testing.T) {
+	assert.Equal(t, "dumbbell bench press", Normalize("  DB   Bench-Press "))
+	assert.Equal(t, "push up", Normalize("Push-ups"))
+	assert.Equal(t, "press", Normalize("Press"))
+	assert.Equal(t, "", Normalize(" - "))
+}
+
+func TestMatch(t *testing.T) {
+	m := New(catalog)
+
+	tests := []struct {
+		name   string
+		input  string
+		wantId int64
+	}{
+		{name: "exact", input: "Bench press", wantId: 1},
+		{name: "case and spacing", input: "  bench   PRESS ", wantId: 1},
+		{name: "alias", input: "OHP", wantId: 3},
+		{name: "abbreviation", input: "DB Bench Press", wantId: 2},
+		{name: "punctuation and plural", input: "pushups", wantId: 4},
+		{name: "word order", input: "press bench", wantId: 1},
+		{name: "typo", input: "Overhed press", wantId: 3},
+		{name: "typos in long name", input: "romanain deadlift", wantId: 8},
+		{name: "plural alias", input: "Walking Lunges", wantId: 7},
+		{name: "unknown", input: "Zercher squat", wantId: 0},
+		{name: "short name without typo tolerance", input: "rdk", wantId: 0},
+		{name: "ambiguous", input: "row", wantId: 0},
+		{name: "empty", input: "  ", wantId: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exercise, ok := m.Match(tt.input)
+			if tt.wantId == 0 {
+				assert.False(t, ok)
+				return
+			}
+
+			require.True(t, ok)
+			assert.Equal(t, tt.wantId, exercise.Id)
+		})
+	}
+}
+
+func TestMatchTies(t *testing.T) {
+	userId := int64(1)
+
+	tests := []struct {
+		name      string
+		exercises []store.Exercise
+		input     string
+		wantId    int64
+	}{
+		{
+			name:      "exact key over word order",
+			exercises: []store.Exercise{{Id: 1, Name: "Press leg"}, {Id: 2, Name: "Leg press"}},
+			input:     "leg press",
+			wantId:    2,
+		},
+		{
+			name:      "custom over catalog",
+			exercises: []store.Exercise{{Id: 1, Name: "Bench press"}, {Id: 2, UserId: &userId, Name: "Bench press"}},
+			input:     "bench press",
+			wantId:    2,
+		},
+		{
+			name:      "custom over catalog with a typo",
+			exercises: []store.Exercise{{Id: 1, Name: "Hip thrust"}, {Id: 2, UserId: &userId, Name: "Hip thrust"}},
+			input:     "hip trust",
+			wantId:    2,
+		},
+		{
+			name:      "exact catalog key over custom word order",
+			exercises: []store.Exercise{{Id: 1, Name: "Leg press"}, {Id: 2, UserId: &userId, Name: "Press leg"}},
+			input:     "leg press",
+			wantId:    1,
+		},
+		{
+			name:      "two catalog exercises",
+			exercises: []store.Exercise{{Id: 1, Name: "Leg press"}, {Id: 2, Name: "Leg press", Aliases: []string{"sled press"}}},
+			input:     "leg press",
+			wantId:    0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exercise, ok := New(tt.exercises).Match(tt.input)
+			if tt.wantId == 0 {
+				assert.False(t, ok)
+				return
+			}
+
+			require.True(t, ok)
+			assert.Equal(t, tt.wantId, exercise.Id)
+		})
+	}
+}
+
+func TestSuggest(t *testing.T) {
+	m := New(catalog)
+
+	names := func(exercises []store.Exercise) []string {
+		names := []string{}
+		for _, exercise := range exercises {
+			names = append(names, exercise.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"Barbell row", "Dumbbell row"}, names(m.Suggest("row", 5)))
+	assert.Equal(t, []string{"Barbell row"}, names(m.Suggest("row", 1)))
+	assert.Equal(t, []string{"Dumbbell bench press"}, names(m.Suggest("dumbell bench pres", 1)))
+	assert.Empty(t, m.Suggest("zercher squat", 5))
+	assert.Empty(t, m.Suggest("жим", 5), "three runes are not six letters")
+}
+
+func TestLevenshtein(t *testing.T) {
+	assert.Equal(t, 0, levenshtein("squat", "squat"))
+	assert.Equal(t, 3, levenshtein("kitten", "sitting"))
+	assert.Equal(t, 5, levenshtein("", "squat"))
+	assert.Equal(t, 1, levenshtein("écarté", "ecarté"))
+}
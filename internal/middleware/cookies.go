@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/tokens"
+)
+
+// Browser clients may keep their tokens in HttpOnly cookies rather than in
+// JavaScript. Requests authenticated by cookie must then prove they come from
+// the application by echoing the CSRF cookie in the CSRF header.
+const (
+	SessionCookieName = "session"
+	RefreshCookieName = "refresh_token"
+	CSRFCookieName    = "csrf_token"
+	CSRFHeaderName    = "X-CSRF-Token"
+
+	// refreshCookiePath limits the refresh token to the only route using it.
+	refreshCookiePath = "/tokens/refresh"
+)
+
+// CSRFToken derives the CSRF token of a session from its auth token, so it
+// cannot be planted by a sibling domain able to write cookies.
+func CSRFToken(sessionToken string) string {
+	hash := sha256.Sum256([]byte("csrf:" + sessionToken))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// SetSessionCookies writes the cookies of a session and returns its CSRF
+// token.
+func SetSessionCookies(w http.ResponseWriter, authToken, refreshToken *tokens.Token) string {
+	csrf := CSRFToken(authToken.Plaintext)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     SessionCookieName,
+		Value:    authToken.Plaintext,
+		Path:     "/",
+		Expires:  authToken.Expiry,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     RefreshCookieName,
+		Value:    refreshToken.Plaintext,
+		Path:     refreshCookiePath,
+		Expires:  refreshToken.Expiry,
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteStrictMode,
+	})
+
+	// readable by scripts, which send it back in the CSRF header
+	http.SetCookie(w, &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    csrf,
+		Path:     "/",
+		Expires:  refreshToken.Expiry,
+		Secure:   true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return csrf
+}
+
+// ClearSessionCookies asks the browser to drop the cookies of a session.
+func ClearSessionCookies(w http.ResponseWriter) {
+	for name, path := range map[string]string{
+		SessionCookieName: "/",
+		RefreshCookieName: refreshCookiePath,
+		CSRFCookieName:    "/",
+	} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     path,
+			Expires:  time.Unix(0, 0),
+			MaxAge:   -1,
+			HttpOnly: name != CSRFCookieName,
+			Secure:   true,
+		})
+	}
+}
+
+// ValidCSRF reports whether the CSRF header of r matches the expected token.
+func ValidCSRF(r *http.Request, expected string) bool {
+	header := r.Header.Get(CSRFHeaderName)
+	return header != "" && subtle.ConstantTimeCompare([]byte(header), []byte(expected)) == 1
+}
+
+// safeMethod reports whether a method is not supposed to change state, and so
+// needs no CSRF protection.
+func safeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	default:
+		return false
+	}
+}
@@ -2,23 +2,60 @@ package middleware
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/martialanouman/femProject/internal/policy"
 	"github.com/martialanouman/femProject/internal/store"
 	"github.com/martialanouman/femProject/internal/tokens"
 	"github.com/martialanouman/femProject/internal/utils"
 )
 
 type UserMiddleware struct {
-	Store store.UserStore
+	Store      store.UserStore
+	TokenStore store.TokenStore
+	AuditStore store.AuditStore
+	// JWT verifies JWT access tokens, it is nil when access tokens are
+	// opaque.
+	JWT      *tokens.JWTCodec
+	Logger   *log.Logger
+	lastUsed *lastUsedThrottle
+	revoked  *revocationList
+}
+
+// lastUsedInterval is how stale a token's last_used_at may get, so that
+// authenticated requests do not all turn into a write.
+const lastUsedInterval = 5 * time.Minute
+
+func NewUserMiddleware(store store.UserStore, tokenStore store.TokenStore, auditStore store.AuditStore, jwt *tokens.JWTCodec, logger *log.Logger) *UserMiddleware {
+	return &UserMiddleware{
+		Store:      store,
+		TokenStore: tokenStore,
+		AuditStore: auditStore,
+		JWT:        jwt,
+		Logger:     logger,
+		lastUsed:   newLastUsedThrottle(lastUsedInterval, maxTrackedTokens),
+		revoked:    newRevocationList(tokenStore),
+	}
 }
 
 type UserContextKey string
 
 const (
-	UserContextKeyName = UserContextKey("user")
-	BearerTokenName    = "Bearer"
+	UserContextKeyName     = UserContextKey("user")
+	RealUserContextKeyName = UserContextKey("real-user")
+	TokenContextKeyName    = UserContextKey("token")
+	BearerTokenName        = "Bearer"
+
+	// ImpersonatedByHeader marks the responses to impersonated requests with
+	// the id of the admin behind them.
+	ImpersonatedByHeader = "X-Impersonated-By"
 )
 
 func SetUser(r *http.Request, user *store.User) *http.Request {
@@ -35,35 +72,242 @@ func GetUser(r *http.Request) *store.User {
 	return user
 }
 
+func SetRealUser(r *http.Request, user *store.User) *http.Request {
+	ctx := context.WithValue(r.Context(), RealUserContextKeyName, user)
+	return r.WithContext(ctx)
+}
+
+// GetRealUser returns who is actually behind the request: the admin when the
+// request is impersonated, the same user as GetUser otherwise.
+func GetRealUser(r *http.Request) *store.User {
+	user, ok := r.Context().Value(RealUserContextKeyName).(*store.User)
+	if !ok {
+		return GetUser(r)
+	}
+
+	return user
+}
+
+// IsImpersonating reports whether an admin makes the request as another user.
+func IsImpersonating(r *http.Request) bool {
+	token := GetToken(r)
+	return token != nil && token.Scope == tokens.ScopeImpersonation
+}
+
+func SetToken(r *http.Request, token *tokens.Token) *http.Request {
+	ctx := context.WithValue(r.Context(), TokenContextKeyName, token)
+	return r.WithContext(ctx)
+}
+
+// GetToken returns the token the request was authenticated with, or nil for
+// anonymous requests.
+func GetToken(r *http.Request) *tokens.Token {
+	token, _ := r.Context().Value(TokenContextKeyName).(*tokens.Token)
+	return token
+}
+
+// GetPermissions returns what the request is allowed to do: everything for
+// an interactive session, the permissions granted to the key for an API key.
+func GetPermissions(r *http.Request) tokens.Permissions {
+	token := GetToken(r)
+
+	switch {
+	case token == nil:
+		return nil
+	case token.Scope == tokens.ScopeAPIKey:
+		return token.Permissions
+	default:
+		return tokens.AllPermissions
+	}
+}
+
 func (um *UserMiddleware) Authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "Cookie")
 		authHeader := r.Header.Get("Authorization")
 
-		if authHeader == "" {
-			r := SetUser(r, store.AnonymousUser)
-			next.ServeHTTP(w, r)
-			return
+		var plaintext string
+		switch {
+		case authHeader != "":
+			headerParts := strings.Split(authHeader, " ")
+			if len(headerParts) != 2 || headerParts[0] != BearerTokenName {
+				utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or missing authorization header"})
+				return
+			}
+
+			plaintext = headerParts[1]
+		default:
+			cookie, err := r.Cookie(SessionCookieName)
+			if err != nil || cookie.Value == "" {
+				r := SetUser(r, store.AnonymousUser)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if !safeMethod(r.Method) && !ValidCSRF(r, CSRFToken(cookie.Value)) {
+				utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "missing or invalid CSRF token"})
+				return
+			}
+
+			plaintext = cookie.Value
 		}
 
-		headerParts := strings.Split(authHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != BearerTokenName {
-			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or missing authorization header"})
+		var user *store.User
+		var token *tokens.Token
+		var err error
+
+		// API keys stay opaque, as do auth tokens issued before switching
+		// to JWTs
+		if um.JWT != nil && tokens.IsJWT(plaintext) {
+			user, token, err = um.authenticateJWT(plaintext)
+		} else {
+			user, token, err = um.Store.GetUserAndToken(plaintext, tokens.ScopeAuth, tokens.ScopeAPIKey, tokens.ScopeImpersonation)
+		}
+
+		if errors.Is(err, errRevocationsStale) {
+			utils.WriteJSON(w, http.StatusServiceUnavailable, utils.Envelope{"error": "auth tokens cannot be verified at the moment, retry later"})
 			return
 		}
 
-		token := headerParts[1]
-		user, err := um.Store.GetUserByToken(tokens.ScopeAuth, token)
 		if err != nil || user == nil {
 			utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired auth token"})
 			return
 		}
 
+		// suspending a user revokes their tokens, JWTs included, this only
+		// catches requests racing with the suspension
+		if user.IsSuspended() {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "your account is suspended"})
+			return
+		}
+
+		if token.Scope == tokens.ScopeImpersonation {
+			admin, err := um.impersonator(token)
+			if err != nil {
+				um.Logger.Printf("WARNING: impersonation token of user %d rejected %v", token.ImpersonatorId, err)
+				utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired auth token"})
+				return
+			}
+
+			r = SetRealUser(r, admin)
+			w.Header().Set(ImpersonatedByHeader, strconv.FormatInt(admin.Id, 10))
+			um.recordImpersonatedRequest(r, admin, user)
+		}
+
+		um.touch(token.Hash)
+
 		r = SetUser(r, user)
+		r = SetToken(r, token)
 		next.ServeHTTP(w, r)
 	})
 }
 
+var (
+	errTokenRevoked = errors.New("token revoked")
+	// errRevocationsStale is returned while the revocation list cannot be
+	// synced: JWTs are refused rather than trusted blindly.
+	errRevocationsStale = errors.New("revocation list is stale")
+)
+
+// authenticateJWT verifies a JWT access token against the signing keys and
+// the revocation list, without querying the database. The user is the partial
+// one described by the claims.
+func (um *UserMiddleware) authenticateJWT(raw string) (*store.User, *tokens.Token, error) {
+	token, claims, err := um.JWT.Verify(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	if um.revoked.stale(now) {
+		go func() {
+			err := um.SyncRevocations()
+			if err != nil {
+				um.Logger.Printf("ERROR: SyncRevocations %v", err)
+			}
+		}()
+	}
+
+	fresh, syncedAt := um.revoked.fresh(now)
+	if !fresh {
+		if um.revoked.refusing.CompareAndSwap(false, true) {
+			um.Logger.Printf("ERROR: revocation list not synced since %s, refusing JWT access tokens", syncedAt.Format(time.RFC3339))
+		}
+		return nil, nil, errRevocationsStale
+	}
+
+	if um.revoked.refusing.CompareAndSwap(true, false) {
+		um.Logger.Printf("WARNING: revocation list synced again, accepting JWT access tokens")
+	}
+
+	if um.revoked.isRevoked(claims.ID) {
+		return nil, nil, errTokenRevoked
+	}
+
+	user := &store.User{
+		Id:        token.UserId,
+		Username:  claims.Username,
+		Role:      store.Role(claims.Role),
+		Activated: claims.Activated,
+	}
+
+	return user, token, nil
+}
+
+// recordImpersonatedRequest audits a request admin makes as user, before it
+// is served. A failure is only logged, like the events of the handlers.
+func (um *UserMiddleware) recordImpersonatedRequest(r *http.Request, admin *store.User, user *store.User) {
+	err := um.AuditStore.RecordEvent(&store.AuditEvent{
+		ActorId:        &admin.Id,
+		ImpersonatorId: &admin.Id,
+		UserId:         &user.Id,
+		Action:         store.AuditImpersonatedRequest,
+		IP:             utils.ClientIP(r),
+		Metadata:       map[string]any{"method": r.Method, "path": r.URL.Path},
+	})
+	if err != nil {
+		um.Logger.Printf("ERROR: recording impersonated request of admin %d as user %d %v", admin.Id, user.Id, err)
+	}
+}
+
+var errNotAnAdmin = errors.New("impersonator is no longer an admin")
+
+// impersonator loads the admin behind an impersonation token, who must still
+// be an admin in good standing.
+func (um *UserMiddleware) impersonator(token *tokens.Token) (*store.User, error) {
+	admin, err := um.Store.GetUserById(token.ImpersonatorId)
+	if err != nil {
+		return nil, err
+	}
+
+	if admin.Role != store.RoleAdmin || admin.IsSuspended() {
+		return nil, errNotAnAdmin
+	}
+
+	return admin, nil
+}
+
+// SyncRevocations refreshes the list of revoked JWT access tokens.
+func (um *UserMiddleware) SyncRevocations() error {
+	return um.revoked.sync()
+}
+
+// touch records that the token hashed as hash was used, at most once per
+// lastUsedInterval.
+func (um *UserMiddleware) touch(hash []byte) {
+	if !um.lastUsed.allow(hash, time.Now()) {
+		return
+	}
+
+	go func() {
+		err := um.TokenStore.TouchToken(hash)
+		if err != nil {
+			um.Logger.Printf("ERROR: TouchToken %v", err)
+		}
+	}()
+}
+
 func (um *UserMiddleware) RequireUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := GetUser(r)
@@ -76,3 +320,94 @@ func (um *UserMiddleware) RequireUser(next http.HandlerFunc) http.HandlerFunc {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// RequireActivatedUser is RequireUser for routes only open to accounts whose
+// email has been verified.
+func (um *UserMiddleware) RequireActivatedUser(next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		user := GetUser(r)
+
+		if !user.Activated {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "your account must be activated to access this resource"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireRole is RequireUser for routes restricted to some roles.
+func (um *UserMiddleware) RequireRole(roles []store.Role, next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		if !policy.HasRole(GetUser(r), roles...) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "you do not have permission to access this resource"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequirePermission is RequireUser for routes which API keys may only use when
+// granted permission.
+func (um *UserMiddleware) RequirePermission(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		if !GetPermissions(r).Includes(permission) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": fmt.Sprintf("the %s permission is required", permission)})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireUserRecord is RequireUser for routes needing the whole user: users
+// authenticated with a JWT only carry what its claims tell, they are loaded
+// from the database.
+func (um *UserMiddleware) RequireUserRecord(next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		if token := GetToken(r); token != nil && token.Stateless {
+			user, err := um.Store.GetUserById(GetUser(r).Id)
+			if errors.Is(err, sql.ErrNoRows) {
+				utils.WriteJSON(w, http.StatusUnauthorized, utils.Envelope{"error": "invalid or expired auth token"})
+				return
+			}
+
+			if err != nil {
+				um.Logger.Printf("ERROR: GetUserById %v", err)
+				utils.WriteJSON(w, http.StatusInternalServerError, utils.Envelope{"error": "internal server error"})
+				return
+			}
+
+			r = SetUser(r, user)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireNotImpersonating is RequireUser for routes which admins impersonating
+// a user must not use, such as changing their credentials.
+func (um *UserMiddleware) RequireNotImpersonating(next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		if IsImpersonating(r) {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "this resource cannot be accessed while impersonating"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireSession is RequireUserRecord for routes closed to API keys and to
+// impersonation, such as credential and key management.
+func (um *UserMiddleware) RequireSession(next http.HandlerFunc) http.HandlerFunc {
+	return um.RequireUserRecord(um.RequireNotImpersonating(func(w http.ResponseWriter, r *http.Request) {
+		if GetToken(r).Scope == tokens.ScopeAPIKey {
+			utils.WriteJSON(w, http.StatusForbidden, utils.Envelope{"error": "this resource cannot be accessed with an API key"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}))
+}
@@ -0,0 +1,367 @@
+package middleware
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/tokens"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUserStore knows a single auth token.
+type fakeUserStore struct {
+	store.UserStore
+	token     *tokens.Token
+	role      store.Role
+	suspended bool
+	// impersonator is the admin behind an impersonation token.
+	impersonator *store.User
+}
+
+func (s *fakeUserStore) GetUserAndToken(plaintext string, scopes ...string) (*store.User, *tokens.Token, error) {
+	if plaintext != s.token.Plaintext {
+		return nil, nil, sql.ErrNoRows
+	}
+
+	user := &store.User{Id: s.token.UserId, Role: s.role}
+	if s.suspended {
+		now := time.Now()
+		user.SuspendedAt = &now
+	}
+
+	return user, s.token, nil
+}
+
+func (s *fakeUserStore) GetUserById(id int64) (*store.User, error) {
+	if s.impersonator == nil || s.impersonator.Id != id {
+		return nil, sql.ErrNoRows
+	}
+
+	return s.impersonator, nil
+}
+
+// fakeTokenStore ignores token uses.
+type fakeTokenStore struct {
+	store.TokenStore
+}
+
+func (fakeTokenStore) TouchToken(hash []byte) error {
+	return nil
+}
+
+// fakeAuditStore keeps recorded events in memory.
+type fakeAuditStore struct {
+	store.AuditStore
+	mu     sync.Mutex
+	events []store.AuditEvent
+}
+
+func (s *fakeAuditStore) RecordEvent(event *store.AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.events = append(s.events, *event)
+	return nil
+}
+
+func TestAuthenticateCookie(t *testing.T) {
+	token, err := tokens.GenerateToken(7, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+
+	um := NewUserMiddleware(&fakeUserStore{token: token}, fakeTokenStore{}, &fakeAuditStore{}, nil, log.New(io.Discard, "", 0))
+	handler := um.Authenticate(um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name   string
+		method string
+		cookie string
+		csrf   string
+		want   int
+	}{
+		{name: "no cookie", method: http.MethodGet, want: http.StatusUnauthorized},
+		{name: "unknown cookie", method: http.MethodGet, cookie: "unknown", want: http.StatusUnauthorized},
+		{name: "safe method", method: http.MethodGet, cookie: token.Plaintext, want: http.StatusNoContent},
+		{name: "missing csrf", method: http.MethodPost, cookie: token.Plaintext, want: http.StatusForbidden},
+		{name: "wrong csrf", method: http.MethodDelete, cookie: token.Plaintext, csrf: CSRFToken("other"), want: http.StatusForbidden},
+		{name: "valid csrf", method: http.MethodPost, cookie: token.Plaintext, csrf: CSRFToken(token.Plaintext), want: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/workouts", nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: SessionCookieName, Value: tt.cookie})
+			}
+			if tt.csrf != "" {
+				req.Header.Set(CSRFHeaderName, tt.csrf)
+			}
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.want, rec.Code)
+		})
+	}
+
+	t.Run("bearer needs no csrf", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/workouts", nil)
+		req.Header.Set("Authorization", "Bearer "+token.Plaintext)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+	})
+}
+
+func TestAuthenticateSuspended(t *testing.T) {
+	token, err := tokens.GenerateToken(7, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+
+	um := NewUserMiddleware(&fakeUserStore{token: token, suspended: true}, fakeTokenStore{}, &fakeAuditStore{}, nil, log.New(io.Discard, "", 0))
+	handler := um.Authenticate(um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/workouts", nil)
+	req.Header.Set("Authorization", "Bearer "+token.Plaintext)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func TestRequireRole(t *testing.T) {
+	token, err := tokens.GenerateToken(7, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+
+	tests := []struct {
+		role store.Role
+		want int
+	}{
+		{role: store.RoleUser, want: http.StatusForbidden},
+		{role: store.RoleCoach, want: http.StatusForbidden},
+		{role: store.RoleAdmin, want: http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.role), func(t *testing.T) {
+			um := NewUserMiddleware(&fakeUserStore{token: token, role: tt.role}, fakeTokenStore{}, &fakeAuditStore{}, nil, log.New(io.Discard, "", 0))
+			handler := um.Authenticate(um.RequireRole([]store.Role{store.RoleAdmin}, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/admin/users", nil)
+			req.Header.Set("Authorization", "Bearer "+token.Plaintext)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.want, rec.Code)
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	apiKey, err := tokens.GenerateToken(7, time.Hour, tokens.ScopeAPIKey)
+	require.NoError(t, err)
+	apiKey.Permissions = tokens.Permissions{tokens.PermissionWorkoutsRead}
+
+	session, err := tokens.GenerateToken(7, time.Hour, tokens.ScopeAuth)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		token *tokens.Token
+		guard func(um *UserMiddleware, next http.HandlerFunc) http.HandlerFunc
+		want  int
+	}{
+		{name: "key with the permission", token: apiKey, guard: func(um *UserMiddleware, next http.HandlerFunc) http.HandlerFunc {
+			return um.RequirePermission(tokens.PermissionWorkoutsRead, next)
+		}, want: http.StatusNoContent},
+		{name: "key without the permission", token: apiKey, guard: func(um *UserMiddleware, next http.HandlerFunc) http.HandlerFunc {
+			return um.RequirePermission(tokens.PermissionWorkoutsWrite, next)
+		}, want: http.StatusForbidden},
+		{name: "session", token: session, guard: func(um *UserMiddleware, next http.HandlerFunc) http.HandlerFunc {
+			return um.RequirePermission(tokens.PermissionWorkoutsWrite, next)
+		}, want: http.StatusNoContent},
+		{name: "key on a session route", token: apiKey, guard: (*UserMiddleware).RequireSession, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			um := NewUserMiddleware(&fakeUserStore{token: tt.token}, fakeTokenStore{}, &fakeAuditStore{}, nil, log.New(io.Discard, "", 0))
+			handler := um.Authenticate(tt.guard(um, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/workouts", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token.Plaintext)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.want, rec.Code)
+		})
+	}
+}
+
+func TestAuthenticateImpersonation(t *testing.T) {
+	token, err := tokens.GenerateToken(7, time.Hour, tokens.ScopeImpersonation)
+	require.NoError(t, err)
+	token.ImpersonatorId = 1
+
+	tests := []struct {
+		name         string
+		impersonator *store.User
+		guard        func(um *UserMiddleware, next http.HandlerFunc) http.HandlerFunc
+		want         int
+		audited      bool
+	}{
+		{name: "admin", impersonator: &store.User{Id: 1, Role: store.RoleAdmin}, guard: (*UserMiddleware).RequireUser, want: http.StatusNoContent, audited: true},
+		{name: "demoted admin", impersonator: &store.User{Id: 1, Role: store.RoleUser}, guard: (*UserMiddleware).RequireUser, want: http.StatusUnauthorized},
+		{name: "deleted admin", guard: (*UserMiddleware).RequireUser, want: http.StatusUnauthorized},
+		{name: "sensitive route", impersonator: &store.User{Id: 1, Role: store.RoleAdmin}, guard: (*UserMiddleware).RequireSession, want: http.StatusForbidden, audited: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auditStore := &fakeAuditStore{}
+			um := NewUserMiddleware(&fakeUserStore{token: token, impersonator: tt.impersonator}, fakeTokenStore{}, auditStore, nil, log.New(io.Discard, "", 0))
+			handler := um.Authenticate(tt.guard(um, func(w http.ResponseWriter, r *http.Request) {
+				assert.True(t, IsImpersonating(r))
+				assert.Equal(t, int64(7), GetUser(r).Id)
+				assert.Equal(t, int64(1), GetRealUser(r).Id)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/users/me", nil)
+			req.Header.Set("Authorization", "Bearer "+token.Plaintext)
+
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			assert.Equal(t, tt.want, rec.Code)
+			if tt.want == http.StatusNoContent {
+				assert.Equal(t, "1", rec.Header().Get(ImpersonatedByHeader))
+			}
+
+			if !tt.audited {
+				assert.Empty(t, auditStore.events)
+				return
+			}
+
+			require.Len(t, auditStore.events, 1)
+			event := auditStore.events[0]
+			assert.Equal(t, store.AuditImpersonatedRequest, event.Action)
+			assert.Equal(t, int64(1), *event.ActorId, "the admin acts")
+			assert.Equal(t, int64(1), *event.ImpersonatorId)
+			assert.Equal(t, int64(7), *event.UserId)
+			assert.Equal(t, map[string]any{"method": http.MethodGet, "path": "/users/me"}, event.Metadata)
+		})
+	}
+}
+
+func TestLastUsedThrottle(t *testing.T) {
+	throttle := newLastUsedThrottle(time.Minute, 2)
+	now := time.Now()
+	a, b, c := []byte("a"), []byte("b"), []byte("c")
+
+	assert.True(t, throttle.allow(a, now))
+	assert.False(t, throttle.allow(a, now.Add(30*time.Second)), "uses within the interval are not recorded")
+	assert.True(t, throttle.allow(a, now.Add(time.Minute)))
+
+	assert.True(t, throttle.allow(b, now.Add(time.Minute)))
+	assert.True(t, throttle.allow(c, now.Add(time.Minute)))
+	assert.Len(t, throttle.seen, 2, "the least recently recorded token is forgotten")
+	assert.Equal(t, 2, throttle.recent.Len())
+
+	assert.True(t, throttle.allow(a, now.Add(time.Minute)), "forgotten tokens are recorded again")
+	assert.False(t, throttle.allow(c, now.Add(time.Minute)))
+}
+
+// revocationTokenStore lists the revoked tokens it is given, or fails with
+// err.
+type revocationTokenStore struct {
+	fakeTokenStore
+	mu      sync.Mutex
+	revoked []store.RevokedToken
+	err     error
+}
+
+func (s *revocationTokenStore) ListRevokedTokens(since time.Time) ([]store.RevokedToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.revoked, s.err
+}
+
+func (s *revocationTokenStore) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err
+}
+
+func TestAuthenticateJWTRevocations(t *testing.T) {
+	keys, err := tokens.ParseSigningKeys("k1:HS256:" + base64.StdEncoding.EncodeToString(make([]byte, 32)))
+	require.NoError(t, err)
+	codec, err := tokens.NewJWTCodec(keys)
+	require.NoError(t, err)
+
+	jwt := func() *tokens.Token {
+		token, err := tokens.GenerateToken(7, time.Hour, tokens.ScopeAuth)
+		require.NoError(t, err)
+		require.NoError(t, codec.Sign(token, "janedoe", string(store.RoleUser), true))
+		return token
+	}
+
+	valid, revoked := jwt(), jwt()
+	tokenStore := &revocationTokenStore{revoked: []store.RevokedToken{
+		{TokenId: tokens.TokenId(revoked.Hash), Expiry: revoked.Expiry, RevokedAt: time.Now()},
+	}}
+
+	um := NewUserMiddleware(&fakeUserStore{}, tokenStore, &fakeAuditStore{}, codec, log.New(io.Discard, "", 0))
+	require.NoError(t, um.SyncRevocations())
+
+	handler := um.Authenticate(um.RequireUser(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	authenticate := func(token *tokens.Token) int {
+		req := httptest.NewRequest(http.MethodGet, "/workouts", nil)
+		req.Header.Set("Authorization", "Bearer "+token.Plaintext)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusNoContent, authenticate(valid))
+	assert.Equal(t, http.StatusUnauthorized, authenticate(revoked))
+
+	// the database goes away long enough for revocations to be missed
+	tokenStore.setErr(errors.New("connection refused"))
+	um.revoked.mu.Lock()
+	um.revoked.syncedAt = time.Now().Add(-revocationMaxStaleness)
+	um.revoked.attemptedAt = um.revoked.syncedAt
+	um.revoked.mu.Unlock()
+
+	assert.Equal(t, http.StatusServiceUnavailable, authenticate(valid), "JWTs are refused rather than trusted blindly")
+
+	tokenStore.setErr(nil)
+	require.Eventually(t, func() bool {
+		um.revoked.mu.Lock()
+		um.revoked.attemptedAt = time.Time{}
+		um.revoked.mu.Unlock()
+		return authenticate(valid) == http.StatusNoContent
+	}, time.Second, 10*time.Millisecond, "JWTs are accepted again once synced")
+	assert.Equal(t, http.StatusUnauthorized, authenticate(revoked))
+}
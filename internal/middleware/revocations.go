@@ -0,0 +1,113 @@
+package middleware
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/store"
+)
+
+const (
+	// revocationSyncInterval bounds how long a revoked JWT stays usable.
+	revocationSyncInterval = 15 * time.Second
+	// revocationSyncOverlap re-reads recent revocations, in case some were
+	// committed out of order after the previous sync.
+	revocationSyncOverlap = time.Minute
+	// revocationMaxStaleness is how long the list may go without a
+	// successful sync before JWTs are refused: past it, revoked sessions
+	// could be used indefinitely, so verification fails closed.
+	revocationMaxStaleness = 4 * revocationSyncInterval
+)
+
+// revocationList is an in-memory copy of the revoked auth tokens, refreshed
+// in the background so JWTs are checked without a database round trip.
+type revocationList struct {
+	tokenStore store.TokenStore
+
+	mu       sync.RWMutex
+	revoked  map[string]time.Time
+	lastSeen time.Time
+	syncedAt time.Time
+	// attemptedAt is the start of the last sync, successful or not, so a
+	// failing database is retried once per interval rather than on every
+	// request.
+	attemptedAt time.Time
+
+	syncing atomic.Bool
+	// refusing is set while JWTs are refused for want of a recent sync.
+	refusing atomic.Bool
+}
+
+func newRevocationList(tokenStore store.TokenStore) *revocationList {
+	return &revocationList{
+		tokenStore: tokenStore,
+		revoked:    map[string]time.Time{},
+	}
+}
+
+// isRevoked reports whether the token with the given JWT id was revoked.
+func (l *revocationList) isRevoked(tokenId string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	_, ok := l.revoked[tokenId]
+	return ok
+}
+
+// stale reports whether the list is due for a sync.
+func (l *revocationList) stale(now time.Time) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return now.Sub(l.attemptedAt) >= revocationSyncInterval
+}
+
+// fresh reports whether the list synced recently enough to be trusted,
+// returning the time of its last successful sync.
+func (l *revocationList) fresh(now time.Time) (bool, time.Time) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return now.Sub(l.syncedAt) < revocationMaxStaleness, l.syncedAt
+}
+
+// sync fetches the revocations recorded since the last sync and forgets the
+// ones of expired tokens. Concurrent calls return immediately.
+func (l *revocationList) sync() error {
+	if !l.syncing.CompareAndSwap(false, true) {
+		return nil
+	}
+	defer l.syncing.Store(false)
+
+	l.mu.Lock()
+	since := l.lastSeen.Add(-revocationSyncOverlap)
+	l.attemptedAt = time.Now()
+	l.mu.Unlock()
+
+	revoked, err := l.tokenStore.ListRevokedTokens(since)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for tokenId, expiry := range l.revoked {
+		if !expiry.After(now) {
+			delete(l.revoked, tokenId)
+		}
+	}
+
+	for _, token := range revoked {
+		l.revoked[token.TokenId] = token.Expiry
+		if token.RevokedAt.After(l.lastSeen) {
+			l.lastSeen = token.RevokedAt
+		}
+	}
+
+	l.syncedAt = now
+	return nil
+}
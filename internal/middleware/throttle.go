@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// lastUsedThrottle remembers when each token was last recorded as used so the
+// database is only written to once per interval and token. It tracks at most
+// capacity tokens, forgetting the least recently recorded first: a forgotten
+// token is merely recorded again early.
+type lastUsedThrottle struct {
+	mu       sync.Mutex
+	interval time.Duration
+	capacity int
+	seen     map[[sha256.Size]byte]*list.Element
+	// recent orders the tracked tokens, the most recently recorded first.
+	recent *list.List
+}
+
+type lastUsedEntry struct {
+	key [sha256.Size]byte
+	at  time.Time
+}
+
+// maxTrackedTokens bounds the memory used by the throttle.
+const maxTrackedTokens = 10000
+
+func newLastUsedThrottle(interval time.Duration, capacity int) *lastUsedThrottle {
+	return &lastUsedThrottle{
+		interval: interval,
+		capacity: capacity,
+		seen:     map[[sha256.Size]byte]*list.Element{},
+		recent:   list.New(),
+	}
+}
+
+// allow reports whether the use of the token hashed as hash at now should be
+// recorded.
+func (t *lastUsedThrottle) allow(hash []byte, now time.Time) bool {
+	var key [sha256.Size]byte
+	copy(key[:], hash)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if element, ok := t.seen[key]; ok {
+		entry := element.Value.(*lastUsedEntry)
+		if now.Sub(entry.at) < t.interval {
+			return false
+		}
+
+		entry.at = now
+		t.recent.MoveToFront(element)
+		return true
+	}
+
+	t.seen[key] = t.recent.PushFront(&lastUsedEntry{key: key, at: now})
+	if t.recent.Len() > t.capacity {
+		oldest := t.recent.Back()
+		t.recent.Remove(oldest)
+		delete(t.seen, oldest.Value.(*lastUsedEntry).key)
+	}
+
+	return true
+}
@@ -0,0 +1,188 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// stubProvider is a minimal OpenID provider issuing ID tokens for whatever
+// authorization code it is given.
+type stubProvider struct {
+	*httptest.Server
+	key       *rsa.PrivateKey
+	challenge string
+	claims    map[string]any
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	stub := &stubProvider{key: key}
+	mux := http.NewServeMux()
+	stub.Server = httptest.NewServer(mux)
+	t.Cleanup(stub.Close)
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 stub.URL,
+			"authorization_endpoint": stub.URL + "/authorize",
+			"token_endpoint":         stub.URL + "/token",
+			"jwks_uri":               stub.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "stub",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if Challenge(r.PostForm.Get("code_verifier")) != stub.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": stub.sign(t, stub.claims)})
+	})
+
+	return stub
+}
+
+func (s *stubProvider) sign(t *testing.T, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "stub", "typ": "JWT"})
+	require.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	require.NoError(t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestExchange(t *testing.T) {
+	stub := newStubProvider(t)
+	provider := NewProvider(Config{
+		Name:        "stub",
+		Issuer:      stub.URL,
+		ClientID:    "workouts",
+		RedirectURL: "http://localhost:8080/auth/oidc/stub/callback",
+	}, stub.Client())
+
+	ctx := context.Background()
+	verifier, err := NewVerifier()
+	require.NoError(t, err)
+	stub.challenge = Challenge(verifier)
+
+	validClaims := func() map[string]any {
+		return map[string]any{
+			"iss":            stub.URL,
+			"sub":            "42",
+			"aud":            "workouts",
+			"exp":            time.Now().Add(time.Minute).Unix(),
+			"nonce":          "nonce",
+			"email":          "jane@example.com",
+			"email_verified": true,
+		}
+	}
+
+	t.Run("auth code url", func(t *testing.T) {
+		raw, err := provider.AuthCodeURL(ctx, "state", "nonce", verifier)
+		require.NoError(t, err)
+
+		u, err := url.Parse(raw)
+		require.NoError(t, err)
+		assert.Equal(t, "/authorize", u.Path)
+		assert.Equal(t, "state", u.Query().Get("state"))
+		assert.Equal(t, stub.challenge, u.Query().Get("code_challenge"))
+		assert.Equal(t, "S256", u.Query().Get("code_challenge_method"))
+	})
+
+	tests := []struct {
+		name    string
+		modify  func(map[string]any)
+		nonce   string
+		wantErr bool
+	}{
+		{name: "valid", modify: func(map[string]any) {}, nonce: "nonce"},
+		{name: "audience array", modify: func(c map[string]any) { c["aud"] = []string{"other", "workouts"} }, nonce: "nonce"},
+		{name: "nonce mismatch", modify: func(map[string]any) {}, nonce: "other", wantErr: true},
+		{name: "wrong audience", modify: func(c map[string]any) { c["aud"] = "other" }, nonce: "nonce", wantErr: true},
+		{name: "wrong issuer", modify: func(c map[string]any) { c["iss"] = "https://evil.example.com" }, nonce: "nonce", wantErr: true},
+		{name: "expired", modify: func(c map[string]any) { c["exp"] = time.Now().Add(-time.Minute).Unix() }, nonce: "nonce", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stub.claims = validClaims()
+			tt.modify(stub.claims)
+
+			claims, err := provider.Exchange(ctx, "code", verifier, tt.nonce)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidIDToken)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, "42", claims.Subject)
+			assert.Equal(t, "jane@example.com", claims.Email)
+			assert.True(t, claims.EmailVerified)
+		})
+	}
+
+	t.Run("wrong verifier", func(t *testing.T) {
+		stub.claims = validClaims()
+		_, err := provider.Exchange(ctx, "code", "not-the-verifier", "nonce")
+		assert.Error(t, err)
+	})
+}
+
+func TestLoadProviders(t *testing.T) {
+	env := map[string]string{
+		"OIDC_PROVIDERS":           "google, my-idp",
+		"OIDC_GOOGLE_ISSUER":       "https://accounts.google.com",
+		"OIDC_GOOGLE_CLIENT_ID":    "id",
+		"OIDC_GOOGLE_REDIRECT_URL": "http://localhost/cb",
+		"OIDC_MY_IDP_ISSUER":       "http://localhost:9000",
+		"OIDC_MY_IDP_CLIENT_ID":    "id",
+		"OIDC_MY_IDP_REDIRECT_URL": "http://localhost/cb",
+	}
+
+	providers, err := LoadProviders(func(key string) string { return env[key] })
+	require.NoError(t, err)
+	assert.Len(t, providers, 2)
+
+	_, err = providers.Get("my-idp")
+	assert.NoError(t, err)
+	_, err = providers.Get("github")
+	assert.ErrorIs(t, err, ErrUnknownProvider)
+
+	delete(env, "OIDC_GOOGLE_CLIENT_ID")
+	_, err = LoadProviders(func(key string) string { return env[key] })
+	assert.Error(t, err)
+}
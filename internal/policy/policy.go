@@ -0,0 +1,53 @@
+// Package policy decides what users may do to resources, so handlers consult
+// a single set of rules instead of comparing owners themselves.
+//
+// Owners manage their own resources and admins manage everyone's. Coaches
+// have no rights over other users' workouts until athletes can be assigned to
+// them. Other users only see public workouts, and unlisted ones through their
+// share link.
+package policy
+
+import (
+	"slices"
+
+	"github.com/martialanouman/femProject/internal/store"
+)
+
+// HasRole reports whether user has one of roles.
+func HasRole(user *store.User, roles ...store.Role) bool {
+	return !user.IsAnonymous() && slices.Contains(roles, user.Role)
+}
+
+// CanViewWorkout reports whether user may see workout. Workouts shared with
+// followers stay private until users can follow each other.
+func CanViewWorkout(user *store.User, workout *store.Workout) bool {
+	return workout.Visibility == store.VisibilityPublic || isOwnerOrAdmin(user, workout.UserId)
+}
+
+// VisibleWorkouts returns the visibilities of the workouts of ownerId listed
+// to user, nil meaning all of them.
+func VisibleWorkouts(user *store.User, ownerId int64) []store.Visibility {
+	if isOwnerOrAdmin(user, ownerId) {
+		return nil
+	}
+
+	return []store.Visibility{store.VisibilityPublic}
+}
+
+// CanUpdateWorkout reports whether user may modify a workout owned by ownerId.
+func CanUpdateWorkout(user *store.User, ownerId int64) bool {
+	return isOwnerOrAdmin(user, ownerId)
+}
+
+// CanDeleteWorkout reports whether user may delete a workout owned by ownerId.
+func CanDeleteWorkout(user *store.User, ownerId int64) bool {
+	return isOwnerOrAdmin(user, ownerId)
+}
+
+func isOwnerOrAdmin(user *store.User, ownerId int64) bool {
+	if user.IsAnonymous() {
+		return false
+	}
+
+	return user.Id == ownerId || user.Role == store.RoleAdmin
+}
@@ -0,0 +1,72 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkoutPolicy(t *testing.T) {
+	owner := &store.User{Id: 1, Role: store.RoleUser}
+	other := &store.User{Id: 2, Role: store.RoleUser}
+	coach := &store.User{Id: 3, Role: store.RoleCoach}
+	admin := &store.User{Id: 4, Role: store.RoleAdmin}
+
+	tests := []struct {
+		name string
+		user *store.User
+		want bool
+	}{
+		{name: "owner", user: owner, want: true},
+		{name: "other user", user: other, want: false},
+		{name: "coach", user: coach, want: false},
+		{name: "admin", user: admin, want: true},
+		{name: "anonymous", user: store.AnonymousUser, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, CanUpdateWorkout(tt.user, owner.Id))
+			assert.Equal(t, tt.want, CanDeleteWorkout(tt.user, owner.Id))
+		})
+	}
+}
+
+func TestCanViewWorkout(t *testing.T) {
+	owner := &store.User{Id: 1, Role: store.RoleUser}
+	other := &store.User{Id: 2, Role: store.RoleUser}
+	admin := &store.User{Id: 3, Role: store.RoleAdmin}
+
+	tests := []struct {
+		visibility store.Visibility
+		user       *store.User
+		want       bool
+	}{
+		{visibility: store.VisibilityPrivate, user: owner, want: true},
+		{visibility: store.VisibilityPrivate, user: other, want: false},
+		{visibility: store.VisibilityPrivate, user: admin, want: true},
+		{visibility: store.VisibilityFollowers, user: other, want: false},
+		{visibility: store.VisibilityUnlisted, user: other, want: false},
+		{visibility: store.VisibilityPublic, user: other, want: true},
+		{visibility: store.VisibilityPublic, user: store.AnonymousUser, want: true},
+	}
+
+	for _, tt := range tests {
+		workout := &store.Workout{UserId: owner.Id, Visibility: tt.visibility}
+		assert.Equal(t, tt.want, CanViewWorkout(tt.user, workout), "%s workout seen by user %d", tt.visibility, tt.user.Id)
+	}
+
+	assert.Nil(t, VisibleWorkouts(owner, owner.Id))
+	assert.Nil(t, VisibleWorkouts(admin, owner.Id))
+	assert.Equal(t, []store.Visibility{store.VisibilityPublic}, VisibleWorkouts(other, owner.Id))
+}
+
+func TestHasRole(t *testing.T) {
+	admin := &store.User{Id: 1, Role: store.RoleAdmin}
+
+	assert.True(t, HasRole(admin, store.RoleAdmin))
+	assert.True(t, HasRole(admin, store.RoleCoach, store.RoleAdmin))
+	assert.False(t, HasRole(admin, store.RoleCoach))
+	assert.False(t, HasRole(store.AnonymousUser, store.RoleUser))
+}
@@ -1,29 +1,83 @@
 package routes
 
 import (
+	"expvar"
+	"net/http"
+
 	"github.com/go-chi/chi/v5"
 	"github.com/martialanouman/femProject/internal/app"
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/martialanouman/femProject/internal/tokens"
 )
 
 func SetupRoutes(app *app.Application) *chi.Mux {
 	r := chi.NewRouter()
 
+	// admin routes are closed to API keys
+	admin := func(next http.HandlerFunc) http.HandlerFunc {
+		return app.AuthMiddleware.RequireSession(app.AuthMiddleware.RequireRole([]store.Role{store.RoleAdmin}, next))
+	}
+
 	r.Group(func(r chi.Router) {
 		r.Use(app.AuthMiddleware.Authenticate)
 
-		r.Get("/workouts/{id}", app.AuthMiddleware.RequireUser(app.WorkoutHandler.HandleGetWorkoutById))
-		r.Post("/workouts", app.AuthMiddleware.RequireUser(app.WorkoutHandler.HandleCreateWorkout))
-		r.Put("/workouts/{id}", app.AuthMiddleware.RequireUser(app.WorkoutHandler.HandleUpdateWorkout))
-		r.Delete("/workouts/{id}", app.AuthMiddleware.RequireUser(app.WorkoutHandler.HandleDeleteWorkout))
-		r.Get("/workouts", app.AuthMiddleware.RequireUser(app.WorkoutHandler.HandleGetWorkouts))
+		r.Get("/workouts/{id}", app.AuthMiddleware.RequirePermission(tokens.PermissionWorkoutsRead, app.WorkoutHandler.HandleGetWorkoutById))
+		r.Post("/workouts", app.AuthMiddleware.RequireActivatedUser(app.AuthMiddleware.RequirePermission(tokens.PermissionWorkoutsWrite, app.WorkoutHandler.HandleCreateWorkout)))
+		r.Put("/workouts/{id}", app.AuthMiddleware.RequireActivatedUser(app.AuthMiddleware.RequirePermission(tokens.PermissionWorkoutsWrite, app.WorkoutHandler.HandleUpdateWorkout)))
+		r.Delete("/workouts/{id}", app.AuthMiddleware.RequireActivatedUser(app.AuthMiddleware.RequirePermission(tokens.PermissionWorkoutsWrite, app.WorkoutHandler.HandleDeleteWorkout)))
+		r.Get("/workouts", app.AuthMiddleware.RequirePermission(tokens.PermissionWorkoutsRead, app.WorkoutHandler.HandleGetWorkouts))
+
+		r.Get("/exercises", app.AuthMiddleware.RequirePermission(tokens.PermissionWorkoutsRead, app.ExerciseHandler.HandleListExercises))
+		r.Get("/exercises/{id}", app.AuthMiddleware.RequirePermission(tokens.PermissionWorkoutsRead, app.ExerciseHandler.HandleGetExercise))
+		r.Post("/exercises", app.AuthMiddleware.RequireActivatedUser(app.AuthMiddleware.RequirePermission(tokens.PermissionWorkoutsWrite, app.ExerciseHandler.HandleCreateExercise)))
+
+		r.Get("/users/me", app.AuthMiddleware.RequirePermission(tokens.PermissionProfileRead, app.AuthMiddleware.RequireUserRecord(app.UserHandler.HandleGetCurrentUser)))
+		r.Patch("/users/me", app.AuthMiddleware.RequirePermission(tokens.PermissionProfileWrite, app.AuthMiddleware.RequireUserRecord(app.AuthMiddleware.RequireNotImpersonating(app.UserHandler.HandleUpdateCurrentUser))))
+		r.Delete("/users/me", app.AuthMiddleware.RequireSession(app.UserHandler.HandleDeleteCurrentUser))
+		r.Put("/users/me/password", app.AuthMiddleware.RequireSession(app.UserHandler.HandleChangePassword))
+		r.Post("/users/me/2fa", app.AuthMiddleware.RequireSession(app.TwoFactorHandler.HandleEnrollTwoFactor))
+		r.Post("/users/me/2fa/confirm", app.AuthMiddleware.RequireSession(app.TwoFactorHandler.HandleConfirmTwoFactor))
+		r.Delete("/users/me/2fa", app.AuthMiddleware.RequireSession(app.TwoFactorHandler.HandleDisableTwoFactor))
+		r.Get("/users/me/identities", app.AuthMiddleware.RequireSession(app.OIDCHandler.HandleListIdentities))
+		r.Post("/users/me/identities/{provider}", app.AuthMiddleware.RequireSession(app.OIDCHandler.HandleLinkIdentity))
+		r.Get("/users/me/audit", app.AuthMiddleware.RequireSession(app.AuditHandler.HandleListCurrentUserEvents))
+
+		r.Get("/tokens", app.AuthMiddleware.RequireSession(app.TokenHandler.HandleListSessions))
+		r.Post("/tokens/logout", app.AuthMiddleware.RequireSession(app.TokenHandler.HandleLogout))
+		r.Delete("/tokens/revoke-all", app.AuthMiddleware.RequireSession(app.TokenHandler.HandleRevokeAllTokensForUser))
+		r.Delete("/tokens/{id}", app.AuthMiddleware.RequireSession(app.TokenHandler.HandleRevokeSession))
+
+		r.Post("/api-keys", app.AuthMiddleware.RequireSession(app.APIKeyHandler.HandleCreateAPIKey))
+		r.Get("/api-keys", app.AuthMiddleware.RequireSession(app.APIKeyHandler.HandleListAPIKeys))
+		r.Delete("/api-keys/{id}", app.AuthMiddleware.RequireSession(app.APIKeyHandler.HandleRevokeAPIKey))
 
-		r.Delete("/tokens/revoke-all", app.AuthMiddleware.RequireUser(app.TokenHandler.HandleRevokeAllTokensForUser))
+		r.Get("/admin/users", admin(app.AdminHandler.HandleListUsers))
+		r.Get("/admin/users/{id}", admin(app.AdminHandler.HandleGetUser))
+		r.Delete("/admin/users/{id}", admin(app.AdminHandler.HandleDeleteUser))
+		r.Get("/admin/users/{id}/workouts", admin(app.WorkoutHandler.HandleGetUserWorkouts))
+		r.Put("/admin/users/{id}/suspended", admin(app.AdminHandler.HandleSuspendUser))
+		r.Delete("/admin/users/{id}/suspended", admin(app.AdminHandler.HandleUnsuspendUser))
+		r.Put("/admin/users/{id}/role", admin(app.AdminHandler.HandleSetUserRole))
+		r.Delete("/admin/users/{id}/tokens", admin(app.AdminHandler.HandleRevokeUserTokens))
+		r.Post("/admin/users/{id}/impersonate", admin(app.AdminHandler.HandleImpersonateUser))
+		r.Get("/admin/audit", admin(app.AuditHandler.HandleListEvents))
+		r.Get("/admin/metrics", admin(expvar.Handler().ServeHTTP))
 	})
 
 	r.Get("/health", app.HealthCheck)
+	r.Get("/shared/workouts/{token}", app.WorkoutHandler.HandleGetSharedWorkout)
 
 	r.Post("/users", app.UserHandler.HandleRegisterUser)
+	r.Post("/users/password-reset", app.UserHandler.HandleRequestPasswordReset)
+	r.Put("/users/password", app.UserHandler.HandleResetPassword)
+	r.Put("/users/activated", app.UserHandler.HandleActivateUser)
 	r.Post("/tokens/auth", app.TokenHandler.HandleCreateToken)
+	r.Post("/tokens/refresh", app.TokenHandler.HandleRefreshToken)
+	r.Post("/tokens/2fa", app.TokenHandler.HandleVerifyTwoFactor)
+	r.Post("/tokens/magic-link", app.TokenHandler.HandleRequestMagicLink)
+	r.Post("/tokens/magic-link/redeem", app.TokenHandler.HandleRedeemMagicLink)
+	r.Get("/auth/oidc/{provider}/login", app.OIDCHandler.HandleLogin)
+	r.Get("/auth/oidc/{provider}/callback", app.OIDCHandler.HandleCallback)
 
 	return r
 }
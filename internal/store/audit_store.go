@@ -0,0 +1,190 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/cursor"
+)
+
+// Audited actions.
+const (
+	AuditLogin               = "login"
+	AuditLoginFailed         = "login_failed"
+	AuditLoginLocked         = "login_locked"
+	AuditTwoFactorFailed     = "two_factor_failed"
+	AuditTwoFactorEnrollment = "two_factor_enrollment_started"
+	AuditTwoFactorEnabled    = "two_factor_enabled"
+	AuditTwoFactorDisabled   = "two_factor_disabled"
+	AuditRefreshTokenReused  = "refresh_token_reused"
+	AuditLogout              = "logout"
+	AuditSessionRevoked      = "session_revoked"
+	AuditSessionsRevoked     = "sessions_revoked"
+	AuditAPIKeyCreated       = "api_key_created"
+	AuditAPIKeyRevoked       = "api_key_revoked"
+	AuditIdentityLinked      = "identity_linked"
+	AuditUserRegistered      = "user_registered"
+	AuditUserActivated       = "user_activated"
+	AuditProfileUpdated      = "profile_updated"
+	AuditPasswordChanged     = "password_changed"
+	AuditPasswordReset       = "password_reset"
+	AuditUserDeleted         = "user_deleted"
+	AuditUserSuspended       = "user_suspended"
+	AuditUserUnsuspended     = "user_unsuspended"
+	AuditRoleChanged         = "role_changed"
+	AuditImpersonation       = "impersonation_started"
+	AuditImpersonatedRequest = "impersonated_request"
+	AuditWorkoutCreated      = "workout_created"
+	AuditWorkoutUpdated      = "workout_updated"
+	AuditWorkoutDeleted      = "workout_deleted"
+)
+
+// Kinds of audit event targets.
+const (
+	AuditTargetUser     = "user"
+	AuditTargetSession  = "session"
+	AuditTargetWorkout  = "workout"
+	AuditTargetAPIKey   = "api_key"
+	AuditTargetIdentity = "identity"
+)
+
+// auditListSort is the sort of audit event cursors: newest first.
+const auditListSort = "-id"
+
+// AuditEvent records who did what. ActorId is the user who acted, when known,
+// and ImpersonatorId the admin behind them when impersonating. UserId is the
+// account the event concerns, which admins acting on users or failed logins
+// make different from the actor.
+type AuditEvent struct {
+	Id             int64          `json:"id"`
+	ActorId        *int64         `json:"actor_id"`
+	ImpersonatorId *int64         `json:"impersonator_id,omitempty"`
+	UserId         *int64         `json:"user_id"`
+	Action         string         `json:"action"`
+	TargetType     string         `json:"target_type,omitempty"`
+	TargetId       *int64         `json:"target_id,omitempty"`
+	IP             string         `json:"ip"`
+	Metadata       map[string]any `json:"metadata"`
+	CreatedAt      time.Time      `json:"created_at"`
+}
+
+// AuditFilter selects audit events. Zero fields do not filter.
+type AuditFilter struct {
+	ActorId *int64
+	UserId  *int64
+	Action  string
+	From    *time.Time
+	To      *time.Time
+	Take    int
+	After   *cursor.Cursor
+}
+
+type AuditPage struct {
+	Events []AuditEvent
+	Next   *cursor.Cursor
+}
+
+type AuditStore interface {
+	RecordEvent(event *AuditEvent) error
+	ListEvents(filter AuditFilter) (*AuditPage, error)
+}
+
+type PostgresAuditStore struct {
+	db *sql.DB
+}
+
+func NewPostgresAuditStore(db *sql.DB) *PostgresAuditStore {
+	return &PostgresAuditStore{db}
+}
+
+func (s *PostgresAuditStore) RecordEvent(event *AuditEvent) error {
+	if event.Metadata == nil {
+		event.Metadata = map[string]any{}
+	}
+
+	metadata, err := json.Marshal(event.Metadata)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO audit_events (actor_id, impersonator_id, user_id, action, target_type, target_id, ip, metadata)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8::jsonb)
+	RETURNING id, created_at
+	`
+
+	return s.db.QueryRow(
+		query, event.ActorId, event.ImpersonatorId, event.UserId, event.Action, event.TargetType, event.TargetId, event.IP, string(metadata),
+	).Scan(&event.Id, &event.CreatedAt)
+}
+
+// ListEvents returns a page of the events matching filter, newest first. It
+// returns cursor.ErrInvalidCursor for cursors not issued by ListEvents.
+func (s *PostgresAuditStore) ListEvents(filter AuditFilter) (*AuditPage, error) {
+	var beforeId *int64
+	if filter.After != nil {
+		if filter.After.Sort != auditListSort || filter.After.Before {
+			return nil, cursor.ErrInvalidCursor
+		}
+		beforeId = &filter.After.Id
+	}
+
+	query := `
+	SELECT id, actor_id, impersonator_id, user_id, action, target_type, target_id, ip, metadata, created_at
+	FROM audit_events
+	WHERE ($1::bigint IS NULL OR actor_id = $1)
+		AND ($2::bigint IS NULL OR user_id = $2)
+		AND ($3 = '' OR action = $3)
+		AND ($4::timestamptz IS NULL OR created_at >= $4)
+		AND ($5::timestamptz IS NULL OR created_at < $5)
+		AND ($6::bigint IS NULL OR id < $6)
+	ORDER BY id DESC
+	LIMIT $7
+	`
+
+	rows, err := s.db.Query(query, filter.ActorId, filter.UserId, filter.Action, filter.From, filter.To, beforeId, filter.Take+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &AuditPage{Events: []AuditEvent{}}
+	for rows.Next() {
+		var event AuditEvent
+		var metadata []byte
+		err = rows.Scan(
+			&event.Id,
+			&event.ActorId,
+			&event.ImpersonatorId,
+			&event.UserId,
+			&event.Action,
+			&event.TargetType,
+			&event.TargetId,
+			&event.IP,
+			&metadata,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		err = json.Unmarshal(metadata, &event.Metadata)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Events = append(page.Events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Events) > filter.Take {
+		page.Events = page.Events[:filter.Take]
+		page.Next = &cursor.Cursor{Sort: auditListSort, Id: page.Events[filter.Take-1].Id}
+	}
+
+	return page, nil
+}
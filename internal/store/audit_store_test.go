@@ -0,0 +1,76 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/cursor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditEvents(t *testing.T) {
+	db := setupTestDb(t)
+	defer db.Close()
+
+	_, err := db.Exec(`TRUNCATE audit_events RESTART IDENTITY;`)
+	require.NoError(t, err)
+
+	store := NewPostgresAuditStore(db)
+	owner, other, admin := int64(1), int64(2), int64(3)
+
+	record := func(actorId, userId int64, action string, createdAt string) int64 {
+		event := &AuditEvent{ActorId: &actorId, UserId: &userId, Action: action, IP: "192.0.2.1"}
+		require.NoError(t, store.RecordEvent(event))
+
+		_, err := db.Exec(`UPDATE audit_events SET created_at = $1 WHERE id = $2`, createdAt, event.Id)
+		require.NoError(t, err)
+		return event.Id
+	}
+
+	first := record(owner, owner, AuditLogin, "2026-10-01T10:00:00Z")
+	second := record(other, other, AuditLogin, "2026-10-02T10:00:00Z")
+	third := record(admin, owner, AuditRoleChanged, "2026-10-03T10:00:00Z")
+	fourth := record(owner, owner, AuditPasswordChanged, "2026-10-03T23:00:00Z")
+
+	at := func(value string) *time.Time {
+		t, _ := time.Parse(time.RFC3339, value)
+		return &t
+	}
+
+	ids := func(filter AuditFilter) []int64 {
+		if filter.Take == 0 {
+			filter.Take = 50
+		}
+		page, err := store.ListEvents(filter)
+		require.NoError(t, err)
+
+		ids := []int64{}
+		for _, event := range page.Events {
+			ids = append(ids, event.Id)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []int64{fourth, third, second, first}, ids(AuditFilter{}))
+	assert.Equal(t, []int64{fourth, first}, ids(AuditFilter{ActorId: &owner}), "actor")
+	assert.Equal(t, []int64{fourth, third, first}, ids(AuditFilter{UserId: &owner}), "user")
+	assert.Equal(t, []int64{second, first}, ids(AuditFilter{Action: AuditLogin}), "action")
+	assert.Equal(t, []int64{third, second}, ids(AuditFilter{From: at("2026-10-02T10:00:00Z"), To: at("2026-10-03T23:00:00Z")}), "from included, to excluded")
+
+	page, err := store.ListEvents(AuditFilter{Take: 3})
+	require.NoError(t, err)
+	assert.Len(t, page.Events, 3)
+	assert.Equal(t, "192.0.2.1", page.Events[0].IP)
+	assert.Equal(t, map[string]any{}, page.Events[0].Metadata)
+	require.NotNil(t, page.Next)
+
+	assert.Equal(t, []int64{first}, ids(AuditFilter{Take: 3, After: page.Next}))
+
+	page, err = store.ListEvents(AuditFilter{Take: 4})
+	require.NoError(t, err)
+	assert.Nil(t, page.Next, "no cursor on the last page")
+
+	_, err = store.ListEvents(AuditFilter{Take: 3, After: &cursor.Cursor{Sort: "name", Id: third}})
+	assert.ErrorIs(t, err, cursor.ErrInvalidCursor)
+}
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io/fs"
@@ -34,6 +35,32 @@ func Open() (*sql.DB, error) {
 	return db, nil
 }
 
+// TryAdvisoryLock takes the Postgres advisory lock key on a connection of its
+// own, without waiting for it. ok is false when another session holds the
+// lock; otherwise unlock releases the lock and the connection.
+func TryAdvisoryLock(ctx context.Context, db *sql.DB, key int64) (unlock func() error, ok bool, err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", key).Scan(&ok)
+	if err != nil || !ok {
+		conn.Close()
+		return nil, false, err
+	}
+
+	unlock = func() error {
+		defer conn.Close()
+
+		// the lock must not outlive a request canceled by ctx
+		_, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", key)
+		return err
+	}
+
+	return unlock, true, nil
+}
+
 func Migrate(db *sql.DB, dir string) error {
 	err := goose.SetDialect("postgres")
 	if err != nil {
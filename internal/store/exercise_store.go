@@ -0,0 +1,277 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/martialanouman/femProject/internal/cursor"
+)
+
+// UnitType tells how an exercise is measured.
+type UnitType string
+
+const (
+	UnitTypeReps     UnitType = "reps"
+	UnitTypeTime     UnitType = "time"
+	UnitTypeDistance UnitType = "distance"
+)
+
+var UnitTypes = []UnitType{UnitTypeReps, UnitTypeTime, UnitTypeDistance}
+
+func (u UnitType) Valid() bool {
+	return slices.Contains(UnitTypes, u)
+}
+
+// Mechanics tells whether an exercise works several joints or a single one.
+type Mechanics string
+
+const (
+	MechanicsCompound  Mechanics = "compound"
+	MechanicsIsolation Mechanics = "isolation"
+)
+
+var MechanicsValues = []Mechanics{MechanicsCompound, MechanicsIsolation}
+
+// Valid reports whether m is known, the empty value standing for exercises
+// such as cardio to which mechanics do not apply.
+func (m Mechanics) Valid() bool {
+	return m == "" || slices.Contains(MechanicsValues, m)
+}
+
+// Exercise is an exercise of the shared catalog or, when UserId is set, a
+// custom exercise only its user sees.
+type Exercise struct {
+	Id               int64     `json:"id"`
+	UserId           *int64    `json:"user_id"`
+	Name             string    `json:"name"`
+	Aliases          []string  `json:"aliases"`
+	PrimaryMuscles   []string  `json:"primary_muscles"`
+	SecondaryMuscles []string  `json:"secondary_muscles"`
+	Equipment        string    `json:"equipment"`
+	Mechanics        Mechanics `json:"mechanics"`
+	UnitType         UnitType  `json:"unit_type"`
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// ExerciseFilter selects exercises. The catalog is always listed, along with
+// the custom exercises of UserId. Zero fields do not filter.
+type ExerciseFilter struct {
+	UserId int64
+	// Query matches the name or one of the aliases, ignoring case.
+	Query     string
+	Muscle    string
+	Equipment string
+	Take      int
+	After     *cursor.Cursor
+}
+
+type ExercisePage struct {
+	Exercises []Exercise
+	Next      *cursor.Cursor
+}
+
+// exerciseListSort is the sort of exercise cursors: by name.
+const exerciseListSort = "name"
+
+var ErrDuplicateExercise = errors.New("duplicate exercise")
+
+type ExerciseStore interface {
+	ListExercises(filter ExerciseFilter) (*ExercisePage, error)
+	GetExerciseForUser(id int64, userId int64) (*Exercise, error)
+	GetExercisesForUser(userId int64) ([]Exercise, error)
+	CreateExercise(exercise *Exercise) error
+}
+
+type PostgresExerciseStore struct {
+	db *sql.DB
+}
+
+func NewPostgresExerciseStore(db *sql.DB) *PostgresExerciseStore {
+	return &PostgresExerciseStore{db}
+}
+
+const exerciseColumns = `id, user_id, name, aliases, primary_muscles, secondary_muscles, equipment, mechanics, unit_type, created_at`
+
+// ListExercises returns a page of the exercises matching filter, by name. It
+// returns cursor.ErrInvalidCursor for cursors not issued by ListExercises.
+func (s *PostgresExerciseStore) ListExercises(filter ExerciseFilter) (*ExercisePage, error) {
+	var afterName *string
+	var afterId *int64
+	if filter.After != nil {
+		if filter.After.Sort != exerciseListSort || filter.After.Before {
+			return nil, cursor.ErrInvalidCursor
+		}
+		afterName, afterId = &filter.After.Key, &filter.After.Id
+	}
+
+	query := `
+	SELECT ` + exerciseColumns + `
+	FROM exercises
+	WHERE (user_id IS NULL OR user_id = $1)
+		AND ($2 = '' OR name ILIKE '%' || $2 || '%' OR EXISTS (
+			SELECT 1 FROM unnest(aliases) alias WHERE alias ILIKE '%' || $2 || '%'
+		))
+		AND ($3 = '' OR lower($3) = ANY(primary_muscles) OR lower($3) = ANY(secondary_muscles))
+		AND ($4 = '' OR equipment = lower($4))
+		AND ($5::text IS NULL OR (name, id) > ($5, $6))
+	ORDER BY name, id
+	LIMIT $7
+	`
+
+	rows, err := s.db.Query(
+		query, filter.UserId, escapeLike(filter.Query), strings.TrimSpace(filter.Muscle), strings.TrimSpace(filter.Equipment),
+		afterName, afterId, filter.Take+1,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &ExercisePage{Exercises: []Exercise{}}
+	types := pgtype.NewMap()
+	for rows.Next() {
+		exercise, err := scanExercise(rows, types)
+		if err != nil {
+			return nil, err
+		}
+		page.Exercises = append(page.Exercises, *exercise)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Exercises) > filter.Take {
+		page.Exercises = page.Exercises[:filter.Take]
+		last := page.Exercises[filter.Take-1]
+		page.Next = &cursor.Cursor{Sort: exerciseListSort, Key: last.Name, Id: last.Id}
+	}
+
+	return page, nil
+}
+
+// GetExerciseForUser returns the exercise of the catalog or custom exercise
+// of userId with the given id, sql.ErrNoRows for the custom exercises of
+// other users.
+func (s *PostgresExerciseStore) GetExerciseForUser(id int64, userId int64) (*Exercise, error) {
+	query := `
+	SELECT ` + exerciseColumns + `
+	FROM exercises
+	WHERE id = $1 AND (user_id IS NULL OR user_id = $2)
+	`
+
+	return scanExercise(s.db.QueryRow(query, id, userId), pgtype.NewMap())
+}
+
+// GetExercisesForUser returns the whole catalog along with the custom
+// exercises of userId, the set free-text names are matched against.
+func (s *PostgresExerciseStore) GetExercisesForUser(userId int64) ([]Exercise, error) {
+	query := `
+	SELECT ` + exerciseColumns + `
+	FROM exercises
+	WHERE user_id IS NULL OR user_id = $1
+	ORDER BY id
+	`
+
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exercises := []Exercise{}
+	types := pgtype.NewMap()
+	for rows.Next() {
+		exercise, err := scanExercise(rows, types)
+		if err != nil {
+			return nil, err
+		}
+		exercises = append(exercises, *exercise)
+	}
+
+	return exercises, rows.Err()
+}
+
+// CreateExercise saves a custom exercise, returning ErrDuplicateExercise when
+// its user already has one with the same name.
+func (s *PostgresExerciseStore) CreateExercise(exercise *Exercise) error {
+	prepareExercise(exercise)
+
+	query := `
+	INSERT INTO exercises (user_id, name, aliases, primary_muscles, secondary_muscles, equipment, mechanics, unit_type)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	RETURNING id, created_at
+	`
+
+	err := s.db.QueryRow(
+		query,
+		exercise.UserId,
+		exercise.Name,
+		exercise.Aliases,
+		exercise.PrimaryMuscles,
+		exercise.SecondaryMuscles,
+		exercise.Equipment,
+		exercise.Mechanics,
+		exercise.UnitType,
+	).Scan(&exercise.Id, &exercise.CreatedAt)
+	if err != nil {
+		return uniqueViolation(err)
+	}
+
+	return nil
+}
+
+// prepareExercise trims the name of exercise, lowers the case of its muscle
+// groups and equipment, which are searched for by equality, and defaults its
+// unit type to reps.
+func prepareExercise(exercise *Exercise) {
+	exercise.Name = strings.TrimSpace(exercise.Name)
+	exercise.Equipment = strings.ToLower(strings.TrimSpace(exercise.Equipment))
+
+	for _, values := range []*[]string{&exercise.Aliases, &exercise.PrimaryMuscles, &exercise.SecondaryMuscles} {
+		if *values == nil {
+			*values = []string{}
+		}
+	}
+	for i, muscle := range exercise.PrimaryMuscles {
+		exercise.PrimaryMuscles[i] = strings.ToLower(strings.TrimSpace(muscle))
+	}
+	for i, muscle := range exercise.SecondaryMuscles {
+		exercise.SecondaryMuscles[i] = strings.ToLower(strings.TrimSpace(muscle))
+	}
+
+	if exercise.UnitType == "" {
+		exercise.UnitType = UnitTypeReps
+	}
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// scanExercise reads an exercise from row, its text arrays being decoded with
+// types.
+func scanExercise(row rowScanner, types *pgtype.Map) (*Exercise, error) {
+	exercise := &Exercise{}
+	err := row.Scan(
+		&exercise.Id,
+		&exercise.UserId,
+		&exercise.Name,
+		types.SQLScanner(&exercise.Aliases),
+		types.SQLScanner(&exercise.PrimaryMuscles),
+		types.SQLScanner(&exercise.SecondaryMuscles),
+		&exercise.Equipment,
+		&exercise.Mechanics,
+		&exercise.UnitType,
+		&exercise.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return exercise, nil
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExercises(t *testing.T) {
+	db := setupTestDb(t)
+	defer db.Close()
+
+	deleteUsers(t, db)
+
+	owner := &User{Username: "owner", Email: "owner@example.com"}
+	require.NoError(t, owner.PasswordHash.Set("password123"))
+	require.NoError(t, NewPostgresUserStore(db).CreateUser(owner))
+
+	other := &User{Username: "other", Email: "other@example.com"}
+	require.NoError(t, other.PasswordHash.Set("password123"))
+	require.NoError(t, NewPostgresUserStore(db).CreateUser(other))
+
+	store := NewPostgresExerciseStore(db)
+
+	custom := &Exercise{UserId: &owner.Id, Name: " Zercher squat ", PrimaryMuscles: []string{"Quadriceps"}}
+	require.NoError(t, store.CreateExercise(custom))
+	assert.Equal(t, "Zercher squat", custom.Name)
+	assert.Equal(t, UnitTypeReps, custom.UnitType)
+
+	err := store.CreateExercise(&Exercise{UserId: &owner.Id, Name: "zercher SQUAT"})
+	assert.ErrorIs(t, err, ErrDuplicateExercise)
+
+	names := func(filter ExerciseFilter) []string {
+		filter.Take = 50
+		page, err := store.ListExercises(filter)
+		require.NoError(t, err)
+
+		names := []string{}
+		for _, exercise := range page.Exercises {
+			names = append(names, exercise.Name)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"Overhead press"}, names(ExerciseFilter{Query: "OHP"}), "alias")
+	assert.Contains(t, names(ExerciseFilter{UserId: owner.Id, Query: "squat"}), "Zercher squat")
+	assert.NotContains(t, names(ExerciseFilter{UserId: other.Id, Query: "squat"}), "Zercher squat")
+	assert.Contains(t, names(ExerciseFilter{UserId: owner.Id, Muscle: "quadriceps", Equipment: "Barbell"}), "Front squat")
+
+	found, err := store.GetExerciseForUser(custom.Id, owner.Id)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"quadriceps"}, found.PrimaryMuscles)
+
+	_, err = store.GetExerciseForUser(custom.Id, other.Id)
+	assert.ErrorIs(t, err, sql.ErrNoRows)
+
+	t.Run("exercises for user", func(t *testing.T) {
+		exercises, err := store.GetExercisesForUser(owner.Id)
+		require.NoError(t, err)
+
+		othersExercises, err := store.GetExercisesForUser(other.Id)
+		require.NoError(t, err)
+		assert.Len(t, exercises, len(othersExercises)+1, "the catalog along with the custom exercise")
+
+		custom := exercises[len(exercises)-1]
+		assert.Equal(t, "Zercher squat", custom.Name)
+		require.NotNil(t, custom.UserId)
+		assert.Equal(t, owner.Id, *custom.UserId)
+		for _, exercise := range othersExercises {
+			assert.Nil(t, exercise.UserId)
+		}
+	})
+
+	t.Run("keyset pagination", func(t *testing.T) {
+		first, err := store.ListExercises(ExerciseFilter{Query: "press", Take: 2})
+		require.NoError(t, err)
+		require.Len(t, first.Exercises, 2)
+		require.NotNil(t, first.Next)
+
+		second, err := store.ListExercises(ExerciseFilter{Query: "press", Take: 2, After: first.Next})
+		require.NoError(t, err)
+		require.NotEmpty(t, second.Exercises)
+		assert.Greater(t, second.Exercises[0].Name, first.Exercises[1].Name)
+	})
+}
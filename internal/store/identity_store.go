@@ -0,0 +1,202 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var ErrIdentityTaken = errors.New("identity already linked to a user")
+
+// Identity is an account of a user at an external OpenID provider.
+type Identity struct {
+	Id        int64     `json:"id"`
+	Provider  string    `json:"provider"`
+	Subject   string    `json:"-"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// LoginState is what is remembered of a login sent to an OpenID provider,
+// until it comes back to the callback. UserId is set when an authenticated
+// user is linking the provider to their account rather than logging in.
+// CookieSession is set when a browser client wants its session in cookies.
+type LoginState struct {
+	State         string
+	Provider      string
+	CodeVerifier  string
+	Nonce         string
+	DeviceName    string
+	CookieSession bool
+	UserId        *int64
+	Expiry        time.Time
+}
+
+type IdentityStore interface {
+	CreateLoginState(state *LoginState) error
+	ConsumeLoginState(state string) (*LoginState, error)
+	GetUserByIdentity(provider, subject string) (*User, error)
+	CreateUserWithIdentity(user *User, identity *Identity) error
+	LinkIdentity(userId int64, identity *Identity) error
+	ListIdentities(userId int64) ([]Identity, error)
+}
+
+type PostgresIdentityStore struct {
+	db *sql.DB
+}
+
+func NewPostgresIdentityStore(db *sql.DB) *PostgresIdentityStore {
+	return &PostgresIdentityStore{db}
+}
+
+func (s *PostgresIdentityStore) CreateLoginState(state *LoginState) error {
+	query := `
+	INSERT INTO oidc_login_states (state, provider, code_verifier, nonce, device_name, cookie_session, user_id, expiry)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`
+
+	_, err := s.db.Exec(
+		query, state.State, state.Provider, state.CodeVerifier, state.Nonce, state.DeviceName, state.CookieSession, state.UserId, state.Expiry,
+	)
+
+	return err
+}
+
+// ConsumeLoginState deletes and returns an unexpired login state, so that a
+// callback cannot be replayed.
+func (s *PostgresIdentityStore) ConsumeLoginState(state string) (*LoginState, error) {
+	loginState := &LoginState{}
+
+	query := `
+	DELETE FROM oidc_login_states
+	WHERE state = $1 AND expiry > $2
+	RETURNING state, provider, code_verifier, nonce, device_name, cookie_session, user_id, expiry
+	`
+
+	err := s.db.QueryRow(query, state, time.Now()).Scan(
+		&loginState.State,
+		&loginState.Provider,
+		&loginState.CodeVerifier,
+		&loginState.Nonce,
+		&loginState.DeviceName,
+		&loginState.CookieSession,
+		&loginState.UserId,
+		&loginState.Expiry,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return loginState, nil
+}
+
+func (s *PostgresIdentityStore) GetUserByIdentity(provider, subject string) (*User, error) {
+	user := &User{
+		PasswordHash: password{},
+	}
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users u
+	INNER JOIN user_identities i ON i.user_id = u.id
+	WHERE i.provider = $1 AND i.subject = $2
+	`
+
+	err := s.db.QueryRow(query, provider, subject).Scan(userFields(user)...)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// CreateUserWithIdentity registers a user on their first login through a
+// provider, along with the identity they logged in with.
+func (s *PostgresIdentityStore) CreateUserWithIdentity(user *User, identity *Identity) error {
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO users (username, email, password_hash, bio, role, activated)
+	VALUES ($1, $2, $3, $4, $5, $6)
+	RETURNING id, created_at, updated_at
+	`
+
+	err = tx.QueryRow(
+		query, user.Username, user.Email, user.PasswordHash.hash, user.Bio, user.Role, user.Activated,
+	).Scan(
+		&user.Id, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err != nil {
+		return uniqueViolation(err)
+	}
+
+	err = insertIdentity(tx, user.Id, identity)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresIdentityStore) LinkIdentity(userId int64, identity *Identity) error {
+	return insertIdentity(s.db, userId, identity)
+}
+
+type rowQuerier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func insertIdentity(q rowQuerier, userId int64, identity *Identity) error {
+	query := `
+	INSERT INTO user_identities (user_id, provider, subject, email)
+	VALUES ($1, $2, $3, $4)
+	RETURNING id, created_at
+	`
+
+	err := q.QueryRow(query, userId, identity.Provider, identity.Subject, identity.Email).Scan(&identity.Id, &identity.CreatedAt)
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolationCode {
+		return ErrIdentityTaken
+	}
+
+	return err
+}
+
+func (s *PostgresIdentityStore) ListIdentities(userId int64) ([]Identity, error) {
+	query := `
+	SELECT id, provider, subject, email, created_at
+	FROM user_identities
+	WHERE user_id = $1
+	ORDER BY created_at
+	`
+
+	rows, err := s.db.Query(query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := []Identity{}
+	for rows.Next() {
+		var identity Identity
+		err = rows.Scan(&identity.Id, &identity.Provider, &identity.Subject, &identity.Email, &identity.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		identities = append(identities, identity)
+	}
+
+	return identities, rows.Err()
+}
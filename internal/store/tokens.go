@@ -1,16 +1,66 @@
 package store
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"errors"
 	"time"
 
 	"github.com/martialanouman/femProject/internal/tokens"
 )
 
+var ErrRefreshTokenReused = errors.New("refresh token reused")
+
+// Session is an active auth token as shown to its owner.
+type Session struct {
+	Id         int64      `json:"id"`
+	DeviceName string     `json:"device_name"`
+	UserAgent  string     `json:"user_agent"`
+	IP         string     `json:"ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Expiry     time.Time  `json:"expiry"`
+	Current    bool       `json:"current"`
+}
+
 type TokenStore interface {
 	Insert(token *tokens.Token) error
 	CreateToken(userId int64, ttl time.Duration, scope string) (*tokens.Token, error)
 	RevokeAllTokenForUser(userId int64, scope string) error
+	RevokeAllTokens(userId int64) error
+	ConsumeRefreshToken(plaintext string) (*tokens.Token, error)
+	RevokeTokenFamily(family string, scopes ...string) error
+	ConsumeToken(scope, plaintext string) (int64, error)
+	RevokeOtherSessions(userId int64, currentHash []byte) error
+	ListSessions(userId int64, currentHash []byte) ([]Session, error)
+	RevokeSession(userId int64, id int64) error
+	RevokeSessionByHash(hash []byte) error
+	TouchToken(hash []byte) error
+	ListAPIKeys(userId int64) ([]APIKey, error)
+	RevokeAPIKey(userId int64, id int64) error
+	ListRevokedTokens(since time.Time) ([]RevokedToken, error)
+	DeleteExpiredTokens(limit int) (int64, error)
+	DeleteExpiredRevokedTokens(limit int) (int64, error)
+}
+
+// RevokedToken records an auth token deleted before its expiry, for JWTs
+// standing for it to be rejected without looking the token up.
+type RevokedToken struct {
+	TokenId   string
+	Expiry    time.Time
+	RevokedAt time.Time
+}
+
+// APIKey is a personal API key as shown to its owner. Token is only known
+// right after creation.
+type APIKey struct {
+	Id          int64              `json:"id"`
+	Name        string             `json:"name"`
+	Permissions tokens.Permissions `json:"permissions"`
+	Token       string             `json:"token,omitempty"`
+	CreatedAt   time.Time          `json:"created_at"`
+	LastUsedAt  *time.Time         `json:"last_used_at"`
+	Expiry      time.Time          `json:"expiry"`
 }
 
 type PostgresTokenStore struct {
@@ -33,11 +83,25 @@ func (s *PostgresTokenStore) CreateToken(userId int64, ttl time.Duration, scope
 
 func (s *PostgresTokenStore) Insert(token *tokens.Token) error {
 	query := `
-		INSERT INTO tokens (hash, user_id, expiry, scope)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO tokens (hash, user_id, expiry, scope, family, device_name, user_agent, ip, name, permissions, impersonator_id)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6, $7, $8, $9, $10, NULLIF($11, 0))
+		RETURNING id
 	`
 
-	_, err := s.db.Exec(query, token.Hash, token.UserId, token.Expiry, token.Scope)
+	err := s.db.QueryRow(
+		query,
+		token.Hash,
+		token.UserId,
+		token.Expiry,
+		token.Scope,
+		token.Family,
+		token.Device.Name,
+		token.Device.UserAgent,
+		token.Device.IP,
+		token.Name,
+		token.Permissions.String(),
+		token.ImpersonatorId,
+	).Scan(&token.Id)
 
 	return err
 
@@ -53,3 +117,356 @@ func (s *PostgresTokenStore) RevokeAllTokenForUser(userId int64, scope string) e
 
 	return err
 }
+
+// RevokeAllTokens deletes every token of a user whatever its scope: sessions,
+// API keys and pending emails alike.
+func (s *PostgresTokenStore) RevokeAllTokens(userId int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1
+	`
+
+	_, err := s.db.Exec(query, userId)
+
+	return err
+}
+
+// ConsumeRefreshToken marks a refresh token as used and returns it. Presenting
+// an already used refresh token means it leaked: the whole family is revoked
+// and ErrRefreshTokenReused returned.
+func (s *PostgresTokenStore) ConsumeRefreshToken(plaintext string) (*tokens.Token, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+	token := &tokens.Token{
+		Hash:  hash[:],
+		Scope: tokens.ScopeRefresh,
+	}
+
+	query := `
+		UPDATE tokens
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE hash = $1 AND scope = $2 AND used_at IS NULL AND expiry > $3
+		RETURNING user_id, expiry, COALESCE(family, ''), device_name, user_agent, ip
+	`
+
+	err := s.db.QueryRow(query, token.Hash, token.Scope, time.Now()).Scan(
+		&token.UserId,
+		&token.Expiry,
+		&token.Family,
+		&token.Device.Name,
+		&token.Device.UserAgent,
+		&token.Device.IP,
+	)
+	if err == nil {
+		return token, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	var family string
+	query = `
+		SELECT COALESCE(family, '')
+		FROM tokens
+		WHERE hash = $1 AND scope = $2 AND used_at IS NOT NULL
+	`
+
+	err = s.db.QueryRow(query, token.Hash, token.Scope).Scan(&family)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.RevokeTokenFamily(family)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, ErrRefreshTokenReused
+}
+
+// RevokeTokenFamily deletes the tokens of a family, limited to the given
+// scopes if any.
+func (s *PostgresTokenStore) RevokeTokenFamily(family string, scopes ...string) error {
+	if family == "" {
+		return nil
+	}
+
+	query := `
+		DELETE FROM tokens
+		WHERE family = $1 AND ($2::text[] IS NULL OR scope = ANY($2::text[]))
+	`
+
+	_, err := s.db.Exec(query, family, scopes)
+
+	return err
+}
+
+// ConsumeToken deletes a valid single-use token and returns the id of the user
+// it was issued to, sql.ErrNoRows when it is unknown or expired.
+func (s *PostgresTokenStore) ConsumeToken(scope, plaintext string) (int64, error) {
+	var userId int64
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id
+	`
+
+	err := s.db.QueryRow(query, hash[:], scope, time.Now()).Scan(&userId)
+	if err != nil {
+		return 0, err
+	}
+
+	return userId, nil
+}
+
+// RevokeOtherSessions deletes the auth and refresh tokens of a user except the
+// ones belonging to the same session as the token hashed as currentHash.
+func (s *PostgresTokenStore) RevokeOtherSessions(userId int64, currentHash []byte) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope = ANY($2::text[]) AND hash <> $3
+		AND (family IS NULL OR family <> COALESCE((SELECT family FROM tokens WHERE hash = $3), ''))
+	`
+
+	_, err := s.db.Exec(query, userId, []string{tokens.ScopeAuth, tokens.ScopeRefresh}, currentHash)
+
+	return err
+}
+
+// ListSessions returns the active auth tokens of a user, flagging the one
+// hashed as currentHash.
+func (s *PostgresTokenStore) ListSessions(userId int64, currentHash []byte) ([]Session, error) {
+	sessions := []Session{}
+
+	query := `
+		SELECT id, device_name, user_agent, ip, created_at, last_used_at, expiry, hash = $3
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > $4
+		ORDER BY COALESCE(last_used_at, created_at) DESC, id DESC
+	`
+
+	rows, err := s.db.Query(query, userId, tokens.ScopeAuth, currentHash, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var session Session
+		err := rows.Scan(
+			&session.Id,
+			&session.DeviceName,
+			&session.UserAgent,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+			&session.Expiry,
+			&session.Current,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// RevokeSession deletes an auth token of a user along with the rest of its
+// family, so the session cannot be refreshed either.
+func (s *PostgresTokenStore) RevokeSession(userId int64, id int64) error {
+	query := `
+		WITH target AS (
+			SELECT id, family
+			FROM tokens
+			WHERE id = $2 AND user_id = $1 AND scope = $3
+		)
+		DELETE FROM tokens t
+		USING target
+		WHERE t.user_id = $1 AND (t.id = target.id OR t.family = target.family)
+	`
+
+	result, err := s.db.Exec(query, userId, id, tokens.ScopeAuth)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// RevokeSessionByHash deletes the token hashed as hash along with the rest of
+// its family.
+func (s *PostgresTokenStore) RevokeSessionByHash(hash []byte) error {
+	query := `
+		WITH target AS (
+			SELECT user_id, family
+			FROM tokens
+			WHERE hash = $1
+		)
+		DELETE FROM tokens t
+		USING target
+		WHERE t.hash = $1 OR (t.user_id = target.user_id AND t.family = target.family)
+	`
+
+	_, err := s.db.Exec(query, hash)
+
+	return err
+}
+
+func (s *PostgresTokenStore) TouchToken(hash []byte) error {
+	query := `
+		UPDATE tokens
+		SET last_used_at = CURRENT_TIMESTAMP
+		WHERE hash = $1
+	`
+
+	_, err := s.db.Exec(query, hash)
+
+	return err
+}
+
+func (s *PostgresTokenStore) ListAPIKeys(userId int64) ([]APIKey, error) {
+	keys := []APIKey{}
+
+	query := `
+		SELECT id, name, permissions, created_at, last_used_at, expiry
+		FROM tokens
+		WHERE user_id = $1 AND scope = $2 AND expiry > $3
+		ORDER BY created_at DESC, id DESC
+	`
+
+	rows, err := s.db.Query(query, userId, tokens.ScopeAPIKey, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key APIKey
+		var permissions string
+		err := rows.Scan(
+			&key.Id,
+			&key.Name,
+			&permissions,
+			&key.CreatedAt,
+			&key.LastUsedAt,
+			&key.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		key.Permissions = tokens.ParsePermissions(permissions)
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+func (s *PostgresTokenStore) RevokeAPIKey(userId int64, id int64) error {
+	query := `
+		DELETE FROM tokens
+		WHERE id = $1 AND user_id = $2 AND scope = $3
+	`
+
+	result, err := s.db.Exec(query, id, userId, tokens.ScopeAPIKey)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListRevokedTokens returns the auth tokens revoked since the given time which
+// have not expired yet. Revocations are recorded by a trigger on tokens.
+func (s *PostgresTokenStore) ListRevokedTokens(since time.Time) ([]RevokedToken, error) {
+	revoked := []RevokedToken{}
+
+	query := `
+		SELECT token_id, expiry, revoked_at
+		FROM revoked_tokens
+		WHERE revoked_at > $1 AND expiry > $2
+		ORDER BY revoked_at
+	`
+
+	rows, err := s.db.Query(query, since, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var token RevokedToken
+		err := rows.Scan(&token.TokenId, &token.Expiry, &token.RevokedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		revoked = append(revoked, token)
+	}
+
+	return revoked, rows.Err()
+}
+
+// DeleteExpiredTokens deletes up to limit expired tokens of any scope and
+// returns how many were deleted, so large backlogs are cleared in batches
+// rather than in one long transaction.
+func (s *PostgresTokenStore) DeleteExpiredTokens(limit int) (int64, error) {
+	query := `
+		DELETE FROM tokens
+		WHERE id IN (
+			SELECT id FROM tokens
+			WHERE expiry < $1
+			LIMIT $2
+		)
+	`
+
+	result, err := s.db.Exec(query, time.Now(), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteExpiredRevokedTokens deletes up to limit revocations of tokens past
+// their expiry, which no JWT can stand for anymore, and returns how many were
+// deleted.
+func (s *PostgresTokenStore) DeleteExpiredRevokedTokens(limit int) (int64, error) {
+	query := `
+		DELETE FROM revoked_tokens
+		WHERE token_id IN (
+			SELECT token_id FROM revoked_tokens
+			WHERE expiry < $1
+			LIMIT $2
+		)
+	`
+
+	result, err := s.db.Exec(query, time.Now(), limit)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
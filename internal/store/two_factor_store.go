@@ -0,0 +1,176 @@
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"strings"
+)
+
+type TwoFactorStore interface {
+	SetTOTPSecret(userId int64, secret string) error
+	EnableTOTP(userId int64, recoveryCodes []string) error
+	DisableTOTP(userId int64) error
+	UseTOTPStep(userId int64, step int64) (bool, error)
+	UseRecoveryCode(userId int64, code string) (bool, error)
+}
+
+type PostgresTwoFactorStore struct {
+	db *sql.DB
+}
+
+func NewPostgresTwoFactorStore(db *sql.DB) *PostgresTwoFactorStore {
+	return &PostgresTwoFactorStore{db}
+}
+
+// SetTOTPSecret stores the secret of an enrollment in progress, which only
+// takes effect once confirmed by EnableTOTP.
+func (s *PostgresTwoFactorStore) SetTOTPSecret(userId int64, secret string) error {
+	query := `
+		UPDATE users
+		SET totp_secret = $1, totp_enabled = false, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`
+
+	result, err := s.db.Exec(query, secret, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// EnableTOTP turns two-factor authentication on and replaces the recovery
+// codes of the user, which are only stored hashed.
+func (s *PostgresTwoFactorStore) EnableTOTP(userId int64, recoveryCodes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET totp_enabled = true, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND totp_secret IS NOT NULL
+	`
+
+	result, err := tx.Exec(query, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userId)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.Exec(
+			"INSERT INTO recovery_codes (user_id, hash) VALUES ($1, $2)",
+			userId, hashRecoveryCode(code),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresTwoFactorStore) DisableTOTP(userId int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET totp_secret = NULL, totp_enabled = false, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $1
+	`
+
+	_, err = tx.Exec(query, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM recovery_codes WHERE user_id = $1", userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records that the code of a time step has been used. It reports
+// false if a code of this step or a later one was already used, meaning the
+// code is being replayed.
+func (s *PostgresTwoFactorStore) UseTOTPStep(userId int64, step int64) (bool, error) {
+	query := `
+		UPDATE users
+		SET totp_last_step = $1
+		WHERE id = $2 AND totp_last_step < $1
+	`
+
+	result, err := s.db.Exec(query, step, userId)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// UseRecoveryCode burns a recovery code, reporting false if it is unknown or
+// was already used.
+func (s *PostgresTwoFactorStore) UseRecoveryCode(userId int64, code string) (bool, error) {
+	query := `
+		UPDATE recovery_codes
+		SET used_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND hash = $2 AND used_at IS NULL
+	`
+
+	result, err := s.db.Exec(query, userId, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// hashRecoveryCode hashes a code ignoring case, spaces and dashes, so users
+// can type it back however they like. Codes are random enough for a fast
+// hash to be fine.
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
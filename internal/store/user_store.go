@@ -4,8 +4,13 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"slices"
+	"sync"
 	"time"
 
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/martialanouman/femProject/internal/cursor"
+	"github.com/martialanouman/femProject/internal/tokens"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -41,22 +46,114 @@ func (p *password) Matches(plainText string) (bool, error) {
 	return true, nil
 }
 
+var (
+	ErrDuplicateUsername = errors.New("duplicate username")
+	ErrDuplicateEmail    = errors.New("duplicate email")
+)
+
+var (
+	dummyPasswordOnce sync.Once
+	dummyPassword     password
+)
+
+// SimulatePasswordCheck spends the time a password comparison takes, for
+// logins on unknown accounts to be indistinguishable from wrong passwords.
+func SimulatePasswordCheck(plainText string) {
+	dummyPasswordOnce.Do(func() {
+		dummyPassword.Set("not the password of anyone")
+	})
+
+	dummyPassword.Matches(plainText)
+}
+
+// Role grants a user rights beyond their own resources, see the policy
+// package.
+type Role string
+
+const (
+	RoleUser  Role = "user"
+	RoleCoach Role = "coach"
+	RoleAdmin Role = "admin"
+)
+
+var Roles = []Role{RoleUser, RoleCoach, RoleAdmin}
+
+func (r Role) Valid() bool {
+	return slices.Contains(Roles, r)
+}
+
 type User struct {
-	Id           int64     `json:"id"`
-	Username     string    `json:"name"`
-	Email        string    `json:"email"`
-	PasswordHash password  `json:"-"`
-	Bio          string    `json:"bio"`
-	CreatedAt    time.Time `json:"created_at"`
-	UpdatedAt    time.Time `json:"updated_at"`
+	Id           int64    `json:"id"`
+	Username     string   `json:"name"`
+	Email        string   `json:"email"`
+	PasswordHash password `json:"-"`
+	Bio          string   `json:"bio"`
+	Role         Role     `json:"role"`
+	Activated    bool     `json:"activated"`
+	TOTPEnabled  bool     `json:"two_factor_enabled"`
+	TOTPSecret   string   `json:"-"`
+	TOTPLastStep int64    `json:"-"`
+	// SuspendedAt is set while an admin keeps the user from logging in.
+	SuspendedAt *time.Time `json:"suspended_at,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+}
+
+// IsSuspended reports whether the user is kept from logging in.
+func (u *User) IsSuspended() bool {
+	return u.SuspendedAt != nil
 }
 
+// UserFilter narrows down a list of users. Users are listed by id, After
+// being the position of the previous page.
+type UserFilter struct {
+	// Query matches a part of the username or the email.
+	Query     string
+	Role      Role
+	Suspended *bool
+	Take      int
+	After     *cursor.Cursor
+}
+
+// UserPage is a page of users and the cursor of the following one, nil on the
+// last page.
+type UserPage struct {
+	Users []User
+	Next  *cursor.Cursor
+}
+
+// userListSort is the sort expression cursors of user lists are issued for.
+const userListSort = "id"
+
 var AnonymousUser = &User{}
 
 func (u *User) IsAnonymous() bool {
 	return u == AnonymousUser
 }
 
+// userColumns are the columns of the users table, aliased u, read into a User
+// by scanning them into userFields.
+const userColumns = `u.id, u.username, u.email, u.password_hash, u.bio, u.role, u.activated,
+	u.totp_enabled, COALESCE(u.totp_secret, ''), u.totp_last_step, u.suspended_at, u.created_at, u.updated_at`
+
+func userFields(user *User) []any {
+	return []any{
+		&user.Id,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash.hash,
+		&user.Bio,
+		&user.Role,
+		&user.Activated,
+		&user.TOTPEnabled,
+		&user.TOTPSecret,
+		&user.TOTPLastStep,
+		&user.SuspendedAt,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+	}
+}
+
 type PostgresUserStore struct {
 	db *sql.DB
 }
@@ -67,45 +164,67 @@ func NewPostgresUserStore(db *sql.DB) *PostgresUserStore {
 
 type UserStore interface {
 	CreateUser(*User) error
+	GetUserById(id int64) (*User, error)
 	GetUserByUsername(username string) (*User, error)
+	GetUserByEmail(email string) (*User, error)
 	UpdateUser(*User) error
+	UpdatePassword(*User) error
+	SetRole(userId int64, role Role) error
+	SetSuspended(userId int64, suspended bool) error
+	ListUsers(filter UserFilter) (*UserPage, error)
+	DeleteUser(id int64) error
 	GetUserByToken(scope, tokenPlaintext string) (*User, error)
+	GetUserAndToken(tokenPlaintext string, scopes ...string) (*User, *tokens.Token, error)
 }
 
 func (p *PostgresUserStore) CreateUser(user *User) error {
+	if user.Role == "" {
+		user.Role = RoleUser
+	}
+
 	query := `
-	INSERT INTO users (username, email, password_hash, bio)
-	VALUES ($1, $2, $3, $4)
+	INSERT INTO users (username, email, password_hash, bio, role, activated)
+	VALUES ($1, $2, $3, $4, $5, $6)
 	RETURNING id, created_at, updated_at
 	`
 
 	err := p.db.QueryRow(
-		query, user.Username, user.Email, user.PasswordHash.hash, user.Bio,
+		query, user.Username, user.Email, user.PasswordHash.hash, user.Bio, user.Role, user.Activated,
 	).Scan(
 		&user.Id, &user.CreatedAt, &user.UpdatedAt,
 	)
 	if err != nil {
-		return err
+		return uniqueViolation(err)
 	}
 
 	return nil
 }
 
+func (p *PostgresUserStore) GetUserById(id int64) (*User, error) {
+	return p.getUserBy("id", id)
+}
+
 func (p *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
+	return p.getUserBy("username", username)
+}
+
+func (p *PostgresUserStore) GetUserByEmail(email string) (*User, error) {
+	return p.getUserBy("email", email)
+}
+
+// getUserBy fetches a user by one of its unique columns.
+func (p *PostgresUserStore) getUserBy(column string, value any) (*User, error) {
 	user := &User{
 		PasswordHash: password{},
 	}
 
 	query := `
-	SELECT id, username, email, password_hash, bio, created_at, updated_at
-	FROM users
-	WHERE username = $1
+	SELECT ` + userColumns + `
+	FROM users u
+	WHERE u.` + column + ` = $1
 	`
 
-	err := p.db.QueryRow(query, username).Scan(
-		&user.Id, &user.Username, &user.Email, &user.PasswordHash.hash,
-		&user.Bio, &user.CreatedAt, &user.UpdatedAt,
-	)
+	err := p.db.QueryRow(query, value).Scan(userFields(user)...)
 
 	if err == sql.ErrNoRows {
 		return nil, sql.ErrNoRows
@@ -121,12 +240,153 @@ func (p *PostgresUserStore) GetUserByUsername(username string) (*User, error) {
 func (p *PostgresUserStore) UpdateUser(user *User) error {
 	query := `
 		UPDATE users
-		SET username=$1, email=$2, bio=$3, updated_at=CURRENT_TIMESTAMP
-		WHERE id = $4
+		SET username=$1, email=$2, bio=$3, activated=$4, updated_at=CURRENT_TIMESTAMP
+		WHERE id = $5
+		RETURNING updated_at
+	`
+
+	err := p.db.QueryRow(query, user.Username, user.Email, user.Bio, user.Activated, user.Id).Scan(&user.UpdatedAt)
+	if err != nil {
+		return uniqueViolation(err)
+	}
+
+	return nil
+}
+
+func (p *PostgresUserStore) UpdatePassword(user *User) error {
+	query := `
+		UPDATE users
+		SET password_hash = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
 		RETURNING updated_at
 	`
 
-	result, err := p.db.Exec(query, user.Username, user.Email, user.Bio, user.Id)
+	err := p.db.QueryRow(query, user.PasswordHash.hash, user.Id).Scan(&user.UpdatedAt)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// SetRole changes the role of a user. Roles are deliberately left out of
+// UpdateUser, which profile edits go through.
+func (p *PostgresUserStore) SetRole(userId int64, role Role) error {
+	query := `
+		UPDATE users
+		SET role = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`
+
+	result, err := p.db.Exec(query, role, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// SetSuspended suspends a user, or lifts their suspension. Suspending an
+// already suspended user keeps the original date.
+func (p *PostgresUserStore) SetSuspended(userId int64, suspended bool) error {
+	query := `
+		UPDATE users
+		SET suspended_at = CASE WHEN $1 THEN COALESCE(suspended_at, CURRENT_TIMESTAMP) END,
+			updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2
+	`
+
+	result, err := p.db.Exec(query, suspended, userId)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// ListUsers returns a page of the users matching filter, by ascending id.
+// It returns cursor.ErrInvalidCursor for cursors not issued by ListUsers.
+func (p *PostgresUserStore) ListUsers(filter UserFilter) (*UserPage, error) {
+	var afterId int64
+	if filter.After != nil {
+		if filter.After.Sort != userListSort || filter.After.Before {
+			return nil, cursor.ErrInvalidCursor
+		}
+		afterId = filter.After.Id
+	}
+
+	var pattern string
+	if filter.Query != "" {
+		pattern = "%" + escapeLike(filter.Query) + "%"
+	}
+
+	query := `
+	SELECT ` + userColumns + `
+	FROM users u
+	WHERE ($1 = '' OR u.username ILIKE $1 OR u.email ILIKE $1)
+		AND ($2 = '' OR u.role = $2)
+		AND ($3::boolean IS NULL OR (u.suspended_at IS NOT NULL) = $3)
+		AND u.id > $4
+	ORDER BY u.id
+	LIMIT $5
+	`
+
+	rows, err := p.db.Query(query, pattern, string(filter.Role), filter.Suspended, afterId, filter.Take+1)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	page := &UserPage{Users: []User{}}
+	for rows.Next() {
+		var user User
+		err = rows.Scan(userFields(&user)...)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Users = append(page.Users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Users) > filter.Take {
+		page.Users = page.Users[:filter.Take]
+		page.Next = &cursor.Cursor{Sort: userListSort, Id: page.Users[filter.Take-1].Id}
+	}
+
+	return page, nil
+}
+
+// DeleteUser removes a user, their workouts and tokens going along through
+// ON DELETE CASCADE.
+func (p *PostgresUserStore) DeleteUser(id int64) error {
+	query := `
+	DELETE FROM users
+	WHERE id = $1
+	`
+
+	result, err := p.db.Exec(query, id)
 	if err != nil {
 		return err
 	}
@@ -150,24 +410,82 @@ func (p *PostgresUserStore) GetUserByToken(scope, tokenPlaintext string) (*User,
 	}
 
 	query := `
-	SELECT u.id, u.username, u.email, u.password_hash, u.bio, u.created_at, u.updated_at
+	SELECT ` + userColumns + `
 	FROM users u
 	INNER JOIN tokens t ON t.user_id = u.id
 	WHERE t.hash = $1 AND scope = $2 AND t.expiry > $3
 	`
 
-	err := p.db.QueryRow(query, tokenHash[:], scope, time.Now()).Scan(
-		&user.Id,
-		&user.Username,
-		&user.Email,
-		&user.PasswordHash.hash,
-		&user.Bio,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-	)
+	err := p.db.QueryRow(query, tokenHash[:], scope, time.Now()).Scan(userFields(user)...)
 	if err != nil {
 		return nil, err
 	}
 
 	return user, nil
 }
+
+// GetUserAndToken looks up a valid token having one of the given scopes, and
+// returns it along with its user.
+func (p *PostgresUserStore) GetUserAndToken(tokenPlaintext string, scopes ...string) (*User, *tokens.Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+	user := &User{
+		PasswordHash: password{},
+	}
+	token := &tokens.Token{
+		Plaintext: tokenPlaintext,
+		Hash:      tokenHash[:],
+	}
+
+	query := `
+	SELECT ` + userColumns + `,
+		t.id, t.scope, t.expiry, COALESCE(t.family, ''), t.device_name, t.name, t.permissions,
+		COALESCE(t.impersonator_id, 0)
+	FROM users u
+	INNER JOIN tokens t ON t.user_id = u.id
+	WHERE t.hash = $1 AND t.scope = ANY($2::text[]) AND t.expiry > $3
+	`
+
+	var permissions string
+	err := p.db.QueryRow(query, tokenHash[:], scopes, time.Now()).Scan(append(
+		userFields(user),
+		&token.Id,
+		&token.Scope,
+		&token.Expiry,
+		&token.Family,
+		&token.Device.Name,
+		&token.Name,
+		&permissions,
+		&token.ImpersonatorId,
+	)...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	token.UserId = user.Id
+	token.Permissions = tokens.ParsePermissions(permissions)
+
+	return user, token, nil
+}
+
+const uniqueViolationCode = "23505"
+
+// uniqueViolation translates violations of the unique constraints on users
+// into ErrDuplicateUsername and ErrDuplicateEmail, and on custom exercises
+// into ErrDuplicateExercise.
+func uniqueViolation(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || pgErr.Code != uniqueViolationCode {
+		return err
+	}
+
+	switch pgErr.ConstraintName {
+	case "users_username_key":
+		return ErrDuplicateUsername
+	case "users_email_key":
+		return ErrDuplicateEmail
+	case "exercises_user_name_idx":
+		return ErrDuplicateExercise
+	default:
+		return err
+	}
+}
@@ -1,39 +1,229 @@
 package store
 
 import (
+	"bytes"
+	"crypto/rand"
 	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/martialanouman/femProject/internal/cursor"
 )
 
+// Visibility tells who besides its owner may see a workout.
+type Visibility string
+
+const (
+	VisibilityPrivate Visibility = "private"
+	// VisibilityFollowers is kept private until users can follow each other.
+	VisibilityFollowers Visibility = "followers"
+	VisibilityPublic    Visibility = "public"
+	// VisibilityUnlisted workouts are seen by whoever has their share link.
+	VisibilityUnlisted Visibility = "unlisted"
+)
+
+var Visibilities = []Visibility{VisibilityPrivate, VisibilityFollowers, VisibilityPublic, VisibilityUnlisted}
+
+func (v Visibility) Valid() bool {
+	return slices.Contains(Visibilities, v)
+}
+
 type Workout struct {
-	Id              int64          `json:"id"`
-	Title           string         `json:"title"`
-	UserId          int64          `json:"user_id"`
-	Description     string         `json:"description"`
-	DurationMinutes int            `json:"duration_minutes"`
-	CaloriesBurned  int            `json:"calories_burned"`
-	Entries         []WorkoutEntry `json:"entries"`
+	Id              int64      `json:"id"`
+	Title           string     `json:"title"`
+	UserId          int64      `json:"user_id"`
+	Description     string     `json:"description"`
+	DurationMinutes int        `json:"duration_minutes"`
+	CaloriesBurned  int        `json:"calories_burned"`
+	Visibility      Visibility `json:"visibility"`
+	// ShareToken is the key of the share link of unlisted workouts.
+	ShareToken *string `json:"share_token,omitempty"`
+	// PerformedAt is when the workout took place, expressed in Timezone, the
+	// IANA name of the zone it took place in.
+	PerformedAt time.Time      `json:"performed_at"`
+	Timezone    string         `json:"timezone"`
+	CreatedAt   time.Time      `json:"created_at"`
+	UpdatedAt   time.Time      `json:"updated_at"`
+	Entries     []WorkoutEntry `json:"entries"`
 }
 
+// ValidTimezone reports whether name is the IANA name of a time zone.
+func ValidTimezone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// localize expresses the time workout was performed in its time zone.
+func (w *Workout) localize() {
+	if location, err := time.LoadLocation(w.Timezone); err == nil {
+		w.PerformedAt = w.PerformedAt.In(location)
+	}
+}
+
+// WorkoutEntry is an exercise of a workout. Its sets are logged one by one in
+// SetDetails; Sets, Reps, DurationSeconds and Weight are the aggregate of
+// older clients, from which identical working sets are made when SetDetails
+// is empty. ExerciseId links the entry to the catalog or to a custom
+// exercise, whose name is kept in ExerciseName.
 type WorkoutEntry struct {
+	Id              int64        `json:"id"`
+	ExerciseId      *int64       `json:"exercise_id"`
+	ExerciseName    string       `json:"exercise_name"`
+	Sets            int          `json:"set_count"`
+	Reps            *int         `json:"reps"`
+	DurationSeconds *int         `json:"duration_seconds"`
+	Weight          *float64     `json:"weight"`
+	Notes           string       `json:"notes"`
+	OrderIndex      int          `json:"order_index"`
+	Unit            string       `json:"unit"`
+	SetDetails      []WorkoutSet `json:"sets"`
+}
+
+// UnmarshalJSON reads sets either as the list of sets, or as the number of
+// sets older clients send.
+func (e *WorkoutEntry) UnmarshalJSON(data []byte) error {
+	type entry WorkoutEntry
+	var raw struct {
+		entry
+		Sets json.RawMessage `json:"sets"`
+	}
+
+	err := json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	*e = WorkoutEntry(raw.entry)
+
+	sets := bytes.TrimSpace(raw.Sets)
+	switch {
+	case len(sets) == 0 || bytes.Equal(sets, []byte("null")):
+	case sets[0] == '[':
+		err = json.Unmarshal(sets, &e.SetDetails)
+		if err != nil {
+			return err
+		}
+		e.Sets = len(e.SetDetails)
+	default:
+		err = json.Unmarshal(sets, &e.Sets)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetType tells the purpose of a set.
+type SetType string
+
+const (
+	SetTypeWarmup  SetType = "warmup"
+	SetTypeWorking SetType = "working"
+	SetTypeDrop    SetType = "drop"
+	SetTypeFailure SetType = "failure"
+)
+
+var SetTypes = []SetType{SetTypeWarmup, SetTypeWorking, SetTypeDrop, SetTypeFailure}
+
+func (t SetType) Valid() bool {
+	return slices.Contains(SetTypes, t)
+}
+
+// WorkoutSet is a single set of an entry, counting either Reps or
+// DurationSeconds. RPE is the rate of perceived exertion from 1 to 10 and RIR
+// the repetitions left in reserve.
+type WorkoutSet struct {
 	Id              int64    `json:"id"`
-	ExerciseName    string   `json:"exercise_name"`
-	Sets            int      `json:"sets"`
+	SetNumber       int      `json:"set_number"`
+	Type            SetType  `json:"set_type"`
 	Reps            *int     `json:"reps"`
 	DurationSeconds *int     `json:"duration_seconds"`
 	Weight          *float64 `json:"weight"`
-	Notes           string   `json:"notes"`
-	OrderIndex      int      `json:"order_index"`
-	Unit            string   `json:"unit"`
+	RPE             *float64 `json:"rpe"`
+	RIR             *int     `json:"rir"`
+	RestSeconds     *int     `json:"rest_seconds"`
+	Completed       *bool    `json:"completed"`
+}
+
+// WorkoutFilter narrows down and orders the result of GetWorkouts. Zero values
+// mean "no constraint", so an empty filter lists every workout.
+type WorkoutFilter struct {
+	UserId       int64
+	From         *time.Time
+	To           *time.Time
+	Title        string
+	MinDuration  *int
+	MaxDuration  *int
+	MinCalories  *int
+	MaxCalories  *int
+	ExerciseName string
+	// Visibilities restricts the workouts to the given visibilities, when not
+	// empty.
+	Visibilities []Visibility
+	// Sort is a field name from WorkoutSortFields, prefixed with "-" for a
+	// descending order. Defaults to DefaultWorkoutSort.
+	Sort string
+	Take int
+	// Skip is only used for legacy offset pagination, when Cursor is nil.
+	Skip   int
+	Cursor *cursor.Cursor
+}
+
+// WorkoutPage is a page of workouts along with the cursors to the
+// surrounding pages, nil when there is no such page.
+type WorkoutPage struct {
+	Workouts []Workout
+	Next     *cursor.Cursor
+	Prev     *cursor.Cursor
+}
+
+const DefaultWorkoutSort = "-performed_at"
+
+// WorkoutSortFields maps the sortable fields exposed to clients to their
+// column and its SQL type, used to cast cursor keys back.
+var WorkoutSortFields = map[string]struct{ Column, Type string }{
+	"performed_at":     {"performed_at", "timestamptz"},
+	"created_at":       {"created_at", "timestamptz"},
+	"title":            {"title", "varchar"},
+	"duration_minutes": {"duration_minutes", "integer"},
+	"calories_burned":  {"calories_burned", "integer"},
+}
+
+var ErrInvalidSort = errors.New("invalid sort field")
+
+// ParseSort splits a sort expression such as "-title" into its field and
+// direction.
+func ParseSort(sort string) (field string, desc bool, err error) {
+	if sort == "" {
+		sort = DefaultWorkoutSort
+	}
+
+	field = strings.TrimPrefix(sort, "-")
+	if _, ok := WorkoutSortFields[field]; !ok {
+		return "", false, ErrInvalidSort
+	}
+
+	return field, strings.HasPrefix(sort, "-"), nil
 }
 
 type WorkoutStore interface {
 	CreateWorkout(*Workout) (*Workout, error)
 	GetWorkoutById(int64) (*Workout, error)
+	GetWorkoutByShareToken(token string) (*Workout, error)
 	UpdateWorkout(*Workout) error
 	DeleteWorkout(int64) error
-	GetWorkouts(take int, skip int) ([]Workout, error)
-	GetWorkoutOwner(id int64) (int64, error)
+	GetWorkouts(filter WorkoutFilter) (*WorkoutPage, error)
+	GetUnlinkedExerciseNames() ([]UnlinkedExerciseName, error)
+	LinkExercises(links []ExerciseLink) (int64, error)
 }
 
 type PostgresWorkoutStore struct {
@@ -52,10 +242,20 @@ func (p *PostgresWorkoutStore) CreateWorkout(workout *Workout) (*Workout, error)
 
 	defer tx.Rollback() // Rollback if something goes wrong
 
+	err = prepareWorkout(workout)
+	if err != nil {
+		return nil, err
+	}
+
+	var performedAt *time.Time
+	if !workout.PerformedAt.IsZero() {
+		performedAt = &workout.PerformedAt
+	}
+
 	query :=
-		`INSERT INTO workouts (user_id, title, description, duration_minutes, calories_burned)
-	VALUES ($1, $2, $3, $4, $5)
-	RETURNING id
+		`INSERT INTO workouts (user_id, title, description, duration_minutes, calories_burned, visibility, share_token, performed_at, timezone)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, COALESCE($8, CURRENT_TIMESTAMP), $9)
+	RETURNING id, performed_at, created_at, updated_at
 	`
 
 	err = tx.QueryRow(
@@ -65,10 +265,15 @@ func (p *PostgresWorkoutStore) CreateWorkout(workout *Workout) (*Workout, error)
 		workout.Description,
 		workout.DurationMinutes,
 		workout.CaloriesBurned,
-	).Scan(&workout.Id)
+		workout.Visibility,
+		workout.ShareToken,
+		performedAt,
+		workout.Timezone,
+	).Scan(&workout.Id, &workout.PerformedAt, &workout.CreatedAt, &workout.UpdatedAt)
 	if err != nil {
 		return nil, err
 	}
+	workout.localize()
 
 	for index := range workout.Entries {
 		err := createWorkoutEntry(tx, workout.Id, &workout.Entries[index])
@@ -82,29 +287,76 @@ func (p *PostgresWorkoutStore) CreateWorkout(workout *Workout) (*Workout, error)
 		return nil, err
 	}
 
-	fmt.Printf("%+v\n", workout)
-
 	return workout, nil
 }
 
-func (p *PostgresWorkoutStore) GetWorkouts(take int, skip int) ([]Workout, error) {
-	workouts := []Workout{}
+func (p *PostgresWorkoutStore) GetWorkouts(filter WorkoutFilter) (*WorkoutPage, error) {
+	page := &WorkoutPage{Workouts: []Workout{}}
 
-	query := `
-		SELECT id, user_id, title, description, duration_minutes, calories_burned
+	if filter.Sort == "" {
+		filter.Sort = DefaultWorkoutSort
+	}
+
+	field, desc, err := ParseSort(filter.Sort)
+	if err != nil {
+		return nil, err
+	}
+	column := WorkoutSortFields[field]
+
+	if filter.Cursor != nil && filter.Cursor.Sort != filter.Sort {
+		return nil, cursor.ErrInvalidCursor
+	}
+
+	conditions, args := workoutFilterConditions(filter)
+
+	// Walking backwards from a cursor reverses the order, the rows are put
+	// back in place once fetched.
+	backward := filter.Cursor != nil && filter.Cursor.Before
+	if backward {
+		desc = !desc
+	}
+
+	direction, comparison := "ASC", ">"
+	if desc {
+		direction, comparison = "DESC", "<"
+	}
+
+	offset := filter.Skip
+	if filter.Cursor != nil {
+		offset = 0
+		args = append(args, filter.Cursor.Key, filter.Cursor.Id)
+		conditions = append(conditions, fmt.Sprintf(
+			"(%s, id) %s ($%d::%s, $%d)",
+			column.Column, comparison, len(args)-1, column.Type, len(args),
+		))
+	}
+
+	query := fmt.Sprintf(`
+		SELECT id, user_id, title, description, duration_minutes, calories_burned, visibility, share_token,
+			performed_at, timezone, created_at, updated_at, %s::text
 		FROM workouts
-		ORDER BY created_at DESC
-		LIMIT $1 OFFSET $2
-	`
+	`, column.Column)
+	if len(conditions) > 0 {
+		query += "WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	// One extra row tells whether there is a page after this one.
+	args = append(args, filter.Take+1, offset)
+	query += fmt.Sprintf(`
+		ORDER BY %s %s, id %s
+		LIMIT $%d OFFSET $%d
+	`, column.Column, direction, direction, len(args)-1, len(args))
 
-	rows, err := p.db.Query(query, take, skip)
+	rows, err := p.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	keys := []string{}
 	for rows.Next() {
 		var workout Workout
+		var key string
 		err := rows.Scan(
 			&workout.Id,
 			&workout.UserId,
@@ -112,41 +364,164 @@ func (p *PostgresWorkoutStore) GetWorkouts(take int, skip int) ([]Workout, error
 			&workout.Description,
 			&workout.DurationMinutes,
 			&workout.CaloriesBurned,
+			&workout.Visibility,
+			&workout.ShareToken,
+			&workout.PerformedAt,
+			&workout.Timezone,
+			&workout.CreatedAt,
+			&workout.UpdatedAt,
+			&key,
 		)
 		if err != nil {
 			return nil, err
 		}
+		workout.localize()
 
 		workout.Entries = []WorkoutEntry{}
-		workouts = append(workouts, workout)
+		page.Workouts = append(page.Workouts, workout)
+		keys = append(keys, key)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	hasMore := len(page.Workouts) > filter.Take
+	if hasMore {
+		page.Workouts = page.Workouts[:filter.Take]
+		keys = keys[:filter.Take]
+	}
+
+	if backward {
+		slices.Reverse(page.Workouts)
+		slices.Reverse(keys)
+	}
+
+	if len(page.Workouts) == 0 {
+		return page, nil
+	}
+
+	first, last := 0, len(page.Workouts)-1
+	hasNext, hasPrev := hasMore, filter.Cursor != nil || filter.Skip > 0
+	if backward {
+		hasNext, hasPrev = true, hasMore
+	}
+
+	if hasNext {
+		page.Next = &cursor.Cursor{Sort: filter.Sort, Key: keys[last], Id: page.Workouts[last].Id}
+	}
+
+	if hasPrev {
+		page.Prev = &cursor.Cursor{Sort: filter.Sort, Key: keys[first], Id: page.Workouts[first].Id, Before: true}
+	}
+
+	return page, nil
+}
+
+func workoutFilterConditions(filter WorkoutFilter) ([]string, []any) {
+	conditions := []string{}
+	args := []any{}
+
+	add := func(condition string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.UserId != 0 {
+		add("user_id = $%d", filter.UserId)
+	}
+
+	if len(filter.Visibilities) > 0 {
+		visibilities := make([]string, len(filter.Visibilities))
+		for i, visibility := range filter.Visibilities {
+			visibilities[i] = string(visibility)
+		}
+		add("visibility = ANY($%d)", visibilities)
+	}
+
+	if filter.From != nil {
+		add("performed_at >= $%d", *filter.From)
+	}
+
+	if filter.To != nil {
+		add("performed_at < $%d", *filter.To)
+	}
+
+	if filter.Title != "" {
+		add("title ILIKE '%%' || $%d || '%%'", escapeLike(filter.Title))
+	}
+
+	if filter.MinDuration != nil {
+		add("duration_minutes >= $%d", *filter.MinDuration)
+	}
+
+	if filter.MaxDuration != nil {
+		add("duration_minutes <= $%d", *filter.MaxDuration)
+	}
+
+	if filter.MinCalories != nil {
+		add("calories_burned >= $%d", *filter.MinCalories)
+	}
+
+	if filter.MaxCalories != nil {
+		add("calories_burned <= $%d", *filter.MaxCalories)
+	}
+
+	if filter.ExerciseName != "" {
+		add(`EXISTS (
+			SELECT 1 FROM workout_entries we
+			WHERE we.workout_id = workouts.id AND we.exercise_name ILIKE '%%' || $%d || '%%'
+		)`, escapeLike(filter.ExerciseName))
 	}
 
-	return workouts, nil
+	return conditions, args
+}
+
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(value)
 }
 
 func (p *PostgresWorkoutStore) GetWorkoutById(id int64) (*Workout, error) {
+	return p.getWorkoutBy("id = $1", id)
+}
+
+// GetWorkoutByShareToken returns the unlisted workout shared with token.
+func (p *PostgresWorkoutStore) GetWorkoutByShareToken(token string) (*Workout, error) {
+	return p.getWorkoutBy("share_token = $1 AND visibility = 'unlisted'", token)
+}
+
+// getWorkoutBy fetches a workout and its entries given a condition on one
+// argument.
+func (p *PostgresWorkoutStore) getWorkoutBy(condition string, value any) (*Workout, error) {
 	workout := &Workout{}
 
 	query := `
-		SELECT id, user_id, title, description, duration_minutes, calories_burned
+		SELECT id, user_id, title, description, duration_minutes, calories_burned, visibility, share_token,
+			performed_at, timezone, created_at, updated_at
 		FROM workouts
-		WHERE id = $1
-	`
+		WHERE ` + condition
 
-	err := p.db.QueryRow(query, id).Scan(
+	err := p.db.QueryRow(query, value).Scan(
 		&workout.Id,
 		&workout.UserId,
 		&workout.Title,
 		&workout.Description,
 		&workout.DurationMinutes,
 		&workout.CaloriesBurned,
+		&workout.Visibility,
+		&workout.ShareToken,
+		&workout.PerformedAt,
+		&workout.Timezone,
+		&workout.CreatedAt,
+		&workout.UpdatedAt,
 	)
 	if err != nil {
 		return nil, err
 	}
+	workout.localize()
 
 	entryQuery := `
-		SELECT id, exercise_name, sets, reps, duration_seconds, weight, notes, unit, order_index
+		SELECT id, exercise_id, exercise_name, sets, reps, duration_seconds, weight, notes, unit, order_index
 		FROM workout_entries
 		WHERE workout_id = $1
 		ORDER BY order_index
@@ -161,6 +536,7 @@ func (p *PostgresWorkoutStore) GetWorkoutById(id int64) (*Workout, error) {
 		var entry WorkoutEntry
 		err := rows.Scan(
 			&entry.Id,
+			&entry.ExerciseId,
 			&entry.ExerciseName,
 			&entry.Sets, &entry.Reps,
 			&entry.DurationSeconds,
@@ -175,9 +551,68 @@ func (p *PostgresWorkoutStore) GetWorkoutById(id int64) (*Workout, error) {
 		workout.Entries = append(workout.Entries, entry)
 	}
 
+	err = p.loadWorkoutSets(workout.Entries)
+	if err != nil {
+		return nil, err
+	}
+
 	return workout, nil
 }
 
+// loadWorkoutSets fills the SetDetails of entries.
+func (p *PostgresWorkoutStore) loadWorkoutSets(entries []WorkoutEntry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	entryIndexes := map[int64]int{}
+	entryIds := make([]int64, len(entries))
+	for i := range entries {
+		entryIndexes[entries[i].Id] = i
+		entryIds[i] = entries[i].Id
+		entries[i].SetDetails = []WorkoutSet{}
+	}
+
+	query := `
+		SELECT id, entry_id, set_number, set_type, reps, duration_seconds, weight, rpe, rir, rest_seconds, completed
+		FROM workout_sets
+		WHERE entry_id = ANY($1)
+		ORDER BY entry_id, set_number
+	`
+
+	rows, err := p.db.Query(query, entryIds)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var set WorkoutSet
+		var entryId int64
+		err := rows.Scan(
+			&set.Id,
+			&entryId,
+			&set.SetNumber,
+			&set.Type,
+			&set.Reps,
+			&set.DurationSeconds,
+			&set.Weight,
+			&set.RPE,
+			&set.RIR,
+			&set.RestSeconds,
+			&set.Completed,
+		)
+		if err != nil {
+			return err
+		}
+
+		entry := &entries[entryIndexes[entryId]]
+		entry.SetDetails = append(entry.SetDetails, set)
+	}
+
+	return rows.Err()
+}
+
 func (p *PostgresWorkoutStore) UpdateWorkout(workout *Workout) error {
 	tx, err := p.db.Begin()
 	if err != nil {
@@ -185,32 +620,39 @@ func (p *PostgresWorkoutStore) UpdateWorkout(workout *Workout) error {
 	}
 	defer tx.Rollback()
 
+	err = prepareWorkout(workout)
+	if err != nil {
+		return err
+	}
+
+	if workout.PerformedAt.IsZero() {
+		workout.PerformedAt = time.Now()
+	}
+
 	query := `
 		UPDATE workouts
-		SET title = $1, description = $2, duration_minutes = $3, calories_burned = $4
-		WHERE id = $5
+		SET title = $1, description = $2, duration_minutes = $3, calories_burned = $4, visibility = $5, share_token = $6,
+			performed_at = $7, timezone = $8, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $9
+		RETURNING updated_at
 	`
 
-	result, err := tx.Exec(
+	err = tx.QueryRow(
 		query,
 		workout.Title,
 		workout.Description,
 		workout.DurationMinutes,
 		workout.CaloriesBurned,
+		workout.Visibility,
+		workout.ShareToken,
+		workout.PerformedAt,
+		workout.Timezone,
 		workout.Id,
-	)
-	if err != nil {
-		return err
-	}
-
-	rowsAffected, err := result.RowsAffected()
+	).Scan(&workout.UpdatedAt)
 	if err != nil {
 		return err
 	}
-
-	if rowsAffected == 0 {
-		return sql.ErrNoRows
-	}
+	workout.localize()
 
 	// Updating entries
 	_, err = tx.Exec("DELETE FROM workout_entries WHERE workout_id = $1", workout.Id)
@@ -225,9 +667,7 @@ func (p *PostgresWorkoutStore) UpdateWorkout(workout *Workout) error {
 		}
 	}
 
-	tx.Commit()
-
-	return nil
+	return tx.Commit()
 }
 
 func (p *PostgresWorkoutStore) DeleteWorkout(id int64) error {
@@ -253,32 +693,222 @@ func (p *PostgresWorkoutStore) DeleteWorkout(id int64) error {
 	return nil
 }
 
-func (p *PostgresWorkoutStore) GetWorkoutOwner(id int64) (int64, error) {
-	var userId int64
+// UnlinkedExerciseName is a free-text exercise name used by the entries of a
+// user which are not linked to an exercise.
+type UnlinkedExerciseName struct {
+	UserId       int64
+	ExerciseName string
+	Entries      int64
+}
 
+// GetUnlinkedExerciseNames returns the distinct names of the entries not
+// linked to an exercise, per user.
+func (p *PostgresWorkoutStore) GetUnlinkedExerciseNames() ([]UnlinkedExerciseName, error) {
 	query := `
-		SELECT user_id
-		FROM workouts
-		WHERE id = $1
+		SELECT w.user_id, we.exercise_name, COUNT(*)
+		FROM workout_entries we
+		INNER JOIN workouts w ON w.id = we.workout_id
+		WHERE we.exercise_id IS NULL
+		GROUP BY w.user_id, we.exercise_name
+		ORDER BY w.user_id, we.exercise_name
+	`
+
+	rows, err := p.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	names := []UnlinkedExerciseName{}
+	for rows.Next() {
+		var name UnlinkedExerciseName
+		err := rows.Scan(&name.UserId, &name.ExerciseName, &name.Entries)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// ExerciseLink links the entries of UserId named ExerciseName, and not linked
+// yet, to the exercise ExerciseId.
+type ExerciseLink struct {
+	UserId       int64
+	ExerciseName string
+	ExerciseId   int64
+}
+
+// LinkExercises applies links all at once, naming the entries after their
+// exercise like the entries linked when logged, and returns how many entries
+// were linked.
+func (p *PostgresWorkoutStore) LinkExercises(links []ExerciseLink) (int64, error) {
+	tx, err := p.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	defer tx.Rollback()
+
+	query := `
+		UPDATE workout_entries
+		SET exercise_id = $1, exercise_name = (SELECT name FROM exercises WHERE id = $1)
+		WHERE exercise_id IS NULL
+			AND exercise_name = $2
+			AND workout_id IN (SELECT id FROM workouts WHERE user_id = $3)
 	`
 
-	err := p.db.QueryRow(query, id).Scan(&userId)
+	var linked int64
+	for _, link := range links {
+		result, err := tx.Exec(query, link.ExerciseId, link.ExerciseName, link.UserId)
+		if err != nil {
+			return 0, err
+		}
+
+		count, err := result.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		linked += count
+	}
+
+	err = tx.Commit()
 	if err != nil {
 		return 0, err
 	}
 
-	return userId, nil
+	return linked, nil
+}
+
+// prepareWorkout defaults the visibility of workout to private and its time
+// zone to UTC, and gives unlisted workouts a share token, kept for as long as
+// they stay unlisted.
+func prepareWorkout(workout *Workout) error {
+	if workout.Visibility == "" {
+		workout.Visibility = VisibilityPrivate
+	}
+
+	if workout.Timezone == "" {
+		workout.Timezone = "UTC"
+	}
+
+	if workout.Visibility != VisibilityUnlisted {
+		workout.ShareToken = nil
+		return nil
+	}
+
+	if workout.ShareToken != nil {
+		return nil
+	}
+
+	randomBytes := make([]byte, 16)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	token := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	workout.ShareToken = &token
+
+	return nil
+}
+
+// prepareSets completes the sets of entry: made from the aggregate fields
+// when none is given, numbered and typed otherwise, in which case the
+// aggregate fields are taken from the first working set.
+func prepareSets(entry *WorkoutEntry) {
+	if len(entry.SetDetails) == 0 {
+		entry.SetDetails = make([]WorkoutSet, entry.Sets)
+		for i := range entry.SetDetails {
+			entry.SetDetails[i] = WorkoutSet{
+				Reps:            clone(entry.Reps),
+				DurationSeconds: clone(entry.DurationSeconds),
+				Weight:          clone(entry.Weight),
+			}
+		}
+	}
+
+	for i := range entry.SetDetails {
+		set := &entry.SetDetails[i]
+		set.SetNumber = i + 1
+		if set.Type == "" {
+			set.Type = SetTypeWorking
+		}
+		if set.Completed == nil {
+			completed := true
+			set.Completed = &completed
+		}
+	}
+
+	entry.Sets = len(entry.SetDetails)
+	if entry.Sets == 0 {
+		return
+	}
+
+	summary := entry.SetDetails[0]
+	for _, set := range entry.SetDetails {
+		if set.Type == SetTypeWorking {
+			summary = set
+			break
+		}
+	}
+	entry.Reps, entry.DurationSeconds, entry.Weight = summary.Reps, summary.DurationSeconds, summary.Weight
+}
+
+// clone returns a pointer to a copy of the value p points to, so that sets
+// made from the same aggregate do not share their fields.
+func clone[T any](p *T) *T {
+	if p == nil {
+		return nil
+	}
+
+	copied := *p
+	return &copied
+}
+
+func insertWorkoutSets(tx *sql.Tx, entry *WorkoutEntry) error {
+	query := `
+		INSERT INTO workout_sets (entry_id, set_number, set_type, reps, duration_seconds, weight, rpe, rir, rest_seconds, completed)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id
+	`
+
+	for i := range entry.SetDetails {
+		set := &entry.SetDetails[i]
+		err := tx.QueryRow(
+			query,
+			entry.Id,
+			set.SetNumber,
+			set.Type,
+			set.Reps,
+			set.DurationSeconds,
+			set.Weight,
+			set.RPE,
+			set.RIR,
+			set.RestSeconds,
+			set.Completed,
+		).Scan(&set.Id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func createWorkoutEntry(tx *sql.Tx, workoutId int64, entry *WorkoutEntry) error {
+	prepareSets(entry)
+
 	query :=
-		`INSERT INTO workout_entries (workout_id, exercise_name, sets, reps, duration_seconds, weight, notes, unit, order_index)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		`INSERT INTO workout_entries (workout_id, exercise_id, exercise_name, sets, reps, duration_seconds, weight, notes, unit, order_index)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 			RETURNING id
 		`
 
 	err := tx.QueryRow(query,
 		workoutId,
+		entry.ExerciseId,
 		entry.ExerciseName,
 		entry.Sets,
 		entry.Reps,
@@ -292,18 +922,21 @@ func createWorkoutEntry(tx *sql.Tx, workoutId int64, entry *WorkoutEntry) error
 		return err
 	}
 
-	return nil
+	return insertWorkoutSets(tx, entry)
 }
 
 func insertWorkoutEntry(tx *sql.Tx, workoutId int64, entry *WorkoutEntry) error {
+	prepareSets(entry)
+
 	query := `
-		INSERT INTO workout_entries (workout_id, exercise_name, sets, reps, duration_seconds, weight, notes, unit, order_index)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		INSERT INTO workout_entries (workout_id, exercise_id, exercise_name, sets, reps, duration_seconds, weight, notes, unit, order_index)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 		RETURNING id
 	`
 	err := tx.QueryRow(
 		query,
 		workoutId,
+		entry.ExerciseId,
 		entry.ExerciseName,
 		entry.Sets,
 		entry.Reps,
@@ -318,5 +951,5 @@ func insertWorkoutEntry(tx *sql.Tx, workoutId int64, entry *WorkoutEntry) error
 		return err
 	}
 
-	return nil
+	return insertWorkoutSets(tx, entry)
 }
@@ -2,7 +2,9 @@ package store
 
 import (
 	"database/sql"
+	"encoding/json"
 	"testing"
+	"time"
 
 	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/stretchr/testify/assert"
@@ -28,6 +30,13 @@ func setupTestDb(t *testing.T) *sql.DB {
 	return db
 }
 
+// deleteUsers deletes the users along with their data. TRUNCATE would empty
+// the exercise catalog as well, the exercises table referencing users.
+func deleteUsers(t *testing.T, db *sql.DB) {
+	_, err := db.Exec("DELETE FROM users;")
+	require.NoError(t, err)
+}
+
 func TestCreateWorkout(t *testing.T) {
 	db := setupTestDb(t)
 	defer db.Close()
@@ -115,6 +124,7 @@ func TestCreateWorkout(t *testing.T) {
 				assert.Equal(t, tt.workout.Entries[i].ExerciseName, entry.ExerciseName)
 				assert.Equal(t, tt.workout.Entries[i].Sets, entry.Sets)
 				assert.Equal(t, tt.workout.Entries[i].Reps, entry.Reps)
+				assert.Len(t, entry.SetDetails, tt.workout.Entries[i].Sets)
 			}
 		})
 	}
@@ -127,3 +137,249 @@ func IntPtr(i int) *int {
 func FloatPtr(f float64) *float64 {
 	return &f
 }
+
+func TimePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestGetWorkouts(t *testing.T) {
+	db := setupTestDb(t)
+	defer db.Close()
+
+	deleteUsers(t, db)
+
+	owner := &User{Username: "owner", Email: "owner@example.com"}
+	require.NoError(t, owner.PasswordHash.Set("password123"))
+	require.NoError(t, NewPostgresUserStore(db).CreateUser(owner))
+
+	other := &User{Username: "other", Email: "other@example.com"}
+	require.NoError(t, other.PasswordHash.Set("password123"))
+	require.NoError(t, NewPostgresUserStore(db).CreateUser(other))
+
+	store := NewPostgresWorkoutStore(db)
+	yesterday := time.Now().Add(-24 * time.Hour)
+	seed := []*Workout{
+		{UserId: owner.Id, Title: "Leg day", DurationMinutes: 45, CaloriesBurned: 400, Entries: []WorkoutEntry{
+			{ExerciseName: "Back squat", Sets: 5, Reps: IntPtr(5), OrderIndex: 1},
+		}},
+		{UserId: owner.Id, Title: "Morning run", DurationMinutes: 30, CaloriesBurned: 300, PerformedAt: yesterday, Timezone: "Europe/Paris", Entries: []WorkoutEntry{
+			{ExerciseName: "Run", Sets: 1, DurationSeconds: IntPtr(1800), OrderIndex: 1},
+		}},
+		{UserId: owner.Id, Title: "Push day", DurationMinutes: 60, CaloriesBurned: 500, Entries: []WorkoutEntry{
+			{ExerciseName: "Bench press", Sets: 4, Reps: IntPtr(8), OrderIndex: 1},
+		}},
+		{UserId: other.Id, Title: "Other leg day", DurationMinutes: 50, CaloriesBurned: 450},
+	}
+	for _, workout := range seed {
+		_, err := store.CreateWorkout(workout)
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name   string
+		filter WorkoutFilter
+		want   []string
+	}{
+		{
+			name:   "scoped to owner",
+			filter: WorkoutFilter{UserId: owner.Id, Sort: "title"},
+			want:   []string{"Leg day", "Morning run", "Push day"},
+		},
+		{
+			name:   "title substring",
+			filter: WorkoutFilter{Title: "leg", Sort: "title"},
+			want:   []string{"Leg day", "Other leg day"},
+		},
+		{
+			name:   "duration range sorted descending",
+			filter: WorkoutFilter{UserId: owner.Id, MinDuration: IntPtr(40), MaxDuration: IntPtr(60), Sort: "-duration_minutes"},
+			want:   []string{"Push day", "Leg day"},
+		},
+		{
+			name:   "performed before",
+			filter: WorkoutFilter{UserId: owner.Id, To: TimePtr(time.Now().Add(-time.Hour))},
+			want:   []string{"Morning run"},
+		},
+		{
+			name:   "calories and exercise",
+			filter: WorkoutFilter{UserId: owner.Id, MinCalories: IntPtr(350), ExerciseName: "squat"},
+			want:   []string{"Leg day"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.filter.Take = 10
+			page, err := store.GetWorkouts(tt.filter)
+			require.NoError(t, err)
+
+			titles := []string{}
+			for _, workout := range page.Workouts {
+				titles = append(titles, workout.Title)
+			}
+			assert.Equal(t, tt.want, titles)
+		})
+	}
+
+	_, err := store.GetWorkouts(WorkoutFilter{Sort: "password_hash", Take: 10})
+	assert.ErrorIs(t, err, ErrInvalidSort)
+
+	t.Run("keyset pagination", func(t *testing.T) {
+		filter := WorkoutFilter{UserId: owner.Id, Sort: "title", Take: 2}
+
+		first, err := store.GetWorkouts(filter)
+		require.NoError(t, err)
+		require.Len(t, first.Workouts, 2)
+		assert.Nil(t, first.Prev)
+		require.NotNil(t, first.Next)
+
+		filter.Cursor = first.Next
+		second, err := store.GetWorkouts(filter)
+		require.NoError(t, err)
+		require.Len(t, second.Workouts, 1)
+		assert.Equal(t, "Push day", second.Workouts[0].Title)
+		assert.Nil(t, second.Next)
+		require.NotNil(t, second.Prev)
+
+		filter.Cursor = second.Prev
+		back, err := store.GetWorkouts(filter)
+		require.NoError(t, err)
+		assert.Equal(t, first.Workouts, back.Workouts)
+		assert.Nil(t, back.Prev)
+	})
+}
+
+func TestLinkExercises(t *testing.T) {
+	db := setupTestDb(t)
+	defer db.Close()
+
+	deleteUsers(t, db)
+
+	owner := &User{Username: "owner", Email: "owner@example.com"}
+	require.NoError(t, owner.PasswordHash.Set("password123"))
+	require.NoError(t, NewPostgresUserStore(db).CreateUser(owner))
+
+	other := &User{Username: "other", Email: "other@example.com"}
+	require.NoError(t, other.PasswordHash.Set("password123"))
+	require.NoError(t, NewPostgresUserStore(db).CreateUser(other))
+
+	store := NewPostgresWorkoutStore(db)
+	seed := []*Workout{
+		{UserId: owner.Id, Title: "Push day", Entries: []WorkoutEntry{
+			{ExerciseName: "bench", Sets: 3, Reps: IntPtr(8), OrderIndex: 1},
+			{ExerciseName: "ohp", Sets: 3, Reps: IntPtr(8), OrderIndex: 2},
+		}},
+		{UserId: owner.Id, Title: "Push day again", Entries: []WorkoutEntry{
+			{ExerciseName: "bench", Sets: 3, Reps: IntPtr(8), OrderIndex: 1},
+		}},
+		{UserId: other.Id, Title: "Other push day", Entries: []WorkoutEntry{
+			{ExerciseName: "bench", Sets: 3, Reps: IntPtr(8), OrderIndex: 1},
+		}},
+	}
+	for _, workout := range seed {
+		_, err := store.CreateWorkout(workout)
+		require.NoError(t, err)
+	}
+
+	names, err := store.GetUnlinkedExerciseNames()
+	require.NoError(t, err)
+	assert.Equal(t, []UnlinkedExerciseName{
+		{UserId: owner.Id, ExerciseName: "bench", Entries: 2},
+		{UserId: owner.Id, ExerciseName: "ohp", Entries: 1},
+		{UserId: other.Id, ExerciseName: "bench", Entries: 1},
+	}, names)
+
+	exercises, err := NewPostgresExerciseStore(db).ListExercises(ExerciseFilter{Query: "Bench press", Take: 1})
+	require.NoError(t, err)
+	require.Len(t, exercises.Exercises, 1)
+	benchPress := exercises.Exercises[0]
+
+	linked, err := store.LinkExercises([]ExerciseLink{{UserId: owner.Id, ExerciseName: "bench", ExerciseId: benchPress.Id}})
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, linked)
+
+	workout, err := store.GetWorkoutById(seed[1].Id)
+	require.NoError(t, err)
+	require.NotNil(t, workout.Entries[0].ExerciseId)
+	assert.Equal(t, benchPress.Id, *workout.Entries[0].ExerciseId)
+	assert.Equal(t, benchPress.Name, workout.Entries[0].ExerciseName, "entries are named after their exercise")
+
+	names, err = store.GetUnlinkedExerciseNames()
+	require.NoError(t, err)
+	assert.Equal(t, []UnlinkedExerciseName{
+		{UserId: owner.Id, ExerciseName: "ohp", Entries: 1},
+		{UserId: other.Id, ExerciseName: "bench", Entries: 1},
+	}, names)
+
+	t.Run("all or nothing", func(t *testing.T) {
+		_, err := store.LinkExercises([]ExerciseLink{
+			{UserId: other.Id, ExerciseName: "bench", ExerciseId: benchPress.Id},
+			{UserId: owner.Id, ExerciseName: "ohp", ExerciseId: -1},
+		})
+		require.Error(t, err)
+
+		names, err := store.GetUnlinkedExerciseNames()
+		require.NoError(t, err)
+		assert.Len(t, names, 2)
+	})
+}
+
+func TestValidTimezone(t *testing.T) {
+	assert.True(t, ValidTimezone("UTC"))
+	assert.True(t, ValidTimezone("Europe/Paris"))
+	assert.False(t, ValidTimezone(""))
+	assert.False(t, ValidTimezone("Local"))
+	assert.False(t, ValidTimezone("Mars/Olympus_Mons"))
+}
+
+func TestWorkoutEntrySets(t *testing.T) {
+	t.Run("aggregate", func(t *testing.T) {
+		var entry WorkoutEntry
+		require.NoError(t, json.Unmarshal([]byte(`{"exercise_name": "Squat", "sets": 3, "reps": 5, "weight": 100}`), &entry))
+		assert.Equal(t, 3, entry.Sets)
+		assert.Empty(t, entry.SetDetails)
+
+		prepareSets(&entry)
+		require.Len(t, entry.SetDetails, 3)
+		for i, set := range entry.SetDetails {
+			assert.Equal(t, i+1, set.SetNumber)
+			assert.Equal(t, SetTypeWorking, set.Type)
+			assert.Equal(t, 5, *set.Reps)
+			assert.Equal(t, 100.0, *set.Weight)
+			assert.True(t, *set.Completed)
+		}
+
+		*entry.SetDetails[0].Completed = false
+		*entry.SetDetails[0].Reps = 3
+		assert.True(t, *entry.SetDetails[1].Completed, "sets do not share their values")
+		assert.Equal(t, 5, *entry.SetDetails[1].Reps)
+	})
+
+	t.Run("per set", func(t *testing.T) {
+		var entry WorkoutEntry
+		body := `{"exercise_name": "Bench press", "sets": [
+			{"set_type": "warmup", "reps": 10, "weight": 40},
+			{"reps": 8, "weight": 80, "rpe": 8.5},
+			{"set_type": "failure", "reps": 4, "weight": 80, "completed": false}
+		]}`
+		require.NoError(t, json.Unmarshal([]byte(body), &entry))
+		assert.Equal(t, 3, entry.Sets)
+
+		prepareSets(&entry)
+		assert.Equal(t, []int{1, 2, 3}, []int{entry.SetDetails[0].SetNumber, entry.SetDetails[1].SetNumber, entry.SetDetails[2].SetNumber})
+		assert.Equal(t, 8, *entry.Reps, "aggregate taken from the first working set")
+		assert.Equal(t, 80.0, *entry.Weight)
+		assert.False(t, *entry.SetDetails[2].Completed)
+
+		js, err := json.Marshal(entry)
+		require.NoError(t, err)
+		assert.Contains(t, string(js), `"set_count":3`)
+		assert.Contains(t, string(js), `"sets":[{`)
+		assert.Contains(t, string(js), `"set_type":"failure"`)
+
+		var decoded WorkoutEntry
+		require.NoError(t, json.Unmarshal(js, &decoded), "entries read back what they write")
+		assert.Equal(t, entry.SetDetails, decoded.SetDetails)
+		assert.Equal(t, 3, decoded.Sets)
+	})
+}
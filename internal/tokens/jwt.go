@@ -0,0 +1,203 @@
+package tokens
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const jwtIssuer = "workout-api"
+
+var ErrInvalidJWT = errors.New("invalid jwt")
+
+// SigningKey is a key access tokens are signed or verified with, identified by
+// the kid header of the tokens.
+type SigningKey struct {
+	Id     string
+	method jwt.SigningMethod
+	sign   any
+	verify any
+}
+
+// ParseSigningKeys reads a comma separated list of keys written as
+// kid:alg:base64-secret, alg being HS256 or EdDSA. The secret of an EdDSA key
+// is its 32 bytes seed.
+func ParseSigningKeys(spec string) ([]SigningKey, error) {
+	var keys []SigningKey
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("jwt key %q: expected kid:alg:secret", entry)
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("jwt key %s: secret is not base64: %w", parts[0], err)
+		}
+
+		key := SigningKey{Id: parts[0]}
+		switch parts[1] {
+		case "HS256":
+			if len(secret) < 32 {
+				return nil, fmt.Errorf("jwt key %s: HS256 secret must be at least 32 bytes", key.Id)
+			}
+			key.method, key.sign, key.verify = jwt.SigningMethodHS256, secret, secret
+		case "EdDSA":
+			if len(secret) != ed25519.SeedSize {
+				return nil, fmt.Errorf("jwt key %s: EdDSA seed must be %d bytes", key.Id, ed25519.SeedSize)
+			}
+			private := ed25519.NewKeyFromSeed(secret)
+			key.method, key.sign, key.verify = jwt.SigningMethodEdDSA, private, private.Public()
+		default:
+			return nil, fmt.Errorf("jwt key %s: unsupported algorithm %q", key.Id, parts[1])
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// AccessClaims are the claims of a JWT access token. The session is the token
+// family, and the JWT id the hex encoded hash of the opaque token recorded for
+// the session, which is what revocations refer to.
+type AccessClaims struct {
+	jwt.RegisteredClaims
+	Session   string `json:"sid"`
+	Username  string `json:"name"`
+	Role      string `json:"role"`
+	Activated bool   `json:"activated"`
+}
+
+// JWTCodec signs access tokens with the first of its keys, and verifies them
+// with any of its keys: keys are rotated by adding the new key first and
+// dropping the old one once the tokens it signed have expired.
+type JWTCodec struct {
+	keys map[string]SigningKey
+	// current signs new tokens
+	current SigningKey
+}
+
+func NewJWTCodec(keys []SigningKey) (*JWTCodec, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("jwt: at least one signing key is required")
+	}
+
+	codec := &JWTCodec{
+		keys:    map[string]SigningKey{},
+		current: keys[0],
+	}
+
+	for _, key := range keys {
+		if _, ok := codec.keys[key.Id]; ok {
+			return nil, fmt.Errorf("jwt: duplicate key id %q", key.Id)
+		}
+		codec.keys[key.Id] = key
+	}
+
+	return codec, nil
+}
+
+// TokenId returns the JWT id of a token recorded under hash.
+func TokenId(hash []byte) string {
+	return hex.EncodeToString(hash)
+}
+
+// Sign replaces the plaintext of an auth token with a JWT standing for it.
+// The token must have been generated, its hash being the JWT id.
+func (c *JWTCodec) Sign(token *Token, username, role string, activated bool) error {
+	claims := AccessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    jwtIssuer,
+			Subject:   strconv.FormatInt(token.UserId, 10),
+			ID:        TokenId(token.Hash),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(token.Expiry),
+		},
+		Session:   token.Family,
+		Username:  username,
+		Role:      role,
+		Activated: activated,
+	}
+
+	jwtToken := jwt.NewWithClaims(c.current.method, claims)
+	jwtToken.Header["kid"] = c.current.Id
+
+	signed, err := jwtToken.SignedString(c.current.sign)
+	if err != nil {
+		return err
+	}
+
+	token.Plaintext = signed
+	return nil
+}
+
+// Verify checks the signature and expiry of a JWT access token and returns
+// the token it stands for along with its claims.
+func (c *JWTCodec) Verify(raw string) (*Token, *AccessClaims, error) {
+	claims := &AccessClaims{}
+
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (any, error) {
+		kid, _ := t.Header["kid"].(string)
+		key, ok := c.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key %q", kid)
+		}
+
+		// the algorithm is the one of the key, never the one claimed by
+		// the token
+		if t.Method.Alg() != key.method.Alg() {
+			return nil, fmt.Errorf("unexpected algorithm %q", t.Method.Alg())
+		}
+
+		return key.verify, nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidJWT, err)
+	}
+
+	if !claims.VerifyIssuer(jwtIssuer, true) || claims.ExpiresAt == nil {
+		return nil, nil, fmt.Errorf("%w: bad claims", ErrInvalidJWT)
+	}
+
+	userId, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: bad subject", ErrInvalidJWT)
+	}
+
+	hash, err := hex.DecodeString(claims.ID)
+	if err != nil || len(hash) != sha256.Size {
+		return nil, nil, fmt.Errorf("%w: bad id", ErrInvalidJWT)
+	}
+
+	token := &Token{
+		Plaintext: raw,
+		Hash:      hash,
+		UserId:    userId,
+		Expiry:    claims.ExpiresAt.Time,
+		Scope:     ScopeAuth,
+		Family:    claims.Session,
+		Stateless: true,
+	}
+
+	return token, claims, nil
+}
+
+// IsJWT tells JWTs apart from opaque tokens, which never contain dots.
+func IsJWT(raw string) bool {
+	return strings.Count(raw, ".") == 2
+}
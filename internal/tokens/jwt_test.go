@@ -0,0 +1,111 @@
+package tokens
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testKeys(t *testing.T, spec string) []SigningKey {
+	keys, err := ParseSigningKeys(spec)
+	require.NoError(t, err)
+	return keys
+}
+
+func secret(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), 32)))
+}
+
+func TestJWTCodec(t *testing.T) {
+	hsKey := "k1:HS256:" + secret('a')
+	edKey := "k2:EdDSA:" + secret('b')
+
+	for _, spec := range []string{hsKey, edKey} {
+		t.Run(strings.SplitN(spec, ":", 3)[1], func(t *testing.T) {
+			codec, err := NewJWTCodec(testKeys(t, spec))
+			require.NoError(t, err)
+
+			token, err := GenerateToken(42, time.Minute, ScopeAuth)
+			require.NoError(t, err)
+			token.Family = "family"
+
+			require.NoError(t, codec.Sign(token, "jane", "admin", true))
+			assert.True(t, IsJWT(token.Plaintext))
+
+			verified, claims, err := codec.Verify(token.Plaintext)
+			require.NoError(t, err)
+			assert.Equal(t, int64(42), verified.UserId)
+			assert.Equal(t, token.Hash, verified.Hash)
+			assert.Equal(t, "family", verified.Family)
+			assert.Equal(t, ScopeAuth, verified.Scope)
+			assert.True(t, verified.Stateless)
+			assert.Equal(t, "jane", claims.Username)
+			assert.Equal(t, "admin", claims.Role)
+			assert.True(t, claims.Activated)
+			assert.Equal(t, TokenId(token.Hash), claims.ID)
+		})
+	}
+
+	t.Run("rotation", func(t *testing.T) {
+		old, err := NewJWTCodec(testKeys(t, hsKey))
+		require.NoError(t, err)
+		rotated, err := NewJWTCodec(testKeys(t, edKey+","+hsKey))
+		require.NoError(t, err)
+		retired, err := NewJWTCodec(testKeys(t, edKey))
+		require.NoError(t, err)
+
+		token, err := GenerateToken(1, time.Minute, ScopeAuth)
+		require.NoError(t, err)
+		require.NoError(t, old.Sign(token, "jane", "admin", true))
+
+		_, _, err = rotated.Verify(token.Plaintext)
+		assert.NoError(t, err)
+
+		_, _, err = retired.Verify(token.Plaintext)
+		assert.ErrorIs(t, err, ErrInvalidJWT)
+	})
+
+	t.Run("rejected", func(t *testing.T) {
+		codec, err := NewJWTCodec(testKeys(t, hsKey))
+		require.NoError(t, err)
+		other, err := NewJWTCodec(testKeys(t, "k1:HS256:"+secret('c')))
+		require.NoError(t, err)
+
+		expired, err := GenerateToken(1, -time.Minute, ScopeAuth)
+		require.NoError(t, err)
+		require.NoError(t, codec.Sign(expired, "jane", "user", true))
+
+		forged, err := GenerateToken(1, time.Minute, ScopeAuth)
+		require.NoError(t, err)
+		require.NoError(t, other.Sign(forged, "jane", "user", true))
+
+		for name, raw := range map[string]string{
+			"expired": expired.Plaintext,
+			"forged":  forged.Plaintext,
+			"opaque":  "NOTAJWT",
+		} {
+			_, _, err := codec.Verify(raw)
+			assert.ErrorIs(t, err, ErrInvalidJWT, name)
+		}
+	})
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	for _, spec := range []string{
+		"k1:HS256:" + base64.StdEncoding.EncodeToString([]byte("short")),
+		"k1:EdDSA:" + base64.StdEncoding.EncodeToString([]byte("short")),
+		"k1:RS256:" + secret('a'),
+		"k1:HS256:not base64",
+		"HS256:" + secret('a'),
+	} {
+		_, err := ParseSigningKeys(spec)
+		assert.Error(t, err, spec)
+	}
+
+	_, err := NewJWTCodec(testKeys(t, "k1:HS256:"+secret('a')+",k1:EdDSA:"+secret('b')))
+	assert.Error(t, err)
+}
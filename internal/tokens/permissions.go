@@ -0,0 +1,48 @@
+package tokens
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	PermissionWorkoutsRead  = "workouts:read"
+	PermissionWorkoutsWrite = "workouts:write"
+	PermissionProfileRead   = "profile:read"
+	PermissionProfileWrite  = "profile:write"
+)
+
+// AllPermissions is granted to interactive sessions. API keys get a subset.
+var AllPermissions = Permissions{
+	PermissionWorkoutsRead,
+	PermissionWorkoutsWrite,
+	PermissionProfileRead,
+	PermissionProfileWrite,
+}
+
+type Permissions []string
+
+func (p Permissions) Includes(permission string) bool {
+	return slices.Contains(p, permission)
+}
+
+// Validate checks every permission is known.
+func (p Permissions) Validate() error {
+	for _, permission := range p {
+		if !AllPermissions.Includes(permission) {
+			return fmt.Errorf("unknown permission %q", permission)
+		}
+	}
+
+	return nil
+}
+
+// String returns the permissions space separated, the way they are stored.
+func (p Permissions) String() string {
+	return strings.Join(p, " ")
+}
+
+func ParsePermissions(s string) Permissions {
+	return Permissions(strings.Fields(s))
+}
@@ -8,15 +8,43 @@ import (
 )
 
 const (
-	ScopeAuth = "auth"
+	ScopeAuth          = "auth"
+	ScopeRefresh       = "refresh"
+	ScopePasswordReset = "password-reset"
+	ScopeActivation    = "activation"
+	ScopeAPIKey        = "api-key"
+	Scope2FAChallenge  = "2fa-challenge"
+	ScopeMagicLink     = "magic-link"
+	// ScopeImpersonation tokens let an admin act as another user.
+	ScopeImpersonation = "impersonation"
 )
 
 type Token struct {
+	Id        int64     `json:"-"`
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserId    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	// Family groups the access and refresh tokens descending from the same
+	// login, so a whole session can be revoked at once.
+	Family string `json:"-"`
+	Device Device `json:"-"`
+	// Name and Permissions are only set on API keys.
+	Name        string      `json:"-"`
+	Permissions Permissions `json:"-"`
+	// ImpersonatorId is the admin behind an impersonation token.
+	ImpersonatorId int64 `json:"-"`
+	// Stateless is set on tokens authenticated from a JWT, whose user was
+	// read from the claims rather than the database.
+	Stateless bool `json:"-"`
+}
+
+// Device describes the client a token was issued to.
+type Device struct {
+	Name      string
+	UserAgent string
+	IP        string
 }
 
 func GenerateToken(userId int64, ttl time.Duration, scope string) (*Token, error) {
@@ -38,3 +66,14 @@ func GenerateToken(userId int64, ttl time.Duration, scope string) (*Token, error
 
 	return token, nil
 }
+
+// NewFamily returns a random identifier for a new token family.
+func NewFamily() (string, error) {
+	emptyBytes := make([]byte, 16)
+	_, err := rand.Read(emptyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(emptyBytes), nil
+}
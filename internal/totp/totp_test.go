@@ -0,0 +1,58 @@
+package totp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rfcSecret is the SHA1 seed of the RFC 6238 test vectors, "12345678901234567890".
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestCodeAt(t *testing.T) {
+	// RFC 6238 appendix B, truncated to 6 digits
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		code, err := CodeAt(rfcSecret, Step(time.Unix(tt.unix, 0)))
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, code, "at %d", tt.unix)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+
+	step, ok := Validate(rfcSecret, "050471", now)
+	assert.True(t, ok)
+	assert.Equal(t, Step(now), step)
+
+	previous, err := CodeAt(rfcSecret, Step(now)-1)
+	require.NoError(t, err)
+	_, ok = Validate(rfcSecret, previous, now)
+	assert.True(t, ok, "codes from the previous period are accepted")
+
+	stale, err := CodeAt(rfcSecret, Step(now)-2)
+	require.NoError(t, err)
+	_, ok = Validate(rfcSecret, stale, now)
+	assert.False(t, ok)
+
+	_, ok = Validate(rfcSecret, "12345", now)
+	assert.False(t, ok)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("JBSWY3DPEHPK3PXP", "Workout API", "john doe")
+	assert.Equal(t, "otpauth://totp/Workout%20API:john%20doe?algorithm=SHA1&digits=6&issuer=Workout+API&period=30&secret=JBSWY3DPEHPK3PXP", uri)
+}
@@ -3,10 +3,14 @@ package utils
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-chi/chi/v5"
+	"github.com/martialanouman/femProject/internal/cursor"
 )
 
 type Envelope map[string]any
@@ -39,23 +43,117 @@ func ReadIdParam(r *http.Request) (int64, error) {
 	return id, nil
 }
 
+const (
+	DefaultTake = 5
+	MaxTake     = 100
+)
+
+// ReadPaginationParams reads the take and skip query parameters, each of them
+// being optional.
 func ReadPaginationParams(r *http.Request) (int, int, error) {
 	qs := r.URL.Query()
 	paramTake, paramSkip := qs.Get("take"), qs.Get("skip")
 
-	if paramTake == "" && paramSkip == "" {
-		return 5, 0, nil
+	take, skip := int64(DefaultTake), int64(0)
+	var err error
+
+	if paramTake != "" {
+		take, err = strconv.ParseInt(paramTake, 10, 32)
+		if err != nil || take < 1 || take > MaxTake {
+			return 0, 0, errors.New("invalid take parameter")
+		}
+	}
+
+	if paramSkip != "" {
+		skip, err = strconv.ParseInt(paramSkip, 10, 32)
+		if err != nil || skip < 0 {
+			return 0, 0, errors.New("invalid skip parameter")
+		}
+	}
+
+	return int(take), int(skip), nil
+}
+
+// ReadCursorParam decodes the cursor query parameter, returning nil when it is
+// absent.
+func ReadCursorParam(r *http.Request, codec *cursor.Codec) (*cursor.Cursor, error) {
+	param := r.URL.Query().Get("cursor")
+	if param == "" {
+		return nil, nil
 	}
 
-	take, err := strconv.ParseInt(paramTake, 10, 32)
+	return codec.Decode(param)
+}
+
+// EncodeCursor encodes an optional cursor, nil being encoded as a JSON null.
+func EncodeCursor(codec *cursor.Codec, c *cursor.Cursor) (*string, error) {
+	if c == nil {
+		return nil, nil
+	}
+
+	token, err := codec.Encode(*c)
 	if err != nil {
-		return 0, 0, errors.New("invalid take parameter")
+		return nil, err
 	}
 
-	skip, err := strconv.ParseInt(paramSkip, 10, 32)
+	return &token, nil
+}
+
+// ReadOptionalIntParam parses the named query parameter as an int, returning
+// nil when it is absent.
+func ReadOptionalIntParam(r *http.Request, name string) (*int, error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return nil, nil
+	}
+
+	value, err := strconv.Atoi(param)
 	if err != nil {
-		return 0, 0, errors.New("invalid skip parameter")
+		return nil, fmt.Errorf("invalid %s parameter", name)
 	}
 
-	return int(take), int(skip), nil
+	return &value, nil
+}
+
+// ReadOptionalTimeParam parses the named query parameter either as an RFC 3339
+// timestamp or as a plain date (YYYY-MM-DD), returning nil when it is absent.
+// dateOnly reports whether the value was a plain date.
+func ReadOptionalTimeParam(r *http.Request, name string) (value *time.Time, dateOnly bool, err error) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return nil, false, nil
+	}
+
+	if t, err := time.Parse(time.RFC3339, param); err == nil {
+		return &t, false, nil
+	}
+
+	t, err := time.Parse(time.DateOnly, param)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid %s parameter", name)
+	}
+
+	return &t, true, nil
+}
+
+// ReadOptionalEndTimeParam is ReadOptionalTimeParam for the end of a range: a
+// plain date includes the whole day, standing for the start of the next one.
+func ReadOptionalEndTimeParam(r *http.Request, name string) (*time.Time, error) {
+	value, dateOnly, err := ReadOptionalTimeParam(r, name)
+	if err != nil || value == nil || !dateOnly {
+		return value, err
+	}
+
+	endOfDay := value.AddDate(0, 0, 1)
+	return &endOfDay, nil
+}
+
+// ClientIP returns the address of the client the request comes from.
+func ClientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
 }
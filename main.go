@@ -1,13 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
+	// workouts keep the time zone they were performed in, which must be
+	// known even on hosts without a zone database
+	_ "time/tzdata"
 
 	"github.com/martialanouman/femProject/internal/app"
+	"github.com/martialanouman/femProject/internal/matcher"
 	"github.com/martialanouman/femProject/internal/routes"
+	"github.com/martialanouman/femProject/internal/store"
 )
 
 func main() {
@@ -20,8 +32,22 @@ func main() {
 		panic(err)
 	}
 
-	defer app.Db.Close()
+	if flag.NArg() > 0 {
+		err = runCommand(app, flag.Args())
+	} else {
+		err = serve(app, port)
+	}
+
+	app.Db.Close()
+	if err != nil {
+		app.Logger.Print(err)
+		os.Exit(1)
+	}
+}
 
+// serve runs the API and the janitor until SIGINT or SIGTERM, then lets the
+// requests in progress finish.
+func serve(app *app.Application, port int) error {
 	r := routes.SetupRoutes(app)
 	server := &http.Server{
 		Addr:         fmt.Sprintf(":%d", port),
@@ -31,11 +57,140 @@ func main() {
 		WriteTimeout: 30 * time.Second,
 	}
 
-	app.Logger.Printf("Running App on port %d!\n", port)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	app.Janitor.Start(ctx)
+
+	serverErr := make(chan error, 1)
+	go func() {
+		app.Logger.Printf("Running App on port %d!\n", port)
+		serverErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	app.Logger.Printf("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := server.Shutdown(shutdownCtx)
+
+	// the emails of the last requests are still being sent
+	app.Mailer.Wait()
+
+	return err
+}
+
+// runCommand runs one of the maintenance commands given after the flags.
+func runCommand(app *app.Application, args []string) error {
+	switch args[0] {
+	case "set-role":
+		if len(args) != 3 {
+			return errors.New("usage: set-role <username> <user|coach|admin>")
+		}
+
+		return setRole(store.NewPostgresUserStore(app.Db), store.NewPostgresTokenStore(app.Db), args[1], store.Role(args[2]))
+	case "cleanup-tokens":
+		tokens, revocations, err := app.Janitor.RunOnce(context.Background())
+		if err != nil {
+			return fmt.Errorf("cleanup-tokens: %w", err)
+		}
+
+		app.Logger.Printf("deleted %d expired tokens and %d revocations of expired tokens", tokens, revocations)
+		return nil
+	case "link-exercises":
+		if len(args) > 2 || (len(args) == 2 && args[1] != "-dry-run") {
+			return errors.New("usage: link-exercises [-dry-run]")
+		}
+
+		return linkExercises(store.NewPostgresWorkoutStore(app.Db), store.NewPostgresExerciseStore(app.Db), app.Logger, len(args) == 2)
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+// setRole changes the role of a user, the way to appoint the first admin, and
+// revokes their tokens so that none keeps the permissions of the former role.
+func setRole(userStore store.UserStore, tokenStore store.TokenStore, username string, role store.Role) error {
+	if !role.Valid() {
+		return fmt.Errorf("invalid role %q", role)
+	}
+
+	user, err := userStore.GetUserByUsername(username)
+	if err != nil {
+		return fmt.Errorf("set-role: %s %w", username, err)
+	}
+
+	err = userStore.SetRole(user.Id, role)
+	if err != nil {
+		return fmt.Errorf("set-role: %s %w", username, err)
+	}
+
+	err = tokenStore.RevokeAllTokens(user.Id)
+	if err != nil {
+		return fmt.Errorf("set-role: %s %w", username, err)
+	}
+
+	return nil
+}
+
+// linkExercises links the workout entries logged before the exercise catalog
+// to the exercise their name matches, renaming them after it, and reports the
+// names matching none. The entries are linked all at once, or not at all when
+// dryRun is set.
+func linkExercises(workoutStore store.WorkoutStore, exerciseStore store.ExerciseStore, logger *log.Logger, dryRun bool) error {
+	names, err := workoutStore.GetUnlinkedExerciseNames()
+	if err != nil {
+		return fmt.Errorf("link-exercises: %w", err)
+	}
+
+	// custom exercises make the names of each user match differently
+	matchers := map[int64]*matcher.Matcher{}
+	links := []store.ExerciseLink{}
+	var linked, unmatched int64
+	for _, name := range names {
+		m, ok := matchers[name.UserId]
+		if !ok {
+			exercises, err := exerciseStore.GetExercisesForUser(name.UserId)
+			if err != nil {
+				return fmt.Errorf("link-exercises: %w", err)
+			}
+			m = matcher.New(exercises)
+			matchers[name.UserId] = m
+		}
+
+		exercise, ok := m.Match(name.ExerciseName)
+		if !ok {
+			suggestions := []string{}
+			for _, suggestion := range m.Suggest(name.ExerciseName, 3) {
+				suggestions = append(suggestions, suggestion.Name)
+			}
+
+			logger.Printf("unmatched %q of user %d in %d entries, closest: %s", name.ExerciseName, name.UserId, name.Entries, strings.Join(suggestions, ", "))
+			unmatched += name.Entries
+			continue
+		}
+
+		logger.Printf("matched %q of user %d to %q in %d entries", name.ExerciseName, name.UserId, exercise.Name, name.Entries)
+		links = append(links, store.ExerciseLink{UserId: name.UserId, ExerciseName: name.ExerciseName, ExerciseId: exercise.Id})
+		linked += name.Entries
+	}
+
+	if dryRun {
+		logger.Printf("dry run: would link %d entries, %d left unmatched", linked, unmatched)
+		return nil
+	}
 
-	err = server.ListenAndServe()
+	linked, err = workoutStore.LinkExercises(links)
 	if err != nil {
-		app.Logger.Fatal(err)
+		return fmt.Errorf("link-exercises: %w", err)
 	}
 
+	logger.Printf("linked %d entries, %d left unmatched", linked, unmatched)
+	return nil
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"testing"
+
+	"github.com/martialanouman/femProject/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeWorkoutStore struct {
+	store.WorkoutStore
+	names []store.UnlinkedExerciseName
+	links []store.ExerciseLink
+	err   error
+}
+
+func (s *fakeWorkoutStore) GetUnlinkedExerciseNames() ([]store.UnlinkedExerciseName, error) {
+	return s.names, nil
+}
+
+func (s *fakeWorkoutStore) LinkExercises(links []store.ExerciseLink) (int64, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	s.links = append(s.links, links...)
+
+	var linked int64
+	for _, link := range links {
+		for _, name := range s.names {
+			if name.UserId == link.UserId && name.ExerciseName == link.ExerciseName {
+				linked += name.Entries
+			}
+		}
+	}
+
+	return linked, nil
+}
+
+type fakeExerciseStore struct {
+	store.ExerciseStore
+	exercises []store.Exercise
+}
+
+func (s *fakeExerciseStore) GetExercisesForUser(userId int64) ([]store.Exercise, error) {
+	exercises := []store.Exercise{}
+	for _, exercise := range s.exercises {
+		if exercise.UserId == nil || *exercise.UserId == userId {
+			exercises = append(exercises, exercise)
+		}
+	}
+
+	return exercises, nil
+}
+
+func TestLinkExercises(t *testing.T) {
+	userId := int64(1)
+	exerciseStore := &fakeExerciseStore{exercises: []store.Exercise{
+		{Id: 1, Name: "Bench press"},
+		{Id: 2, Name: "Barbell row"},
+		{Id: 3, Name: "Dumbbell row"},
+		{Id: 4, UserId: &userId, Name: "Bench press"},
+	}}
+	names := []store.UnlinkedExerciseName{
+		{UserId: 1, ExerciseName: "bench press", Entries: 3},
+		{UserId: 1, ExerciseName: "row", Entries: 2},
+		{UserId: 2, ExerciseName: "Bench-press", Entries: 1},
+	}
+
+	t.Run("links the matched names", func(t *testing.T) {
+		workoutStore := &fakeWorkoutStore{names: names}
+		var output bytes.Buffer
+
+		err := linkExercises(workoutStore, exerciseStore, log.New(&output, "", 0), false)
+		require.NoError(t, err)
+
+		assert.Equal(t, []store.ExerciseLink{
+			{UserId: 1, ExerciseName: "bench press", ExerciseId: 4},
+			{UserId: 2, ExerciseName: "Bench-press", ExerciseId: 1},
+		}, workoutStore.links)
+		assert.Contains(t, output.String(), `unmatched "row" of user 1 in 2 entries, closest: Barbell row, Dumbbell row`)
+		assert.Contains(t, output.String(), "linked 4 entries, 2 left unmatched")
+	})
+
+	t.Run("dry run", func(t *testing.T) {
+		workoutStore := &fakeWorkoutStore{names: names}
+		var output bytes.Buffer
+
+		err := linkExercises(workoutStore, exerciseStore, log.New(&output, "", 0), true)
+		require.NoError(t, err)
+
+		assert.Empty(t, workoutStore.links)
+		assert.Contains(t, output.String(), "would link 4 entries, 2 left unmatched")
+	})
+
+	t.Run("store failure", func(t *testing.T) {
+		workoutStore := &fakeWorkoutStore{names: names, err: errors.New("connection lost")}
+
+		err := linkExercises(workoutStore, exerciseStore, log.New(&bytes.Buffer{}, "", 0), false)
+		assert.ErrorContains(t, err, "link-exercises: connection lost")
+	})
+}
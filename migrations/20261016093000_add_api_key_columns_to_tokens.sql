@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE tokens
+ADD COLUMN name TEXT NOT NULL DEFAULT '',
+ADD COLUMN permissions TEXT NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE tokens
+DROP COLUMN permissions,
+DROP COLUMN name;
+-- +goose StatementEnd
@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS revoked_tokens (
+    token_id TEXT PRIMARY KEY,
+    expiry TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT clock_timestamp()
+);
+
+CREATE INDEX IF NOT EXISTS revoked_tokens_revoked_at_idx ON revoked_tokens (revoked_at);
+-- revocations are pruned once their token has expired
+CREATE INDEX IF NOT EXISTS revoked_tokens_expiry_idx ON revoked_tokens (expiry);
+
+-- every way of revoking a session deletes its auth token, recording it here
+-- lets JWTs standing for the token be rejected
+CREATE OR REPLACE FUNCTION record_revoked_token() RETURNS trigger AS $$
+BEGIN
+    IF OLD.scope = 'auth' AND OLD.expiry > CURRENT_TIMESTAMP THEN
+        INSERT INTO revoked_tokens (token_id, expiry)
+        VALUES (encode(OLD.hash, 'hex'), OLD.expiry)
+        ON CONFLICT (token_id) DO NOTHING;
+    END IF;
+    RETURN OLD;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER tokens_record_revoked
+AFTER DELETE ON tokens
+FOR EACH ROW EXECUTE FUNCTION record_revoked_token();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS tokens_record_revoked ON tokens;
+DROP FUNCTION IF EXISTS record_revoked_token();
+DROP TABLE IF EXISTS revoked_tokens;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE oidc_login_states
+ADD COLUMN cookie_session BOOLEAN NOT NULL DEFAULT false;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE oidc_login_states
+DROP COLUMN cookie_session;
+-- +goose StatementEnd
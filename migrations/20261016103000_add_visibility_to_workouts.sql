@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE workouts
+ADD COLUMN visibility TEXT NOT NULL DEFAULT 'private' CHECK (visibility IN ('private', 'followers', 'public', 'unlisted')),
+ADD COLUMN share_token TEXT UNIQUE;
+
+CREATE INDEX IF NOT EXISTS workouts_user_id_visibility_idx ON workouts (user_id, visibility);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS workouts_user_id_visibility_idx;
+
+ALTER TABLE workouts
+DROP COLUMN share_token,
+DROP COLUMN visibility;
+-- +goose StatementEnd
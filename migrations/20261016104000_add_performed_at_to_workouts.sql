@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE workouts
+ADD COLUMN performed_at TIMESTAMP WITH TIME ZONE,
+ADD COLUMN timezone TEXT NOT NULL DEFAULT 'UTC';
+
+-- workouts logged so far are taken as performed when they were logged
+UPDATE workouts
+SET created_at = COALESCE(created_at, CURRENT_TIMESTAMP),
+    updated_at = COALESCE(updated_at, created_at, CURRENT_TIMESTAMP);
+
+UPDATE workouts
+SET performed_at = created_at;
+
+ALTER TABLE workouts
+ALTER COLUMN performed_at SET NOT NULL,
+ALTER COLUMN performed_at SET DEFAULT CURRENT_TIMESTAMP,
+ALTER COLUMN created_at SET NOT NULL,
+ALTER COLUMN updated_at SET NOT NULL;
+
+CREATE INDEX IF NOT EXISTS workouts_user_id_performed_at_idx ON workouts (user_id, performed_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP INDEX IF EXISTS workouts_user_id_performed_at_idx;
+
+ALTER TABLE workouts
+ALTER COLUMN created_at DROP NOT NULL,
+ALTER COLUMN updated_at DROP NOT NULL,
+DROP COLUMN timezone,
+DROP COLUMN performed_at;
+-- +goose StatementEnd
@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+-- the aggregate weight of entries is that of a set, at the same precision
+ALTER TABLE workout_entries ALTER COLUMN weight TYPE DECIMAL(6,2);
+
+CREATE TABLE IF NOT EXISTS workout_sets (
+    id BIGSERIAL PRIMARY KEY,
+    entry_id BIGINT NOT NULL REFERENCES workout_entries(id) ON DELETE CASCADE,
+    set_number INTEGER NOT NULL,
+    set_type TEXT NOT NULL DEFAULT 'working' CHECK (set_type IN ('warmup', 'working', 'drop', 'failure')),
+    reps INTEGER,
+    duration_seconds INTEGER,
+    weight DECIMAL(6,2),
+    rpe DECIMAL(3,1) CHECK (rpe BETWEEN 1 AND 10),
+    rir INTEGER CHECK (rir >= 0),
+    rest_seconds INTEGER CHECK (rest_seconds >= 0),
+    completed BOOLEAN NOT NULL DEFAULT TRUE,
+    UNIQUE (entry_id, set_number),
+    CONSTRAINT valid_workout_set CHECK (
+        (reps IS NOT NULL OR duration_seconds IS NOT NULL) AND
+        (reps IS NULL OR duration_seconds IS NULL)
+    )
+);
+
+-- entries logged so far become as many identical working sets
+INSERT INTO workout_sets (entry_id, set_number, reps, duration_seconds, weight)
+SELECT id, generate_series(1, sets), reps, duration_seconds, weight
+FROM workout_entries
+WHERE sets > 0;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS workout_sets;
+ALTER TABLE workout_entries ALTER COLUMN weight TYPE DECIMAL(5,2);
+-- +goose StatementEnd
@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+-- exercises without user_id form the shared catalog, the others are the
+-- private custom exercises of their user
+CREATE TABLE IF NOT EXISTS exercises (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    aliases TEXT[] NOT NULL DEFAULT '{}',
+    primary_muscles TEXT[] NOT NULL DEFAULT '{}',
+    secondary_muscles TEXT[] NOT NULL DEFAULT '{}',
+    equipment TEXT NOT NULL DEFAULT '',
+    mechanics TEXT NOT NULL DEFAULT '' CHECK (mechanics IN ('', 'compound', 'isolation')),
+    unit_type TEXT NOT NULL DEFAULT 'reps' CHECK (unit_type IN ('reps', 'time', 'distance')),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS exercises_catalog_name_idx ON exercises (lower(name)) WHERE user_id IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS exercises_user_name_idx ON exercises (user_id, lower(name)) WHERE user_id IS NOT NULL;
+
+ALTER TABLE workout_entries
+ADD COLUMN exercise_id BIGINT REFERENCES exercises(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS workout_entries_exercise_id_idx ON workout_entries (exercise_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE workout_entries
+DROP COLUMN exercise_id;
+
+DROP TABLE IF EXISTS exercises;
+-- +goose StatementEnd
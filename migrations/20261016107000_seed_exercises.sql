@@ -0,0 +1,48 @@
+-- +goose Up
+-- +goose StatementBegin
+INSERT INTO exercises (name, aliases, primary_muscles, secondary_muscles, equipment, mechanics, unit_type) VALUES
+('Bench press', '{"barbell bench press", "bb bench", "flat bench", "bench"}', '{"chest"}', '{"triceps", "shoulders"}', 'barbell', 'compound', 'reps'),
+('Incline bench press', '{"incline bench", "incline press"}', '{"chest"}', '{"shoulders", "triceps"}', 'barbell', 'compound', 'reps'),
+('Dumbbell bench press', '{"db bench", "db bench press", "dumbbell press"}', '{"chest"}', '{"triceps", "shoulders"}', 'dumbbell', 'compound', 'reps'),
+('Push-up', '{"push up", "pushup", "press up"}', '{"chest"}', '{"triceps", "shoulders", "core"}', 'bodyweight', 'compound', 'reps'),
+('Dip', '{"dips", "parallel bar dip"}', '{"triceps", "chest"}', '{"shoulders"}', 'bodyweight', 'compound', 'reps'),
+('Overhead press', '{"ohp", "military press", "shoulder press", "standing press"}', '{"shoulders"}', '{"triceps"}', 'barbell', 'compound', 'reps'),
+('Lateral raise', '{"side raise", "db lateral raise"}', '{"shoulders"}', '{}', 'dumbbell', 'isolation', 'reps'),
+('Back squat', '{"squat", "barbell squat", "bb squat"}', '{"quadriceps", "glutes"}', '{"hamstrings", "core"}', 'barbell', 'compound', 'reps'),
+('Front squat', '{"fs"}', '{"quadriceps"}', '{"glutes", "core"}', 'barbell', 'compound', 'reps'),
+('Goblet squat', '{}', '{"quadriceps", "glutes"}', '{"core"}', 'kettlebell', 'compound', 'reps'),
+('Leg press', '{}', '{"quadriceps", "glutes"}', '{"hamstrings"}', 'machine', 'compound', 'reps'),
+('Lunge', '{"lunges", "walking lunge"}', '{"quadriceps", "glutes"}', '{"hamstrings"}', 'bodyweight', 'compound', 'reps'),
+('Deadlift', '{"conventional deadlift", "dl"}', '{"hamstrings", "glutes", "back"}', '{"forearms", "core"}', 'barbell', 'compound', 'reps'),
+('Romanian deadlift', '{"rdl", "stiff leg deadlift"}', '{"hamstrings", "glutes"}', '{"back"}', 'barbell', 'compound', 'reps'),
+('Hip thrust', '{"barbell hip thrust", "glute bridge"}', '{"glutes"}', '{"hamstrings"}', 'barbell', 'compound', 'reps'),
+('Leg curl', '{"hamstring curl", "lying leg curl"}', '{"hamstrings"}', '{}', 'machine', 'isolation', 'reps'),
+('Leg extension', '{"quad extension"}', '{"quadriceps"}', '{}', 'machine', 'isolation', 'reps'),
+('Calf raise', '{"standing calf raise", "calf raises"}', '{"calves"}', '{}', 'machine', 'isolation', 'reps'),
+('Pull-up', '{"pull up", "pullup", "chin-up", "chin up"}', '{"back"}', '{"biceps"}', 'bodyweight', 'compound', 'reps'),
+('Lat pulldown', '{"pulldown", "lat pull down"}', '{"back"}', '{"biceps"}', 'cable', 'compound', 'reps'),
+('Barbell row', '{"bent over row", "bb row", "pendlay row"}', '{"back"}', '{"biceps", "forearms"}', 'barbell', 'compound', 'reps'),
+('Dumbbell row', '{"db row", "one arm row"}', '{"back"}', '{"biceps"}', 'dumbbell', 'compound', 'reps'),
+('Seated cable row', '{"cable row", "seated row"}', '{"back"}', '{"biceps"}', 'cable', 'compound', 'reps'),
+('Face pull', '{"face pulls"}', '{"shoulders"}', '{"back"}', 'cable', 'isolation', 'reps'),
+('Biceps curl', '{"curl", "bicep curl", "barbell curl", "db curl"}', '{"biceps"}', '{"forearms"}', 'dumbbell', 'isolation', 'reps'),
+('Hammer curl', '{}', '{"biceps", "forearms"}', '{}', 'dumbbell', 'isolation', 'reps'),
+('Triceps pushdown', '{"tricep pushdown", "pushdown", "rope pushdown"}', '{"triceps"}', '{}', 'cable', 'isolation', 'reps'),
+('Skull crusher', '{"skullcrusher", "lying triceps extension"}', '{"triceps"}', '{}', 'barbell', 'isolation', 'reps'),
+('Plank', '{"front plank"}', '{"core"}', '{"shoulders"}', 'bodyweight', 'isolation', 'time'),
+('Abdominal crunch', '{"crunch", "crunches", "sit up", "sit-up"}', '{"core"}', '{}', 'bodyweight', 'isolation', 'reps'),
+('Hanging leg raise', '{"leg raise", "hanging knee raise"}', '{"core"}', '{}', 'bodyweight', 'isolation', 'reps'),
+('Kettlebell swing', '{"kb swing", "swing"}', '{"glutes", "hamstrings"}', '{"core", "back"}', 'kettlebell', 'compound', 'reps'),
+('Burpee', '{"burpees"}', '{"full body"}', '{}', 'bodyweight', 'compound', 'reps'),
+('Run', '{"running", "jog", "jogging"}', '{"cardio"}', '{"quadriceps", "calves"}', 'none', '', 'distance'),
+('Cycling', '{"bike", "cycle", "spinning"}', '{"cardio"}', '{"quadriceps"}', 'none', '', 'distance'),
+('Rowing machine', '{"row erg", "erg", "rower", "rowing"}', '{"cardio"}', '{"back", "quadriceps"}', 'machine', '', 'distance'),
+('Jump rope', '{"skipping", "skipping rope"}', '{"cardio"}', '{"calves"}', 'none', '', 'time'),
+('Swimming', '{"swim"}', '{"cardio"}', '{"back", "shoulders"}', 'none', '', 'distance')
+ON CONFLICT DO NOTHING;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DELETE FROM exercises WHERE user_id IS NULL;
+-- +goose StatementEnd